@@ -7,7 +7,6 @@ import (
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.AckType {
@@ -19,9 +18,10 @@ func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.Ack
 	}
 }
 
-func handlerMove(gs *gamelogic.GameState, ch *amqp.Channel) func(gamelogic.ArmyMove) pubsub.AckType {
-	return func(am gamelogic.ArmyMove) pubsub.AckType {
+func handlerMove(gs *gamelogic.GameState, publisher pubsub.Publisher) func(pubsub.Delivery[gamelogic.ArmyMove]) pubsub.AckType {
+	return func(d pubsub.Delivery[gamelogic.ArmyMove]) pubsub.AckType {
 		defer fmt.Println()
+		am := d.Body
 		moveOutCome := gs.HandleMove(am)
 
 		switch moveOutCome {
@@ -33,13 +33,15 @@ func handlerMove(gs *gamelogic.GameState, ch *amqp.Channel) func(gamelogic.ArmyM
 			routingKey := fmt.Sprintf("%s.%s", routing.WarRecognitionsPrefix, gs.Player.Username)
 
 			if err := pubsub.PublishJSON(
-				ch,
+				publisher,
 				routing.ExchangePerilTopic,
 				routingKey,
 				gamelogic.RecognitionOfWar{
 					Attacker: am.Player,
 					Defender: gs.GetPlayerSnap(),
 				},
+				pubsub.WithCausedBy(d.Meta),
+				compressPlayers,
 			); err != nil {
 				return pubsub.NackRequeue
 			}
@@ -50,26 +52,26 @@ func handlerMove(gs *gamelogic.GameState, ch *amqp.Channel) func(gamelogic.ArmyM
 	}
 }
 
-func handlerWar(gs *gamelogic.GameState, ch *amqp.Channel) func(rw gamelogic.RecognitionOfWar) pubsub.AckType {
-	return func(rw gamelogic.RecognitionOfWar) pubsub.AckType {
+func handlerWar(gs *gamelogic.GameState, publisher pubsub.Publisher) func(pubsub.Delivery[gamelogic.RecognitionOfWar]) pubsub.AckType {
+	return func(d pubsub.Delivery[gamelogic.RecognitionOfWar]) pubsub.AckType {
 		defer fmt.Print("> ")
 
-		outcome, winner, loser := gs.HandleWar(rw)
+		outcome, winner, loser := gs.HandleWar(d.Body)
 
 		switch outcome {
 		case gamelogic.WarOutcomeNotInvolved:
-			return pubsub.NackRequeue
+			return pubsub.RetryLater
 		case gamelogic.WarOutcomeNoUnits:
 			return pubsub.NackDiscard
 		case gamelogic.WarOutcomeOpponentWon:
 			message := fmt.Sprintf("%s won a war against %s", winner, loser)
-			return pubsub.PublishGameLog(ch, message, gs.GetPlayerSnap().Username)
+			return pubsub.PublishGameLog(publisher, message, gs.GetPlayerSnap().Username, pubsub.WithCausedBy(d.Meta))
 		case gamelogic.WarOutcomeYouWon:
 			message := fmt.Sprintf("%s won a war against %s", winner, loser)
-			return pubsub.PublishGameLog(ch, message, gs.GetPlayerSnap().Username)
+			return pubsub.PublishGameLog(publisher, message, gs.GetPlayerSnap().Username, pubsub.WithCausedBy(d.Meta))
 		case gamelogic.WarOutcomeDraw:
 			message := fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
-			return pubsub.PublishGameLog(ch, message, gs.GetPlayerSnap().Username)
+			return pubsub.PublishGameLog(publisher, message, gs.GetPlayerSnap().Username, pubsub.WithCausedBy(d.Meta))
 		default:
 			log.Print("Outcome not recognized")
 			return pubsub.NackDiscard
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"sync"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// serverKeys looks up other players' signing keys from the server and keeps
+// the ones it finds, since a player's key never changes.
+type serverKeys struct {
+	rpc *pubsub.RPCClient
+
+	mu   sync.Mutex
+	keys map[string]ed25519.PublicKey
+}
+
+func newServerKeys(rpc *pubsub.RPCClient) *serverKeys {
+	return &serverKeys{rpc: rpc, keys: map[string]ed25519.PublicKey{}}
+}
+
+func (s *serverKeys) PublicKey(username string) (ed25519.PublicKey, error) {
+	s.mu.Lock()
+	key, ok := s.keys[username]
+	s.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	resp, err := pubsub.Call[routing.PlayerKeyRequest, routing.PlayerKey](
+		context.Background(),
+		s.rpc,
+		routing.ExchangePerilDirect,
+		routing.PlayerKeyLookupKey,
+		routing.PlayerKeyRequest{Username: username},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.PublicKey) == 0 {
+		return nil, pubsub.ErrUnknownSigner
+	}
+
+	s.mu.Lock()
+	s.keys[username] = resp.PublicKey
+	s.mu.Unlock()
+
+	return resp.PublicKey, nil
+}
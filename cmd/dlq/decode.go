@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// decodeBody renders a dead letter's body for humans. JSON is
+// pretty-printed; binary codecs need a concrete type, which is picked from
+// the routing key prefix, and the codec from the content type (gob for
+// messages that predate content types). Compressed bodies are decompressed
+// first. Encrypted bodies can't be read here and anything else is hex
+// dumped.
+func decodeBody(dl pubsub.DeadLetter) string {
+	if keyId, ok := dl.Headers[pubsub.KeyIdHeader].(string); ok {
+		return fmt.Sprintf("encrypted with key %s\n%s", keyId, hex.Dump(dl.Body))
+	}
+
+	body, err := pubsub.Decompress(dl.ContentEncoding, dl.Body)
+	if err != nil {
+		return fmt.Sprintf("%v\n%s", err, hex.Dump(dl.Body))
+	}
+
+	if json.Valid(body) {
+		var out bytes.Buffer
+		if err := json.Indent(&out, body, "", "  "); err == nil {
+			return out.String()
+		}
+	}
+
+	codec, ok := pubsub.CodecFor(dl.ContentType)
+	if !ok {
+		codec = pubsub.Gob
+	}
+
+	if target := bodyTarget(dl.RoutingKey); target != nil {
+		if err := codec.Unmarshal(body, target); err == nil {
+			return fmt.Sprintf("%+v", reflect.ValueOf(target).Elem().Interface())
+		}
+	}
+
+	return hex.Dump(body)
+}
+
+func bodyTarget(key string) any {
+	prefix, _, _ := strings.Cut(key, ".")
+
+	switch prefix {
+	case routing.GameLogSlug:
+		return &routing.GameLog{}
+	case routing.ArmyMovesPrefix:
+		return &gamelogic.ArmyMove{}
+	case routing.WarRecognitionsPrefix:
+		return &gamelogic.RecognitionOfWar{}
+	case routing.PauseKey:
+		return &routing.PlayingState{}
+	default:
+		return nil
+	}
+}
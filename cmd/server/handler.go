@@ -1,19 +1,62 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
-func handlerLog() func(gl routing.GameLog) pubsub.AckType {
-	return func(gl routing.GameLog) pubsub.AckType {
-		if err := gamelogic.WriteLog(gl); err != nil {
+func handlerLog() func(pubsub.Delivery[routing.GameLog]) pubsub.AckType {
+	return func(d pubsub.Delivery[routing.GameLog]) pubsub.AckType {
+		log.Printf("game log %s from %s (correlation %s, caused by %s)", d.Meta.MessageId, d.Meta.AppId, d.Meta.CorrelationId, d.Meta.CausationId)
+
+		if err := gamelogic.WriteLog(d.Body); err != nil {
 			fmt.Printf("error writing log: %v\n", err)
 			return pubsub.NackRequeue
 		}
 		return pubsub.Ack
 	}
 }
+
+func handlerStatus(paused *atomic.Bool) func(pubsub.Delivery[routing.GameStatusRequest]) (routing.GameStatus, error) {
+	return func(d pubsub.Delivery[routing.GameStatusRequest]) (routing.GameStatus, error) {
+		log.Printf("%s asked for the game status", d.Body.Username)
+
+		return routing.GameStatus{
+			IsPaused:   paused.Load(),
+			ServerTime: time.Now(),
+		}, nil
+	}
+}
+
+func handlerRegisterKey(ring *pubsub.KeyRing) func(pubsub.Delivery[routing.PlayerKey]) (routing.PlayerKey, error) {
+	return func(d pubsub.Delivery[routing.PlayerKey]) (routing.PlayerKey, error) {
+		if err := ring.Register(d.Body.Username, d.Body.PublicKey); err != nil {
+			log.Printf("Refused key for %s: %v", d.Body.Username, err)
+			return routing.PlayerKey{}, err
+		}
+		log.Printf("Registered key for %s", d.Body.Username)
+
+		return d.Body, nil
+	}
+}
+
+func handlerLookupKey(ring *pubsub.KeyRing) func(pubsub.Delivery[routing.PlayerKeyRequest]) (routing.PlayerKey, error) {
+	return func(d pubsub.Delivery[routing.PlayerKeyRequest]) (routing.PlayerKey, error) {
+		key, err := ring.PublicKey(d.Body.Username)
+		if errors.Is(err, pubsub.ErrUnknownSigner) {
+			return routing.PlayerKey{Username: d.Body.Username}, nil
+		}
+		if err != nil {
+			return routing.PlayerKey{}, err
+		}
+
+		return routing.PlayerKey{Username: d.Body.Username, PublicKey: key}, nil
+	}
+}
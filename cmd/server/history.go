@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/topology"
+)
+
+// historyIdle is how long the history stream may stay quiet before we
+// assume it has been read to the end.
+const historyIdle = time.Second
+
+// printHistory prints the game logs written since since, read from the game
+// history stream.
+func printHistory(ctx context.Context, broker pubsub.Broker, since time.Time) error {
+	received := make(chan struct{}, 1)
+
+	sub, err := pubsub.SubscribeGob(
+		ctx,
+		broker,
+		routing.ExchangePerilTopic,
+		topology.GameHistoryStream,
+		topology.GameLogsKey,
+		pubsub.Stream,
+		func(gl routing.GameLog) pubsub.AckType {
+			// The stream works in chunks, so skip what came before since.
+			if !gl.CurrentTime.Before(since) {
+				fmt.Printf("%v %v: %v\n", gl.CurrentTime.Format(time.RFC3339), gl.Username, gl.Message)
+			}
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+			return pubsub.Ack
+		},
+		pubsub.WithStreamOffset(pubsub.StreamSince(since)),
+	)
+	if err != nil {
+		return err
+	}
+
+	idle := time.NewTimer(historyIdle)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-received:
+			idle.Reset(historyIdle)
+		case <-idle.C:
+			return sub.Close()
+		case <-sub.Done():
+			return sub.Err()
+		}
+	}
+}
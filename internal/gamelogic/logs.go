@@ -15,6 +15,7 @@ const writeToDiskSleep = 1 * time.Second
 
 func WriteLog(gamelog routing.GameLog) error {
 	log.Printf("received game log...")
+	defer func(start time.Time) { logWriteSeconds.With().ObserveDuration(time.Since(start)) }(time.Now())
 	time.Sleep(writeToDiskSleep)
 
 	f, err := os.OpenFile(logsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -0,0 +1,46 @@
+package gamelogic
+
+import "github.com/bootdotdev/learn-pub-sub-starter/internal/metrics"
+
+var (
+	warsTotal = metrics.NewCounter("gamelogic_wars_total",
+		"Wars handled by this player, by outcome.", "outcome")
+	unitsSpawnedTotal = metrics.NewCounter("gamelogic_units_spawned_total",
+		"Units spawned, by rank.", "rank")
+	movesTotal = metrics.NewCounter("gamelogic_moves_total",
+		"Moves made by this player.")
+	moveOutcomesTotal = metrics.NewCounter("gamelogic_move_outcomes_total",
+		"Moves handled by this player, by outcome.", "outcome")
+	logWriteSeconds = metrics.NewHistogram("gamelogic_log_write_duration_seconds",
+		"Time spent writing game logs to disk.", nil)
+)
+
+func (o WarOutcome) String() string {
+	switch o {
+	case WarOutcomeNotInvolved:
+		return "not_involved"
+	case WarOutcomeNoUnits:
+		return "no_units"
+	case WarOutcomeYouWon:
+		return "won"
+	case WarOutcomeOpponentWon:
+		return "lost"
+	case WarOutcomeDraw:
+		return "draw"
+	default:
+		return "unknown"
+	}
+}
+
+func (o MoveOutcome) String() string {
+	switch o {
+	case MoveOutcomeSamePlayer:
+		return "same_player"
+	case MoveOutComeSafe:
+		return "safe"
+	case MoveOutcomeMakeWar:
+		return "make_war"
+	default:
+		return "unknown"
+	}
+}
@@ -14,8 +14,9 @@ const (
 	MoveOutcomeMakeWar
 )
 
-func (gs *GameState) HandleMove(move ArmyMove) MoveOutcome {
+func (gs *GameState) HandleMove(move ArmyMove) (outcome MoveOutcome) {
 	defer fmt.Println("------------------------")
+	defer func() { moveOutcomesTotal.With(outcome.String()).Inc() }()
 	player := gs.GetPlayerSnap()
 
 	fmt.Println()
@@ -87,6 +88,7 @@ func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
 		Units:      newUnits,
 		Player:     gs.GetPlayerSnap(),
 	}
+	movesTotal.With().Inc()
 	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
 	return mv, nil
 }
@@ -8,10 +8,9 @@ import (
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func (gs *GameState) CommandSpam(ch *amqp.Channel, words []string) error {
+func (gs *GameState) CommandSpam(ch pubsub.Publisher, words []string) error {
 	if len(words) < 2 {
 		return errors.New("usage: spam <spamNumber>")
 	}
@@ -26,11 +25,13 @@ func (gs *GameState) CommandSpam(ch *amqp.Channel, words []string) error {
 
 	for i := 0; i < spamNumber; i++ {
 		maliciousLog := GetMaliciousLog()
-		pubsub.PublishGob(ch, routing.ExchangePerilTopic, key, routing.GameLog{
+		if err := pubsub.PublishGob(ch, routing.ExchangePerilTopic, key, routing.GameLog{
 			CurrentTime: time.Now(),
 			Message:     maliciousLog,
 			Username:    gs.GetUsername(),
-		})
+		}); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -29,6 +29,8 @@ func (gs *GameState) CommandSpawn(words []string) error {
 		Location: Location(locationName),
 	})
 
+	unitsSpawnedTotal.With(rank).Inc()
+
 	fmt.Printf("Spawned a(n) %s in %s with id %v\n", rank, locationName, id)
 	return nil
 }
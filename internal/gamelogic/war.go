@@ -15,6 +15,7 @@ const (
 )
 
 func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner string, loser string) {
+	defer func() { warsTotal.With(outcome.String()).Inc() }()
 	defer fmt.Println("------------------------")
 	fmt.Println()
 	fmt.Println("==== War Declared ====")
@@ -0,0 +1,352 @@
+// Package metrics keeps counters and histograms in memory and serves them in
+// the Prometheus text exposition format, so they can be scraped by
+// Prometheus or simply read with curl.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets suit handler latencies, from a millisecond to ten seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds a set of metrics. Metrics are created once, usually in
+// package variables, and are safe for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]collector
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// Default is the registry the package-level constructors register with and
+// Handler serves.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]collector{}}
+}
+
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounter(name, help, labels...)
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewCounter registers a counter with the given label names. Registering
+// the same name twice panics.
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{family: newFamily(name, help, "counter", labels)}
+	r.register(name, c)
+	return c
+}
+
+// NewHistogram registers a histogram with the given upper bounds, which
+// must be sorted, and label names. A nil buckets uses DefaultBuckets.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{family: newFamily(name, help, "histogram", labels), buckets: buckets}
+	r.register(name, h)
+	return h
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.metrics[name] = c
+}
+
+// WriteTo writes every metric in the text exposition format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	collectors := make([]collector, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		collectors[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, c := range collectors {
+		c.write(cw)
+	}
+
+	return cw.n, cw.flush()
+}
+
+// Handler serves the registry on any path.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// Handler serves the default registry.
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// Serve serves the default registry on addr at /metrics until the server
+// fails.
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	return server.ListenAndServe()
+}
+
+// family is what counters and histograms share: their description and one
+// child per combination of label values.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu       sync.RWMutex
+	children map[string]any
+}
+
+func newFamily(name, help, kind string, labels []string) family {
+	return family{name: name, help: help, kind: kind, labels: labels, children: map[string]any{}}
+}
+
+// child returns the child for values, creating it with create the first
+// time they are seen.
+func (f *family) child(values []string, create func() any) any {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.RLock()
+	c, ok := f.children[key]
+	f.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if c, ok := f.children[key]; ok {
+		return c
+	}
+	c = create()
+	f.children[key] = c
+
+	return c
+}
+
+// each calls fn for every child in a stable order with its label pairs
+// already formatted.
+func (f *family) each(fn func(labels string, child any)) {
+	f.mu.RLock()
+	keys := make([]string, 0, len(f.children))
+	for key := range f.children {
+		keys = append(keys, key)
+	}
+	children := make([]any, len(keys))
+	sort.Strings(keys)
+	for i, key := range keys {
+		children[i] = f.children[key]
+	}
+	f.mu.RUnlock()
+
+	for i, key := range keys {
+		var pairs []string
+		if len(f.labels) > 0 {
+			for j, value := range strings.Split(key, "\xff") {
+				pairs = append(pairs, f.labels[j]+`="`+escape(value)+`"`)
+			}
+		}
+		fn(strings.Join(pairs, ","), children[i])
+	}
+}
+
+func (f *family) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// CounterVec is a counter split by label values.
+type CounterVec struct {
+	family
+}
+
+// Counter only goes up.
+type Counter struct {
+	bits atomic.Uint64
+}
+
+// With returns the counter for the given label values, in the order the
+// label names were registered.
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.child(values, func() any { return &Counter{} }).(*Counter)
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds n, which must not be negative.
+func (c *Counter) Add(n float64) {
+	if n < 0 {
+		panic("metrics: counter decreased")
+	}
+	for {
+		old := c.bits.Load()
+		if c.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+n)) {
+			return
+		}
+	}
+}
+
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.header(w)
+	v.each(func(labels string, child any) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, braces(labels), formatFloat(child.(*Counter).Value()))
+	})
+}
+
+// HistogramVec is a histogram split by label values.
+type HistogramVec struct {
+	family
+	buckets []float64
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.child(values, func() any {
+		return &Histogram{buckets: v.buckets, counts: make([]uint64, len(v.buckets))}
+	}).(*Histogram)
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// ObserveDuration observes d in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	v.header(w)
+	v.each(func(labels string, child any) {
+		h := child.(*Histogram)
+		h.mu.Lock()
+		counts := append([]uint64{}, h.counts...)
+		count, sum := h.count, h.sum
+		h.mu.Unlock()
+
+		sep := ""
+		if labels != "" {
+			sep = ","
+		}
+		for i, bound := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", v.name, labels, sep, formatFloat(bound), counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", v.name, labels, sep, count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, braces(labels), formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, braces(labels), count)
+	})
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+func (c *countingWriter) flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.w.Flush()
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func exposition(t *testing.T, r *Registry) string {
+	t.Helper()
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.String()
+}
+
+func TestCounterExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("moves_total", "Moves made,\nby player.", "player")
+	c.With("bob").Inc()
+	c.With(`al"ice`).Add(2.5)
+	c.With("bob").Inc()
+
+	want := `# HELP moves_total Moves made,\nby player.
+# TYPE moves_total counter
+moves_total{player="al\"ice"} 2.5
+moves_total{player="bob"} 2
+`
+	if got := exposition(t, r); got != want {
+		t.Errorf("exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("wait_seconds", "Time waited.", []float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.5, 0.5, 3} {
+		h.With().Observe(v)
+	}
+
+	want := `# HELP wait_seconds Time waited.
+# TYPE wait_seconds histogram
+wait_seconds_bucket{le="0.1"} 1
+wait_seconds_bucket{le="1"} 3
+wait_seconds_bucket{le="+Inf"} 4
+wait_seconds_sum 4.05
+wait_seconds_count 4
+`
+	if got := exposition(t, r); got != want {
+		t.Errorf("exposition:\n%s\nwant:\n%s", got, want)
+	}
+
+	labelled := r.NewHistogram("handle_seconds", "Time handling.", []float64{1}, "queue")
+	labelled.With("moves").Observe(2)
+	if got := exposition(t, r); !strings.Contains(got, `handle_seconds_bucket{queue="moves",le="1"} 0
+handle_seconds_bucket{queue="moves",le="+Inf"} 1
+handle_seconds_sum{queue="moves"} 2
+handle_seconds_count{queue="moves"} 1
+`) {
+		t.Errorf("labelled histogram:\n%s", got)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("b_total", "B.")
+	r.NewCounter("a_total", "A.")
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("served as %q", rec.Header().Get("Content-Type"))
+	}
+	if strings.Index(body, "a_total") > strings.Index(body, "b_total") {
+		t.Errorf("metrics not sorted by name:\n%s", body)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registered a_total twice")
+		}
+	}()
+	r.NewCounter("a_total", "Again.")
+}
@@ -0,0 +1,283 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Defaults for NewBatchPublisher.
+const (
+	defaultBatchCount  = 100
+	defaultBatchBytes  = 1 << 20
+	defaultBatchLinger = 50 * time.Millisecond
+)
+
+// BatchResult is the outcome of one message published through a
+// BatchPublisher.
+type BatchResult struct {
+	Exchange  string
+	Key       string
+	MessageId string
+	Err       error
+}
+
+// BatchPublisher collects messages and publishes them in batches through a
+// ConfirmingPublisher or PublisherPool. A batch is sent once it reaches the
+// count or byte limit, or when the oldest message in it has waited for the
+// linger duration. All messages in a batch are published back to back and their
+// confirms are awaited together. It is safe for concurrent use.
+type BatchPublisher struct {
+	pub      AsyncPublisher
+	maxCount int
+	maxBytes int
+	linger   time.Duration
+	onResult func(BatchResult)
+
+	mu          sync.Mutex
+	batch       []batchEntry
+	bytes       int
+	timer       *time.Timer
+	sent        uint64
+	outstanding int
+	idle        chan struct{}
+	failed      []error
+	closed      bool
+	// published is closed once the last batch handed to send is out.
+	published chan struct{}
+}
+
+type batchEntry struct {
+	exchange     string
+	key          string
+	mandatory    bool
+	immediate    bool
+	msg          amqp.Publishing
+	confirmation *PublishConfirmation
+}
+
+type BatchOption func(*BatchPublisher)
+
+// WithBatchSize caps a batch at count messages or bytes of message bodies,
+// whichever is reached first. Zero leaves a limit unset.
+func WithBatchSize(count, bytes int) BatchOption {
+	return func(b *BatchPublisher) {
+		b.maxCount = count
+		b.maxBytes = bytes
+	}
+}
+
+// WithLinger sets how long a message may wait for its batch to fill.
+func WithLinger(d time.Duration) BatchOption {
+	return func(b *BatchPublisher) {
+		b.linger = d
+	}
+}
+
+// WithBatchResults calls fn with the outcome of every message.
+func WithBatchResults(fn func(BatchResult)) BatchOption {
+	return func(b *BatchPublisher) {
+		b.onResult = fn
+	}
+}
+
+func NewBatchPublisher(pub AsyncPublisher, opts ...BatchOption) *BatchPublisher {
+	b := &BatchPublisher{
+		pub:      pub,
+		maxCount: defaultBatchCount,
+		maxBytes: defaultBatchBytes,
+		linger:   defaultBatchLinger,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b
+}
+
+// PublishWithContext queues msg and returns straight away, which lets
+// Publish, PublishJSON and PublishGob be used with a BatchPublisher. Failures
+// are reported by Flush and WithBatchResults; use Enqueue to follow a single
+// message.
+func (b *BatchPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	_, err := b.Enqueue(ctx, exchange, key, mandatory, immediate, msg)
+	return err
+}
+
+// Enqueue queues msg and returns a confirmation that resolves once its batch
+// has been published and the broker has answered for it.
+func (b *BatchPublisher) Enqueue(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*PublishConfirmation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	confirmation := &PublishConfirmation{done: make(chan struct{})}
+	b.batch = append(b.batch, batchEntry{
+		exchange:     exchange,
+		key:          key,
+		mandatory:    mandatory,
+		immediate:    immediate,
+		msg:          msg,
+		confirmation: confirmation,
+	})
+	b.bytes += len(msg.Body)
+
+	switch {
+	case b.maxCount > 0 && len(b.batch) >= b.maxCount,
+		b.maxBytes > 0 && b.bytes >= b.maxBytes:
+		b.send()
+	case len(b.batch) == 1 && b.linger > 0:
+		sent := b.sent
+		b.timer = time.AfterFunc(b.linger, func() { b.lingered(sent) })
+	case b.linger <= 0:
+		b.send()
+	}
+
+	return confirmation, nil
+}
+
+// Flush sends whatever is queued, waits for every outstanding confirm and
+// returns the failures since the last Flush joined together.
+func (b *BatchPublisher) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	b.send()
+	idle := b.idle
+	b.mu.Unlock()
+
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := errors.Join(b.failed...)
+	b.failed = nil
+
+	return err
+}
+
+// Close flushes and stops accepting messages. The underlying publisher is
+// left open.
+func (b *BatchPublisher) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	return b.Flush(context.Background())
+}
+
+// lingered sends the batch the timer was started for, unless it has already
+// gone out.
+func (b *BatchPublisher) lingered(sent uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sent == sent {
+		b.send()
+	}
+}
+
+// send publishes the current batch without waiting for confirms. The batch
+// lock must be held. The publishing happens once the previous batch is out,
+// which keeps batches in order, but without the lock, so that a blocked
+// broker doesn't stall Enqueue and Flush.
+func (b *BatchPublisher) send() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.batch) == 0 {
+		return
+	}
+
+	batch := b.batch
+	b.batch = nil
+	b.bytes = 0
+	b.sent++
+
+	prev := b.published
+	published := make(chan struct{})
+	b.published = published
+
+	if b.outstanding == 0 {
+		b.idle = make(chan struct{})
+	}
+	b.outstanding++
+
+	// Publishes held until the broker unblocks give up at the same
+	// deadline, so ctx lives until they settle.
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultPublishTimeout)
+
+	go func() {
+		defer b.settled()
+		defer cancel()
+
+		if prev != nil {
+			<-prev
+		}
+		confirmations := make([]*PublishConfirmation, len(batch))
+		errs := make([]error, len(batch))
+		for i, e := range batch {
+			confirmations[i], errs[i] = b.pub.PublishAsync(ctx, e.exchange, e.key, e.mandatory, e.immediate, e.msg)
+		}
+		close(published)
+
+		for i, e := range batch {
+			err := errs[i]
+			if err == nil {
+				err = confirmations[i].Wait(context.Background())
+			}
+			b.resolve(e, err)
+		}
+	}()
+}
+
+func (b *BatchPublisher) settled() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.outstanding--
+	if b.outstanding == 0 {
+		close(b.idle)
+		b.idle = nil
+	}
+}
+
+func (b *BatchPublisher) resolve(e batchEntry, err error) {
+	e.confirmation.err = err
+	close(e.confirmation.done)
+
+	if err != nil {
+		b.mu.Lock()
+		b.failed = append(b.failed, err)
+		b.mu.Unlock()
+	}
+
+	if b.onResult != nil {
+		b.onResult(BatchResult{
+			Exchange:  e.exchange,
+			Key:       e.key,
+			MessageId: e.msg.MessageId,
+			Err:       err,
+		})
+	}
+}
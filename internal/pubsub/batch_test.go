@@ -0,0 +1,205 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestBatchSendsWhenFull(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	batcher := NewBatchPublisher(newTestConfirmingPublisher(t, conn), WithBatchSize(3, 0), WithLinger(time.Hour))
+
+	ctx := context.Background()
+	var confirmations []*PublishConfirmation
+	for _, body := range []string{"a", "b", "c"} {
+		if got := queued(t, ch, "batch"); len(got) != 0 {
+			t.Fatalf("%v sent before the batch was full", got)
+		}
+		confirmation, err := batcher.Enqueue(ctx, testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte(body)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		confirmations = append(confirmations, confirmation)
+	}
+
+	for _, confirmation := range confirmations {
+		if err := confirmation.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := queued(t, ch, "batch"); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("queue holds %v, want [a b c]", got)
+	}
+}
+
+func TestBatchByteLimit(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	batcher := NewBatchPublisher(newTestConfirmingPublisher(t, conn), WithBatchSize(0, 10), WithLinger(time.Hour))
+
+	ctx := context.Background()
+	batcher.Enqueue(ctx, testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte("12345")})
+	confirmation, err := batcher.Enqueue(ctx, testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte("67890")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := confirmation.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 2 {
+		t.Errorf("queue holds %v, want both messages", got)
+	}
+}
+
+func TestBatchLinger(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	batcher := NewBatchPublisher(newTestConfirmingPublisher(t, conn), WithBatchSize(100, 0), WithLinger(20*time.Millisecond))
+
+	if err := PublishJSON(batcher, testExchange, "batch.ok", "late"); err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 0 {
+		t.Fatalf("%v sent before the linger ran out", got)
+	}
+
+	if err := batcher.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 1 {
+		t.Fatalf("queue holds %v after Flush", got)
+	}
+
+	start := time.Now()
+	confirmation, err := batcher.Enqueue(context.Background(), testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte("lingered")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := confirmation.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("sent after %v, before the linger", waited)
+	}
+}
+
+func TestBatchReportsFailures(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+
+	var mu sync.Mutex
+	var results []BatchResult
+	batcher := NewBatchPublisher(
+		newTestConfirmingPublisher(t, conn, WithMandatory()),
+		WithBatchSize(10, 0),
+		WithLinger(time.Hour),
+		WithBatchResults(func(r BatchResult) {
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+		}),
+	)
+
+	ctx := context.Background()
+	batcher.PublishWithContext(ctx, testExchange, "batch.ok", false, false, amqp.Publishing{MessageId: "routed", Body: []byte("ok")})
+	batcher.PublishWithContext(ctx, testExchange, "batch.nowhere", false, false, amqp.Publishing{MessageId: "lost", Body: []byte("lost")})
+
+	err := batcher.Flush(ctx)
+	var returned *ReturnedError
+	if !errors.As(err, &returned) || returned.Key != "batch.nowhere" {
+		t.Fatalf("Flush() = %v, want the unroutable message returned", err)
+	}
+	if err := batcher.Flush(ctx); err != nil {
+		t.Errorf("second Flush() = %v, want the failure reported once", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(results) != 2 || results[0].MessageId != "routed" || results[0].Err != nil || results[1].MessageId != "lost" || results[1].Err == nil {
+		t.Errorf("results %+v", results)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 1 {
+		t.Errorf("queue holds %v", got)
+	}
+}
+
+func TestBatchClose(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	batcher := NewBatchPublisher(newTestConfirmingPublisher(t, conn), WithLinger(time.Hour))
+
+	if err := PublishJSON(batcher, testExchange, "batch.ok", "last"); err != nil {
+		t.Fatal(err)
+	}
+	if err := batcher.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 1 {
+		t.Errorf("queue holds %v after Close", got)
+	}
+
+	if err := PublishJSON(batcher, testExchange, "batch.ok", "too late"); !errors.Is(err, amqp.ErrClosed) {
+		t.Errorf("publish after Close = %v, want ErrClosed", err)
+	}
+}
+
+// stuckPublisher is a broker blocking publishers until release is closed.
+type stuckPublisher struct {
+	release chan struct{}
+
+	mu   sync.Mutex
+	keys []string
+}
+
+func (p *stuckPublisher) PublishAsync(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*PublishConfirmation, error) {
+	<-p.release
+
+	p.mu.Lock()
+	p.keys = append(p.keys, key)
+	p.mu.Unlock()
+
+	confirmation := &PublishConfirmation{done: make(chan struct{})}
+	confirmation.resolve(nil)
+	return confirmation, nil
+}
+
+// TestBatchBlockedBroker checks that a batch stuck on a blocked broker holds
+// up neither callers nor the batches behind it being sent in order.
+func TestBatchBlockedBroker(t *testing.T) {
+	pub := &stuckPublisher{release: make(chan struct{})}
+	batcher := NewBatchPublisher(pub, WithBatchSize(1, 0))
+
+	returned := make(chan error, 1)
+	go func() {
+		for _, key := range []string{"first", "second", "third"} {
+			if err := PublishJSON(batcher, testExchange, key, key); err != nil {
+				returned <- err
+				return
+			}
+		}
+		returned <- nil
+	}()
+	if err := receive(t, returned); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := batcher.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Flush() while blocked = %v", err)
+	}
+
+	close(pub.release)
+	if err := batcher.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.keys) != 3 || pub.keys[0] != "first" || pub.keys[1] != "second" || pub.keys[2] != "third" {
+		t.Errorf("published %v", pub.keys)
+	}
+}
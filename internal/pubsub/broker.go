@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publisher is anything that can publish to an exchange. *amqp.Channel
+// satisfies it, as do the channels handed out by the in-memory broker.
+type Publisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Channel is the subset of *amqp.Channel that pubsub relies on.
+type Channel interface {
+	Publisher
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	QueuePurge(name string, noWait bool) (int, error)
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Cancel(consumer string, noWait bool) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(returns chan amqp.Return) chan amqp.Return
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Broker hands out channels. It stands in for *amqp.Connection so that the
+// subscribe path can run against RabbitMQ or the in-memory broker alike.
+type Broker interface {
+	Channel() (Channel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Blocker is a Broker that reports RabbitMQ's connection.blocked and
+// connection.unblocked notifications, sent while a memory or disk alarm
+// stops the broker from accepting publishes. Brokers from Dial, the
+// in-memory broker and Manager implement it.
+type Blocker interface {
+	NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking
+}
+
+type amqpBroker struct {
+	conn *amqp.Connection
+}
+
+func NewAMQPBroker(conn *amqp.Connection) Broker {
+	return &amqpBroker{conn: conn}
+}
+
+func Dial(url string) (Broker, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAMQPBroker(conn), nil
+}
+
+func (b *amqpBroker) Channel() (Channel, error) {
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+func (b *amqpBroker) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return b.conn.NotifyClose(receiver)
+}
+
+func (b *amqpBroker) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+	return b.conn.NotifyBlocked(receiver)
+}
+
+func (b *amqpBroker) Close() error {
+	return b.conn.Close()
+}
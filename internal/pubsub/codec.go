@@ -0,0 +1,105 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// MIME types of the built-in codecs.
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeGob     = "application/x-gob"
+	ContentTypeMsgPack = "application/msgpack"
+)
+
+// Codec turns values into message bodies and back.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	Gob     Codec = gobCodec{}
+	MsgPack Codec = msgpackCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(JSON)
+	RegisterCodec(Gob)
+	RegisterCodec(MsgPack)
+}
+
+// RegisterCodec makes c available to subscribers for deliveries carrying its
+// content type, replacing any codec already registered for it.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[c.ContentType()] = c
+}
+
+// CodecFor looks up the codec registered for a content type.
+func CodecFor(contentType string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[contentType]
+	return c, ok
+}
+
+// UnsupportedEncodingError is returned when a delivery has a ContentEncoding
+// the subscriber does not understand.
+type UnsupportedEncodingError struct {
+	Encoding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("pubsub: unsupported content encoding %q", e.Encoding)
+}
+
+// decoderFor picks the codec for a delivery. Publishers from before the
+// registry labelled both JSON and gob bodies "json", and some send no
+// content type at all, so anything unregistered falls back to the
+// subscription's default codec.
+func decoderFor(contentType string, fallback Codec) Codec {
+	if c, ok := CodecFor(contentType); ok {
+		return c
+	}
+
+	return fallback
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+
+func (jsonCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return ContentTypeGob }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
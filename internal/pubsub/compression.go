@@ -0,0 +1,168 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultCompressionThreshold is a body size below which compressing isn't
+// worth the CPU: small messages barely shrink and may even grow.
+const DefaultCompressionThreshold = 1024
+
+// maxDecompressedSize stops a small, highly compressed message from
+// exhausting memory when it is expanded.
+const maxDecompressedSize = 64 << 20
+
+// Compressor compresses bodies for one ContentEncoding.
+type Compressor interface {
+	Encoding() string
+	Compress(body []byte) ([]byte, error)
+	Decompress(body []byte) ([]byte, error)
+}
+
+var (
+	// Gzip compresses with gzip, content encoding "gzip".
+	Gzip Compressor = gzipCompressor{}
+	// Deflate compresses with zlib-wrapped DEFLATE, content encoding
+	// "deflate", which has less framing than gzip for small messages.
+	Deflate Compressor = deflateCompressor{}
+)
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(Gzip)
+	RegisterCompressor(Deflate)
+}
+
+// RegisterCompressor makes subscribers able to decompress c's encoding.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	compressors[c.Encoding()] = c
+}
+
+func CompressorFor(encoding string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	c, ok := compressors[encoding]
+	return c, ok
+}
+
+// WithCompression compresses bodies of at least threshold bytes with c and
+// sets the message's ContentEncoding. A body that doesn't get smaller is
+// sent as it is.
+func WithCompression(c Compressor, threshold int) PublishOption {
+	return func(p *publishConfig) {
+		p.compressor = c
+		p.compressThreshold = threshold
+	}
+}
+
+// Decompress undoes the given content encoding. Bodies without one, or with
+// "identity", are returned untouched.
+func Decompress(encoding string, body []byte) ([]byte, error) {
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+
+	c, ok := CompressorFor(encoding)
+	if !ok {
+		return nil, &UnsupportedEncodingError{Encoding: encoding}
+	}
+
+	return c.Decompress(body)
+}
+
+// compress applies the configured compression to a body and returns the
+// content encoding to label it with.
+func (p publishConfig) compress(body []byte) ([]byte, string, error) {
+	if p.compressor == nil || len(body) < p.compressThreshold {
+		return body, "", nil
+	}
+
+	compressed, err := p.compressor.Compress(body)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(compressed) >= len(body) {
+		return body, "", nil
+	}
+
+	return compressed, p.compressor.Encoding(), nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Encoding() string { return "gzip" }
+
+func (gzipCompressor) Compress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(body []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readLimited(r, "gzip")
+}
+
+type deflateCompressor struct{}
+
+func (deflateCompressor) Encoding() string { return "deflate" }
+
+func (deflateCompressor) Compress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (deflateCompressor) Decompress(body []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readLimited(r, "deflate")
+}
+
+func readLimited(r io.Reader, encoding string) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxDecompressedSize {
+		return nil, fmt.Errorf("pubsub: %s body expands to more than %d bytes", encoding, maxDecompressedSize)
+	}
+
+	return body, nil
+}
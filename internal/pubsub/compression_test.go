@@ -0,0 +1,104 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestCompression(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+
+	long := strings.Repeat("attack ", 500)
+	for _, c := range []Compressor{Gzip, Deflate} {
+		for body, encoding := range map[string]string{long: c.Encoding(), "short": ""} {
+			if err := PublishJSON(ch, testExchange, "batch.ok", body, WithCompression(c, DefaultCompressionThreshold)); err != nil {
+				t.Fatal(err)
+			}
+			d, ok, _ := ch.Get("batch", true)
+			if !ok {
+				t.Fatal("nothing published")
+			}
+			if d.ContentEncoding != encoding {
+				t.Errorf("%d byte body sent with %s encoding %q, want %q", len(body), c.Encoding(), d.ContentEncoding, encoding)
+			}
+
+			decompressed, err := Decompress(d.ContentEncoding, d.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(decompressed) != `"`+body+`"` {
+				t.Errorf("%s round trip changed the body", c.Encoding())
+			}
+		}
+	}
+}
+
+func TestCompressionSubscribe(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+
+	handled := make(chan string, 1)
+	_, err := Subscribe(testContext(t), conn, testExchange, "compressed", "compressed.*", Transient, func(body string) AckType {
+		handled <- body
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	long := strings.Repeat("attack ", 500)
+	PublishJSON(ch, testExchange, "compressed.alice", long, WithCompression(Deflate, 0))
+	if got := receive(t, handled); got != long {
+		t.Errorf("handled %d bytes, want %d", len(got), len(long))
+	}
+}
+
+func TestDecompressLimits(t *testing.T) {
+	var unsupported *UnsupportedEncodingError
+	if _, err := Decompress("br", []byte("body")); !errors.As(err, &unsupported) || unsupported.Encoding != "br" {
+		t.Errorf("Decompress() of an unknown encoding = %v", err)
+	}
+	if body, err := Decompress("identity", []byte("body")); err != nil || string(body) != "body" {
+		t.Errorf("Decompress() of identity = %q, %v", body, err)
+	}
+
+	bomb, err := Gzip.Compress(bytes.Repeat([]byte{0}, maxDecompressedSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decompress("gzip", bomb); err == nil {
+		t.Errorf("expanded a %d byte body past the limit", len(bomb))
+	}
+}
+
+// TestUnsupportedEncodingDiscarded checks that a message a subscriber can't
+// decompress is treated as poison rather than handed over compressed.
+func TestUnsupportedEncodingDiscarded(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+
+	decodeErrs := make(chan *DecodeError, 1)
+	_, err := Subscribe(testContext(t), conn, testExchange, "compressed", "compressed.*", Transient, func(string) AckType {
+		t.Error("handled a body it couldn't decompress")
+		return Ack
+	}, WithDecodeErrorPolicy(DiscardOnDecodeError), WithDecodeErrorHandler(func(de *DecodeError) { decodeErrs <- de }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch.PublishWithContext(context.Background(), testExchange, "compressed.alice", false, false, amqp.Publishing{
+		ContentType:     ContentTypeJSON,
+		ContentEncoding: "br",
+		Body:            []byte("????"),
+	})
+	var unsupported *UnsupportedEncodingError
+	if de := receive(t, decodeErrs); !errors.As(de, &unsupported) {
+		t.Errorf("decode error %v", de)
+	}
+}
@@ -0,0 +1,421 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrNacked = errors.New("pubsub: broker nacked the publish")
+
+const confirmBuffer = 256
+
+// ReturnedError reports an unroutable mandatory publish.
+type ReturnedError struct {
+	Exchange string
+	Key      string
+	Code     uint16
+	Reason   string
+}
+
+func (e *ReturnedError) Error() string {
+	return fmt.Sprintf("pubsub: message to %q with key %q was returned: %d %s", e.Exchange, e.Key, e.Code, e.Reason)
+}
+
+// ConfirmingPublisher publishes on a channel in confirm mode. It is safe for
+// concurrent use and reopens its channel if the broker closes it.
+type ConfirmingPublisher struct {
+	broker    Broker
+	mandatory bool
+
+	mu      sync.Mutex
+	ch      Channel
+	seq     uint64
+	pending *pendingConfirms
+	closed  bool
+	held    []heldPublish
+}
+
+type heldPublish struct {
+	ctx          context.Context
+	exchange     string
+	key          string
+	mandatory    bool
+	immediate    bool
+	msg          amqp.Publishing
+	confirmation *PublishConfirmation
+	reserved     bool
+}
+
+type pendingConfirms struct {
+	mu      sync.Mutex
+	byTag   map[uint64]*PublishConfirmation
+	returns map[string][]*ReturnedError
+	closed  bool
+}
+
+type PublishConfirmation struct {
+	done      chan struct{}
+	err       error
+	messageId string
+}
+
+type ConfirmOption func(*ConfirmingPublisher)
+
+// WithMandatory makes unroutable publishes fail with a *ReturnedError.
+func WithMandatory() ConfirmOption {
+	return func(p *ConfirmingPublisher) {
+		p.mandatory = true
+	}
+}
+
+func NewConfirmingPublisher(broker Broker, opts ...ConfirmOption) (*ConfirmingPublisher, error) {
+	p := &ConfirmingPublisher{broker: broker}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// PublishWithContext publishes and waits for the broker's confirmation.
+func (p *ConfirmingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	confirmation, err := p.PublishAsync(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		return err
+	}
+
+	return confirmation.Wait(ctx)
+}
+
+// PublishAsync publishes without waiting for the broker's confirmation.
+func (p *ConfirmingPublisher) PublishAsync(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*PublishConfirmation, error) {
+	gate, _ := p.broker.(flowGate)
+	hold := false
+	if gate != nil {
+		var err error
+		if hold, err = gate.admit(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		if hold {
+			gate.release()
+		}
+		return nil, amqp.ErrClosed
+	}
+
+	// Anything published after a held message waits behind it.
+	if hold || len(p.held) > 0 {
+		confirmation := &PublishConfirmation{done: make(chan struct{})}
+		p.held = append(p.held, heldPublish{
+			ctx:          ctx,
+			exchange:     exchange,
+			key:          key,
+			mandatory:    mandatory,
+			immediate:    immediate,
+			msg:          msg,
+			confirmation: confirmation,
+			reserved:     hold,
+		})
+		if len(p.held) == 1 {
+			go p.drain(gate)
+		}
+		return confirmation, nil
+	}
+
+	return p.send(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// send publishes, reopening the channel if needed. The publisher lock must
+// be held.
+func (p *ConfirmingPublisher) send(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*PublishConfirmation, error) {
+	if p.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	if p.ch == nil {
+		if err := p.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	confirmation, err := p.publish(ctx, exchange, key, mandatory || p.mandatory, immediate, msg)
+	if !errors.Is(err, amqp.ErrClosed) {
+		return confirmation, err
+	}
+
+	p.ch = nil
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+
+	return p.publish(ctx, exchange, key, mandatory || p.mandatory, immediate, msg)
+}
+
+func (p *ConfirmingPublisher) drain(gate flowGate) {
+	for {
+		<-gate.unblockedCh()
+		if p.sendHeld(gate) {
+			return
+		}
+	}
+}
+
+// sendHeld reports whether it sent every held publish before the broker
+// blocked again.
+func (p *ConfirmingPublisher) sendHeld(gate flowGate) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.held) > 0 {
+		select {
+		case <-gate.unblockedCh():
+		default:
+			return false
+		}
+
+		h := p.held[0]
+		p.held = p.held[1:]
+		if h.reserved {
+			gate.release()
+		}
+
+		if err := h.ctx.Err(); err != nil {
+			h.confirmation.resolve(err)
+			continue
+		}
+
+		confirmation, err := p.send(h.ctx, h.exchange, h.key, h.mandatory, h.immediate, h.msg)
+		if err != nil {
+			h.confirmation.resolve(err)
+			continue
+		}
+		go func() {
+			h.confirmation.resolve(confirmation.Wait(h.ctx))
+		}()
+	}
+
+	return true
+}
+
+func (p *ConfirmingPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return amqp.ErrClosed
+	}
+	p.closed = true
+
+	for _, h := range p.held {
+		if h.reserved {
+			p.broker.(flowGate).release()
+		}
+		h.confirmation.resolve(amqp.ErrClosed)
+	}
+	p.held = nil
+
+	if p.ch == nil {
+		return nil
+	}
+
+	return p.ch.Close()
+}
+
+func (p *ConfirmingPublisher) publish(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*PublishConfirmation, error) {
+	p.seq++
+	seq := p.seq
+
+	confirmation := &PublishConfirmation{done: make(chan struct{}), messageId: msg.MessageId}
+	if err := p.pending.add(seq, confirmation); err != nil {
+		p.seq--
+		return nil, err
+	}
+
+	if err := p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg); err != nil {
+		// The channel only counts publishes it sent.
+		p.pending.remove(seq)
+		p.seq--
+		return nil, err
+	}
+
+	return confirmation, nil
+}
+
+func (p *ConfirmingPublisher) open() error {
+	if c, ok := p.broker.(interface{ Connected() bool }); ok && !c.Connected() {
+		return ErrDisconnected
+	}
+
+	ch, err := p.broker.Channel()
+	if err != nil {
+		return err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return err
+	}
+
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, confirmBuffer))
+	returns := ch.NotifyReturn(make(chan amqp.Return, confirmBuffer))
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	pending := &pendingConfirms{byTag: map[uint64]*PublishConfirmation{}, returns: map[string][]*ReturnedError{}}
+	go pending.listen(confirms, returns, closes)
+
+	p.ch = ch
+	p.seq = 0
+	p.pending = pending
+
+	return nil
+}
+
+func (pc *pendingConfirms) listen(confirms chan amqp.Confirmation, returns chan amqp.Return, closes chan *amqp.Error) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			pc.returned(r)
+		case c, ok := <-confirms:
+			if !ok {
+				var err error = amqp.ErrClosed
+				if e, ok := <-closes; ok && e != nil {
+					err = e
+				}
+				pc.fail(err)
+				return
+			}
+			// The broker sends a return before the ack for the same
+			// message, so take any that are waiting first.
+			returns = pc.takeReturns(returns)
+			pc.confirmed(c)
+		}
+	}
+}
+
+func (pc *pendingConfirms) takeReturns(returns chan amqp.Return) chan amqp.Return {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				return nil
+			}
+			pc.returned(r)
+		default:
+			return returns
+		}
+	}
+}
+
+func (pc *pendingConfirms) add(seq uint64, confirmation *PublishConfirmation) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.closed {
+		return amqp.ErrClosed
+	}
+	pc.byTag[seq] = confirmation
+
+	return nil
+}
+
+func (pc *pendingConfirms) remove(seq uint64) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	delete(pc.byTag, seq)
+}
+
+func (pc *pendingConfirms) returned(r amqp.Return) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.returns[r.MessageId] = append(pc.returns[r.MessageId], &ReturnedError{
+		Exchange: r.Exchange,
+		Key:      r.RoutingKey,
+		Code:     r.ReplyCode,
+		Reason:   r.ReplyText,
+	})
+}
+
+// confirmed matches returns to publishes by MessageId, which Publish always
+// sets.
+func (pc *pendingConfirms) confirmed(c amqp.Confirmation) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	confirmation, ok := pc.byTag[c.DeliveryTag]
+	if !ok {
+		return
+	}
+	delete(pc.byTag, c.DeliveryTag)
+
+	if returns := pc.returns[confirmation.messageId]; len(returns) > 0 {
+		confirmation.err = returns[0]
+		if len(returns) == 1 {
+			delete(pc.returns, confirmation.messageId)
+		} else {
+			pc.returns[confirmation.messageId] = returns[1:]
+		}
+	} else if !c.Ack {
+		confirmation.err = ErrNacked
+	}
+	close(confirmation.done)
+}
+
+func (pc *pendingConfirms) fail(err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.closed = true
+	for seq, confirmation := range pc.byTag {
+		if confirmation.err == nil {
+			confirmation.err = err
+		}
+		close(confirmation.done)
+		delete(pc.byTag, seq)
+	}
+}
+
+func (c *PublishConfirmation) resolve(err error) {
+	c.err = err
+	close(c.done)
+}
+
+func (c *PublishConfirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *PublishConfirmation) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *PublishConfirmation) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
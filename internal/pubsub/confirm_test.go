@@ -0,0 +1,104 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TestConfirmAfterFailedPublish checks that a publish the channel never sent
+// doesn't shift the confirmations of the ones after it.
+func TestConfirmAfterFailedPublish(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	pub := newTestConfirmingPublisher(t, conn)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pub.PublishAsync(cancelled, testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte("never")}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("publish with a cancelled context = %v", err)
+	}
+
+	ctx := testContext(t)
+	if err := pub.PublishWithContext(ctx, testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte("sent")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 1 || got[0] != "sent" {
+		t.Errorf("queue holds %v", got)
+	}
+}
+
+// TestConfirmAfterMissingExchange checks that a publish the broker closes the
+// channel over fails, and the next one is confirmed on a fresh channel.
+func TestConfirmAfterMissingExchange(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	pub := newTestConfirmingPublisher(t, conn)
+	ctx := testContext(t)
+
+	lost, err := pub.PublishAsync(ctx, "nowhere", "batch.ok", false, false, amqp.Publishing{Body: []byte("lost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var amqpErr *amqp.Error
+	if err := lost.Wait(ctx); !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound {
+		t.Fatalf("publish to a missing exchange = %v, want NOT_FOUND", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := pub.PublishWithContext(ctx, testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatalf("publish %d after the channel closed: %v", i, err)
+		}
+	}
+	if got := queued(t, ch, "batch"); len(got) != 3 {
+		t.Errorf("queue holds %v", got)
+	}
+}
+
+// TestConfirmReturns checks that every unroutable mandatory publish, and
+// only those, comes back as a *ReturnedError.
+func TestConfirmReturns(t *testing.T) {
+	_, conn := newTestBroker(t)
+	newBatchQueue(t, conn)
+	pub := newTestConfirmingPublisher(t, conn, WithMandatory())
+	ctx := testContext(t)
+
+	var confirmations []*PublishConfirmation
+	for i := 0; i < 2*confirmBuffer; i++ {
+		key := "batch.ok"
+		if i%2 == 1 {
+			key = "batch.nowhere"
+		}
+		c, err := pub.PublishAsync(ctx, testExchange, key, false, false, amqp.Publishing{MessageId: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		confirmations = append(confirmations, c)
+	}
+
+	for i, c := range confirmations {
+		var returned *ReturnedError
+		err := c.Wait(ctx)
+		if i%2 == 1 && !errors.As(err, &returned) {
+			t.Errorf("publish %d: %v, want a *ReturnedError", i, err)
+		}
+		if i%2 == 0 && err != nil {
+			t.Errorf("publish %d: %v", i, err)
+		}
+	}
+}
+
+func newTestConfirmingPublisher(t *testing.T, conn Broker, opts ...ConfirmOption) *ConfirmingPublisher {
+	t.Helper()
+
+	pub, err := NewConfirmingPublisher(conn, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pub.Close() })
+
+	return pub
+}
@@ -1,11 +1,12 @@
 package pubsub
 
 import (
-	"bytes"
-	"encoding/gob"
-	"encoding/json"
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"time"
 
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -14,148 +15,295 @@ type SimpleQueueType int
 const (
 	Durable SimpleQueueType = iota
 	Transient
+	// Quorum is a durable queue replicated across the cluster. A delivery
+	// requeued more than DefaultDeliveryLimit times is dead-lettered, so a
+	// message that keeps failing can't loop forever.
+	Quorum
+	// Stream is a durable, replicated, append-only log. Consuming doesn't
+	// remove messages: every subscription reads from its own offset (see
+	// WithStreamOffset) and nothing is ever requeued or dead-lettered.
+	Stream
 )
 
+func (t SimpleQueueType) durable() bool {
+	return t != Transient
+}
+
 type AckType int
 
 const (
 	Ack AckType = iota
 	NackRequeue
 	NackDiscard
+	// RetryLater acks the delivery and schedules it to come back after the
+	// subscription's RetryPolicy delay.
+	RetryLater
 )
 
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack-requeue"
+	case NackDiscard:
+		return "nack-discard"
+	case RetryLater:
+		return "retry-later"
+	default:
+		return fmt.Sprintf("AckType(%d)", int(a))
+	}
+}
+
 func DeclareAndBind(
-	conn *amqp.Connection,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-) (*amqp.Channel, amqp.Queue, error) {
+	opts ...QueueOption,
+) (Channel, amqp.Queue, error) {
 
-	ch, err := conn.Channel()
+	ch, err := broker.Channel()
 	if err != nil {
 		return nil, amqp.Queue{}, err
 	}
 
-	durable := queueType == Durable
-	autoDelete := queueType == Transient
-	exclusive := queueType == Transient
+	if err := DeclareDeadLetter(ch); err != nil {
+		ch.Close()
+		return nil, amqp.Queue{}, err
+	}
 
-	queue, err := ch.QueueDeclare(queueName, durable, autoDelete, exclusive, false, amqp.Table{
-		"x-dead-letter-exchange": "peril_dlx",
-	})
+	queue, err := NewQueueSpec(queueName, queueType, opts...).Declare(ch)
 
 	if err != nil {
+		ch.Close()
 		return nil, amqp.Queue{}, err
 	}
 
 	if err = ch.QueueBind(queueName, key, exchange, false, nil); err != nil {
+		ch.Close()
 		return nil, amqp.Queue{}, err
 	}
 
 	return ch, queue, nil
 }
 
-func SubscribeJSON[T any](
-	conn *amqp.Connection,
+// Subscribe consumes queueName, decoding each delivery with the codec
+// registered for its content type. Deliveries with no or an unregistered
+// content type use the default codec, JSON unless WithDefaultCodec says
+// otherwise.
+func Subscribe[T any](
+	ctx context.Context,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
-
-	unmarshaller := func(body []byte) (T, error) {
-
-		var unMarshalledDelivery T
-
-		if err := json.Unmarshal(body, &unMarshalledDelivery); err != nil {
-			return unMarshalledDelivery, err
-		}
-
-		return unMarshalledDelivery, nil
-	}
-
-	return subscribe(conn, exchange, queueName, key, queueType, handler, unmarshaller)
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeDelivery(ctx, broker, exchange, queueName, key, queueType, func(d Delivery[T]) AckType {
+		return handler(d.Body)
+	}, opts...)
 }
 
-func SubscribeGob[T any](
-	conn *amqp.Connection,
+// SubscribeDelivery is Subscribe for handlers that need the envelope as well
+// as the payload.
+func SubscribeDelivery[T any](
+	ctx context.Context,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-	handler func(T) AckType,
-) error {
+	handler Handler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &Subscription{
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		broker:    broker,
+		queue:     queueName,
+		queueType: queueType,
+		config:    newSubscribeConfig(opts),
+	}
 
-	unmarshaller := func(body []byte) (T, error) {
+	if sub.config.dedup != nil {
+		handler = dedupHandler(sub, sub.config.dedup, handler)
+	}
+	handler, err := chain(sub.config, handler)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	start := func() (chan *amqp.Error, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-		dec := gob.NewDecoder(bytes.NewReader(body))
+		ch, _, err := DeclareAndBind(broker, exchange, queueName, key, queueType, sub.config.queueOptions...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+		if err := ch.Qos(sub.config.prefetchCount, sub.config.prefetchSize, false); err != nil {
+			ch.Close()
+			return nil, err
+		}
 
-		var decodedGob T
+		tag := consumerTag(queueName)
+		deliveries, err := ch.Consume(queueName, tag, false, false, false, false, sub.consumeArgs())
 
-		if err := dec.Decode(&decodedGob); err != nil {
-			return decodedGob, err
+		if err != nil {
+			ch.Close()
+			return nil, err
 		}
 
-		return decodedGob, nil
+		finished := make(chan struct{})
+		sub.attach(ch, tag, finished)
+
+		go func() {
+			defer close(finished)
+			consume(sub, deliveries, handler)
+		}()
+
+		return closed, nil
 	}
 
-	return subscribe(conn, exchange, queueName, key, queueType, handler, unmarshaller)
+	closed, err := start()
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go sub.run(ctx, broker, closed, start)
+
+	return sub, nil
 }
 
-func subscribe[T any](
-	conn *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
-	queueType SimpleQueueType,
-	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
-) error {
-	ch, _, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
+func consume[T any](
+	sub *Subscription,
+	deliveries <-chan amqp.Delivery,
+	handler Handler[T],
+) {
+	if sub.config.workers <= 1 {
+		for delivery := range deliveries {
+			handle(sub, delivery, handler)
+		}
+		return
+	}
 
-	if err != nil {
-		return err
+	dispatch(sub, deliveries, func(delivery amqp.Delivery) {
+		handle(sub, delivery, handler)
+	})
+}
+
+// handle decodes, handles and settles a single delivery. Every delivery is
+// settled on its own (never with multiple set), so workers may finish in
+// any order.
+func handle[T any](sub *Subscription, delivery amqp.Delivery, handler Handler[T]) {
+	deliveriesTotal.With(sub.queue).Inc()
+
+	span := startConsumeSpan(sub.queue, delivery)
+	defer span.End()
+
+	if sub.queueType == Stream {
+		defer sub.handledStream(delivery)
 	}
 
-	if err := ch.Qos(10, 0, false); err != nil {
-		return err
+	var signer string
+	if sub.config.keys != nil {
+		var ok bool
+		if signer, ok = sub.verify(delivery); !ok {
+			span.SetError(errors.New("signature rejected"))
+			return
+		}
 	}
 
-	deliveries, err := ch.Consume(queueName, "", false, false, false, false, nil)
+	var unmarshalledVal T
+	codec := decoderFor(delivery.ContentType, sub.config.codec)
+	keyId, _ := delivery.Headers[KeyIdHeader].(string)
+	body, err := Decrypt(sub.config.cipherKeys, keyId, delivery.Body)
+	if err == nil {
+		body, err = Decompress(delivery.ContentEncoding, body)
+	}
+
+	if err == nil {
+		err = codec.Unmarshal(body, &unmarshalledVal)
+	}
 
 	if err != nil {
-		return err
+		decodeFailuresTotal.With(sub.queue).Inc()
+		span.SetError(err)
+		sub.poison(delivery, codec, err)
+		return
 	}
 
-	go func() {
-		for delivery := range deliveries {
+	handlerSpan := tracing.Start(span.Context(), "handle "+sub.queue, tracing.KindInternal)
+	meta := MetaOf(delivery)
+	meta.Queue = sub.queue
+	meta.Signer = signer
+	meta.Trace = handlerSpan.Context()
+	ctx := tracing.ContextWith(sub.ctx, meta.Trace)
 
-			unmarshalledVal, err := unmarshaller(delivery.Body)
+	start := time.Now()
+	acktype := handler(Delivery[T]{Meta: meta, Body: unmarshalledVal, ctx: ctx})
+	handlerSeconds.With(sub.queue).ObserveDuration(time.Since(start))
+	settledTotal.With(sub.queue, acktype.String()).Inc()
 
-			if err != nil {
-				log.Fatalf("Error decoding the delivery body %v", err)
-			}
+	handlerSpan.SetAttribute("ack", acktype.String())
+	handlerSpan.End()
+	span.SetAttribute("ack", acktype.String())
 
-			acktype := handler(unmarshalledVal)
+	if acktype == Ack {
+		delivery.Ack(false)
+	}
 
-			if acktype == Ack {
-				delivery.Ack(false)
-				log.Print("ACK")
-			}
+	if acktype == NackRequeue {
+		delivery.Nack(false, true)
+	}
 
-			if acktype == NackRequeue {
-				delivery.Nack(false, true)
-				log.Print("NACK and Requeue")
-			}
+	if acktype == NackDiscard {
+		delivery.Nack(false, false)
+	}
 
-			if acktype == NackDiscard {
-				delivery.Nack(false, false)
-				log.Print("Nack and Discard")
-			}
-		}
-	}()
+	if acktype == RetryLater {
+		sub.retry(delivery)
+	}
+}
+
+func SubscribeJSON[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	opts = append([]SubscribeOption{WithDefaultCodec(JSON)}, opts...)
+	return Subscribe(ctx, broker, exchange, queueName, key, queueType, handler, opts...)
+}
 
-	return nil
+func SubscribeGob[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	opts = append([]SubscribeOption{WithDefaultCodec(Gob)}, opts...)
+	return Subscribe(ctx, broker, exchange, queueName, key, queueType, handler, opts...)
 }
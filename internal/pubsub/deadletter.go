@@ -0,0 +1,259 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeadLetter is a message sitting in the dead-letter queue together with
+// where it originally came from and why it ended up there.
+type DeadLetter struct {
+	amqp.Delivery
+	Queue      string
+	Exchange   string
+	RoutingKey string
+	Reason     string
+	Count      int64
+	Time       time.Time
+	Error      string
+}
+
+// DeclareDeadLetter declares the fanout exchange that every queue from
+// DeclareAndBind dead-letters to and the shared durable queue bound to it.
+// Messages from every source queue land in the same place and are told
+// apart by x-first-death-queue (or x-poison-queue for poison messages).
+func DeclareDeadLetter(ch Channel) error {
+	if err := ch.ExchangeDeclare(routing.ExchangePerilDeadLetter, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return err
+	}
+
+	if _, err := DeadLetterQueueSpec().Declare(ch); err != nil {
+		return err
+	}
+
+	return ch.QueueBind(routing.QueuePerilDeadLetter, "", routing.ExchangePerilDeadLetter, false, nil)
+}
+
+func DeadLetterQueueSpec() QueueSpec {
+	return QueueSpec{
+		Name:    routing.QueuePerilDeadLetter,
+		Durable: true,
+	}
+}
+
+func ParseDeadLetter(d amqp.Delivery) DeadLetter {
+	dl := DeadLetter{
+		Delivery:   d,
+		Exchange:   d.Exchange,
+		RoutingKey: d.RoutingKey,
+	}
+
+	if queue, ok := d.Headers[PoisonQueueHeader].(string); ok {
+		dl.Queue = queue
+		dl.Reason = "poison"
+		dl.Count = 1
+		dl.Time = d.Timestamp
+		dl.Error, _ = d.Headers[PoisonErrorHeader].(string)
+		dl.Exchange, _ = d.Headers[PoisonExchangeHeader].(string)
+		dl.RoutingKey, _ = d.Headers[PoisonRoutingKeyHeader].(string)
+		return dl
+	}
+
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return dl
+	}
+
+	// x-death is newest first. The newest entry says which queue sent the
+	// message here; the oldest holds the original route unless the message
+	// went through retry queues, which record it in headers instead.
+	last, _ := deaths[0].(amqp.Table)
+	dl.Queue, _ = last["queue"].(string)
+	dl.Reason, _ = last["reason"].(string)
+	dl.Time, _ = last["time"].(time.Time)
+
+	first, _ := deaths[len(deaths)-1].(amqp.Table)
+	dl.Exchange, _ = first["exchange"].(string)
+	if keys, ok := first["routing-keys"].([]interface{}); ok && len(keys) > 0 {
+		dl.RoutingKey, _ = keys[0].(string)
+	}
+	if exchange, ok := d.Headers[RetryExchangeHeader].(string); ok {
+		dl.Exchange = exchange
+		dl.RoutingKey, _ = d.Headers[RetryRoutingKeyHeader].(string)
+	}
+
+	for _, death := range deaths {
+		if t, ok := death.(amqp.Table); ok {
+			count, _ := t["count"].(int64)
+			dl.Count += count
+		}
+	}
+
+	return dl
+}
+
+// BrowseDeadLetters returns up to limit dead letters (all of them if limit
+// is zero or less) without removing them from the queue.
+func BrowseDeadLetters(broker Broker, limit int) ([]DeadLetter, error) {
+	ch, err := openDeadLetter(broker)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the channel hands every unacked message back to the queue.
+	defer ch.Close()
+
+	letters := []DeadLetter{}
+	for limit <= 0 || len(letters) < limit {
+		d, ok, err := ch.Get(routing.QueuePerilDeadLetter, false)
+		if err != nil {
+			return letters, err
+		}
+		if !ok {
+			break
+		}
+		letters = append(letters, ParseDeadLetter(d))
+	}
+
+	return letters, nil
+}
+
+// errKeepDeadLetter leaves a dead letter in the queue without stopping the
+// walk.
+var errKeepDeadLetter = errors.New("pubsub: keep dead letter")
+
+// ReplayDeadLetters republishes every dead letter accepted by match to the
+// exchange and routing key it was first published with, acking each one only
+// after the broker has confirmed the republish. A dead letter that no queue
+// takes any more stays where it is. A nil match replays all.
+func ReplayDeadLetters(broker Broker, match func(DeadLetter) bool) (int, error) {
+	publisher, err := NewConfirmingPublisher(broker, WithMandatory())
+	if err != nil {
+		return 0, err
+	}
+	defer publisher.Close()
+
+	return settleDeadLetters(broker, match, func(dl DeadLetter) error {
+		err := publisher.PublishWithContext(context.Background(), dl.Exchange, dl.RoutingKey, false, false, amqp.Publishing{
+			Headers:         replayHeaders(dl.Headers),
+			ContentType:     dl.ContentType,
+			ContentEncoding: dl.ContentEncoding,
+			DeliveryMode:    dl.DeliveryMode,
+			Priority:        dl.Priority,
+			CorrelationId:   dl.CorrelationId,
+			ReplyTo:         dl.ReplyTo,
+			MessageId:       dl.MessageId,
+			Timestamp:       dl.Delivery.Timestamp,
+			Type:            dl.Type,
+			AppId:           dl.AppId,
+			Body:            dl.Body,
+		})
+		var returned *ReturnedError
+		if errors.As(err, &returned) {
+			log.Printf("Leaving dead letter %s in the queue: %v", dl.MessageId, err)
+			return errKeepDeadLetter
+		}
+		return err
+	})
+}
+
+// PurgeDeadLetters drops every dead letter accepted by match, or the whole
+// queue if match is nil.
+func PurgeDeadLetters(broker Broker, match func(DeadLetter) bool) (int, error) {
+	if match == nil {
+		ch, err := openDeadLetter(broker)
+		if err != nil {
+			return 0, err
+		}
+		defer ch.Close()
+
+		return ch.QueuePurge(routing.QueuePerilDeadLetter, false)
+	}
+
+	return settleDeadLetters(broker, match, func(DeadLetter) error { return nil })
+}
+
+// settleDeadLetters walks the dead-letter queue once, applying fn to the
+// matching messages and acking those it succeeds on. Everything else is
+// returned to the queue when the channel closes. It stops at the messages
+// that were queued when it started, so anything dead-lettered again on the
+// way isn't seen twice.
+func settleDeadLetters(broker Broker, match func(DeadLetter) bool, fn func(DeadLetter) error) (int, error) {
+	ch, err := openDeadLetter(broker)
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	q, err := DeadLetterQueueSpec().DeclarePassive(ch)
+	if err != nil {
+		return 0, err
+	}
+
+	settled := 0
+	for i := 0; i < q.Messages; i++ {
+		d, ok, err := ch.Get(routing.QueuePerilDeadLetter, false)
+		if err != nil {
+			return settled, err
+		}
+		if !ok {
+			return settled, nil
+		}
+
+		dl := ParseDeadLetter(d)
+		if match != nil && !match(dl) {
+			continue
+		}
+
+		err = fn(dl)
+		if errors.Is(err, errKeepDeadLetter) {
+			continue
+		}
+		if err != nil {
+			return settled, err
+		}
+		if err := d.Ack(false); err != nil {
+			return settled, err
+		}
+		settled++
+	}
+
+	return settled, nil
+}
+
+func openDeadLetter(broker Broker) (Channel, error) {
+	ch, err := broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := DeclareDeadLetter(ch); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// replayHeaders drops the headers added by dead-lettering so that a replayed
+// message looks like the original publish.
+func replayHeaders(headers amqp.Table) amqp.Table {
+	replayed := amqp.Table{}
+	for k, v := range headers {
+		if strings.HasPrefix(k, "x-death") ||
+			strings.HasPrefix(k, "x-first-death-") ||
+			strings.HasPrefix(k, "x-last-death-") ||
+			strings.HasPrefix(k, "x-poison-") ||
+			strings.HasPrefix(k, "x-retry-") {
+			continue
+		}
+		replayed[k] = v
+	}
+
+	return replayed
+}
@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// deadLetter sends body through queue to the dead-letter queue, published
+// with key.
+func deadLetter(t *testing.T, ch Channel, queue, key, body string) {
+	t.Helper()
+
+	if err := ch.PublishWithContext(context.Background(), testExchange, key, false, false, amqp.Publishing{MessageId: body, Body: []byte(body)}); err != nil {
+		t.Fatal(err)
+	}
+	d, ok, err := ch.Get(queue, false)
+	if err != nil || !ok {
+		t.Fatalf("%s never reached %s: %v", body, queue, err)
+	}
+	d.Nack(false, false)
+}
+
+func newDeadLetterQueue(t *testing.T, ch Channel, name, key string, opts ...QueueOption) {
+	t.Helper()
+
+	if _, err := NewQueueSpec(name, Durable, opts...).Declare(ch); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind(name, key, testExchange, false, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	if err := DeclareDeadLetter(ch); err != nil {
+		t.Fatal(err)
+	}
+	newDeadLetterQueue(t, ch, "work", "work.*")
+
+	deadLetter(t, ch, "work", "work.alice", "first")
+	deadLetter(t, ch, "work", "work.bob", "second")
+
+	letters, err := BrowseDeadLetters(conn, 0)
+	if err != nil || len(letters) != 2 {
+		t.Fatalf("browsed %d dead letters: %v", len(letters), err)
+	}
+	if dl := letters[0]; dl.Queue != "work" || dl.Reason != "rejected" || dl.Exchange != testExchange || dl.RoutingKey != "work.alice" {
+		t.Errorf("parsed %+v", dl)
+	}
+
+	replayed, err := ReplayDeadLetters(conn, func(dl DeadLetter) bool { return dl.RoutingKey == "work.bob" })
+	if err != nil || replayed != 1 {
+		t.Fatalf("replayed %d: %v", replayed, err)
+	}
+	d, ok, _ := ch.Get("work", true)
+	if !ok || string(d.Body) != "second" || d.Headers["x-death"] != nil {
+		t.Errorf("replayed %q with headers %v", d.Body, d.Headers)
+	}
+	if got := queued(t, ch, routing.QueuePerilDeadLetter); len(got) != 1 || got[0] != "first" {
+		t.Errorf("dead-letter queue holds %v", got)
+	}
+}
+
+// TestReplayUnroutable checks that a dead letter no queue takes any more
+// stays in the dead-letter queue.
+func TestReplayUnroutable(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	if err := DeclareDeadLetter(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	death := amqp.Table{"queue": "gone", "reason": "rejected", "exchange": testExchange, "routing-keys": []interface{}{"nobody.home"}, "count": int64(1)}
+	ch.PublishWithContext(context.Background(), routing.ExchangePerilDeadLetter, "", false, false, amqp.Publishing{
+		Headers: amqp.Table{"x-death": []interface{}{death}},
+		Body:    []byte("kept"),
+	})
+
+	replayed, err := ReplayDeadLetters(conn, nil)
+	if err != nil || replayed != 0 {
+		t.Fatalf("replayed %d: %v", replayed, err)
+	}
+	if got := queued(t, ch, routing.QueuePerilDeadLetter); len(got) != 1 || got[0] != "kept" {
+		t.Errorf("dead-letter queue holds %v", got)
+	}
+}
+
+// TestReplayOnce checks that a message dead-lettered again while replaying
+// isn't replayed a second time.
+func TestReplayOnce(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	if err := DeclareDeadLetter(ch); err != nil {
+		t.Fatal(err)
+	}
+	// Everything published to the queue comes straight back.
+	newDeadLetterQueue(t, ch, "bounce", "bounce.*", WithMessageTTL(0))
+	ch.PublishWithContext(context.Background(), testExchange, "bounce.alice", false, false, amqp.Publishing{Body: []byte("bounced")})
+
+	replayed, err := ReplayDeadLetters(conn, nil)
+	if err != nil || replayed != 1 {
+		t.Fatalf("replayed %d: %v", replayed, err)
+	}
+	if got := queued(t, ch, routing.QueuePerilDeadLetter); len(got) != 1 || got[0] != "bounced" {
+		t.Errorf("dead-letter queue holds %v", got)
+	}
+}
@@ -0,0 +1,159 @@
+package pubsub
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+)
+
+// DedupStore remembers which messages have been handled.
+type DedupStore interface {
+	// Seen reports whether key was marked within the store's retention
+	// window.
+	Seen(key string) (bool, error)
+	// Mark records key as handled.
+	Mark(key string) error
+}
+
+// DedupLocker is a DedupStore that can hold a key while its delivery is
+// handled, so that checking, handling and marking it happen as one step even
+// for subscriptions in different processes sharing the store.
+type DedupLocker interface {
+	Lock(key string) (unlock func(), err error)
+}
+
+// WithDeduplication makes the subscription skip (and ack) deliveries whose
+// MessageId it has already handled, as recorded in store. Only deliveries
+// that were settled for good, with Ack or NackDiscard, are marked, so a
+// message that is requeued or retried still comes back. Deliveries without
+// a MessageId are always handled.
+func WithDeduplication(store DedupStore) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.dedup = store
+	}
+}
+
+// Duplicates returns how many deliveries this subscription has suppressed as
+// duplicates.
+func (s *Subscription) Duplicates() uint64 {
+	return s.duplicates.Load()
+}
+
+// dedupHandler wraps handler with the subscription's dedup store. Keys are
+// scoped to the queue so that one store can be shared by subscriptions that
+// receive copies of the same message.
+func dedupHandler[T any](s *Subscription, store DedupStore, handler Handler[T]) Handler[T] {
+	return func(d Delivery[T]) AckType {
+		if d.Meta.MessageId == "" {
+			return handler(d)
+		}
+		key := s.queue + "/" + d.Meta.MessageId
+
+		if locker, ok := store.(DedupLocker); ok {
+			unlock, err := locker.Lock(key)
+			if err != nil {
+				log.Printf("Could not lock dedup store, handling anyway: %v", err)
+			} else {
+				defer unlock()
+			}
+		}
+
+		seen, err := store.Seen(key)
+		if err != nil {
+			log.Printf("Could not check dedup store, handling anyway: %v", err)
+		}
+		if seen {
+			s.duplicates.Add(1)
+			duplicatesTotal.With(s.queue).Inc()
+			log.Printf("Suppressed duplicate message %s on %s", d.Meta.MessageId, s.queue)
+			return Ack
+		}
+
+		acktype := handler(d)
+		if acktype == Ack || acktype == NackDiscard {
+			if err := store.Mark(key); err != nil {
+				log.Printf("Could not record message %s as handled: %v", d.Meta.MessageId, err)
+			}
+		}
+
+		return acktype
+	}
+}
+
+// MemoryDedupStore is a bounded LRU of recently handled keys. Once full, the
+// least recently seen key is forgotten.
+type MemoryDedupStore struct {
+	capacity  int
+	retention time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type dedupEntry struct {
+	key    string
+	marked time.Time
+}
+
+// NewMemoryDedupStore remembers up to capacity keys for retention each. A
+// retention of zero keeps keys until they are evicted.
+func NewMemoryDedupStore(capacity int, retention time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity:  capacity,
+		retention: retention,
+		entries:   map[string]*list.Element{},
+		order:     list.New(),
+	}
+}
+
+func (m *MemoryDedupStore) Seen(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return false, nil
+	}
+
+	if expired(el.Value.(*dedupEntry).marked, m.retention) {
+		m.order.Remove(el)
+		delete(m.entries, key)
+		return false, nil
+	}
+	m.order.MoveToFront(el)
+
+	return true, nil
+}
+
+func (m *MemoryDedupStore) Mark(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		el.Value.(*dedupEntry).marked = time.Now()
+		m.order.MoveToFront(el)
+		return nil
+	}
+
+	m.entries[key] = m.order.PushFront(&dedupEntry{key: key, marked: time.Now()})
+	for m.capacity > 0 && m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*dedupEntry).key)
+	}
+
+	return nil
+}
+
+func (m *MemoryDedupStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.order.Len()
+}
+
+func expired(marked time.Time, retention time.Duration) bool {
+	return retention > 0 && time.Since(marked) > retention
+}
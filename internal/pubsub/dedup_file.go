@@ -0,0 +1,291 @@
+package pubsub
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fileDedupSlack is how many stale lines the file may collect before
+	// it is rewritten.
+	fileDedupSlack = 1024
+	// fileDedupStripes is how many locks keys are spread over. One more
+	// guards the file itself.
+	fileDedupStripes = 256
+)
+
+// FileDedupStore keeps handled keys in an append-only file so that they
+// survive restarts. Each line is "<unix nanos> <key>". The file is compacted
+// when it holds many expired or repeated lines.
+//
+// Several processes on one host may share the file: each picks up lines
+// appended by the others before answering Seen, and reloads if another
+// process compacted the file. A lock file next to it, "<path>.lock", makes
+// a subscription's check, handle and mark of one key exclusive across the
+// processes (see DedupLocker), and keeps compaction from losing marks.
+type FileDedupStore struct {
+	path      string
+	retention time.Duration
+	lock      *fileLock
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *os.File
+	r       *bufio.Reader
+	partial string
+	entries map[string]time.Time
+	lines   int
+}
+
+// NewFileDedupStore opens (or creates) the store at path. A retention of
+// zero keeps keys forever.
+func NewFileDedupStore(path string, retention time.Duration) (*FileDedupStore, error) {
+	lock, err := openFileLock(path+".lock", fileDedupStripes+1)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileDedupStore{path: path, retention: retention, lock: lock}
+	if err := s.open(); err != nil {
+		lock.close()
+		return nil, err
+	}
+
+	if s.lines > len(s.entries) {
+		if err := s.compact(); err != nil {
+			s.close()
+			lock.close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Lock holds key against every process sharing the store until unlock is
+// called. Keys are spread over a fixed number of locks, so an unrelated key
+// may occasionally have to wait too.
+func (s *FileDedupStore) Lock(key string) (func(), error) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return s.lock.lock(int(h.Sum32()%fileDedupStripes), true)
+}
+
+func (s *FileDedupStore) Seen(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.sync(); err != nil {
+		return false, err
+	}
+
+	marked, ok := s.entries[key]
+	if ok && expired(marked, s.retention) {
+		delete(s.entries, key)
+		return false, nil
+	}
+
+	return ok, nil
+}
+
+func (s *FileDedupStore) Mark(key string) error {
+	if strings.Contains(key, "\n") {
+		return fmt.Errorf("pubsub: dedup key %q contains a newline", key)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Appends only need to keep out of a compaction's way.
+	unlock, err := s.lock.lock(fileDedupStripes, false)
+	if err != nil {
+		return err
+	}
+	err = s.append(key)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	if s.lines > 2*len(s.entries)+fileDedupSlack {
+		return s.compact()
+	}
+
+	return nil
+}
+
+func (s *FileDedupStore) append(key string) error {
+	if err := s.sync(); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(s.w, "%d %s\n", time.Now().UnixNano(), key); err != nil {
+		return err
+	}
+
+	// Reading our own line back records the key.
+	return s.sync()
+}
+
+func (s *FileDedupStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.entries)
+}
+
+func (s *FileDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.close()
+	s.lock.close()
+
+	return err
+}
+
+func (s *FileDedupStore) close() error {
+	s.f.Close()
+	return s.w.Close()
+}
+
+// open uses separate descriptors for appending and reading so that writes
+// don't move the read position.
+func (s *FileDedupStore) open() error {
+	w, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	s.f = f
+	s.w = w
+	s.r = bufio.NewReader(f)
+	s.partial = ""
+	s.entries = map[string]time.Time{}
+	s.lines = 0
+
+	return s.read()
+}
+
+// sync catches up with lines appended since the last read, reopening the
+// file first if it has been replaced by a compaction.
+func (s *FileDedupStore) sync() error {
+	info, err := os.Stat(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	current, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info == nil || !os.SameFile(info, current) {
+		s.close()
+		return s.open()
+	}
+
+	return s.read()
+}
+
+func (s *FileDedupStore) read() error {
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF {
+			// Another process may be halfway through writing this line.
+			s.partial += line
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		s.load(s.partial + line)
+		s.partial = ""
+	}
+}
+
+func (s *FileDedupStore) load(line string) {
+	nanos, key, ok := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+	if !ok {
+		return
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return
+	}
+
+	s.lines++
+	marked := time.Unix(0, n)
+	if expired(marked, s.retention) {
+		return
+	}
+	if marked.After(s.entries[key]) {
+		s.entries[key] = marked
+	}
+}
+
+// compact rewrites the file with only the live entries and swaps it in. It
+// holds the file exclusively, and catches up first, so that no other
+// process's marks are lost.
+func (s *FileDedupStore) compact() error {
+	unlock, err := s.lock.lock(fileDedupStripes, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.sync(); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".dedup-*")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	for key, marked := range s.entries {
+		if expired(marked, s.retention) {
+			continue
+		}
+		fmt.Fprintf(w, "%d %s\n", marked.UnixNano(), key)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	s.close()
+	return s.open()
+}
@@ -0,0 +1,270 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	store := NewMemoryDedupStore(2, 0)
+
+	for _, key := range []string{"a", "b"} {
+		if err := store.Mark(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seen, _ := store.Seen("a"); !seen {
+		t.Error("a not seen")
+	}
+
+	// b is now the least recently seen, so it goes first.
+	store.Mark("c")
+	if seen, _ := store.Seen("b"); seen {
+		t.Error("b still seen after eviction")
+	}
+	for _, key := range []string{"a", "c"} {
+		if seen, _ := store.Seen(key); !seen {
+			t.Errorf("%s not seen", key)
+		}
+	}
+	if n := store.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+}
+
+func TestMemoryDedupStoreRetention(t *testing.T) {
+	store := NewMemoryDedupStore(0, 20*time.Millisecond)
+	store.Mark("a")
+
+	if seen, _ := store.Seen("a"); !seen {
+		t.Fatal("a not seen")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if seen, _ := store.Seen("a"); seen {
+		t.Error("a seen after its retention")
+	}
+}
+
+func TestFileDedupStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+
+	store, err := NewFileDedupStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"logs/1", "logs/2", "logs/1"} {
+		if err := store.Mark(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Mark("bad\nkey"); err == nil {
+		t.Error("marked a key with a newline")
+	}
+	store.Close()
+
+	store, err = NewFileDedupStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for _, key := range []string{"logs/1", "logs/2"} {
+		if seen, err := store.Seen(key); err != nil || !seen {
+			t.Errorf("Seen(%q) = %v, %v after reopening", key, seen, err)
+		}
+	}
+	if seen, _ := store.Seen("logs/3"); seen {
+		t.Error("unmarked key seen")
+	}
+
+	// Reopening compacted the repeated line away.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("file has %d lines after compaction, want 2", lines)
+	}
+}
+
+func TestFileDedupStoreShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+
+	a, err := NewFileDedupStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewFileDedupStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	a.Mark("x")
+	if seen, _ := b.Seen("x"); !seen {
+		t.Error("mark from another store not seen")
+	}
+
+	// Enough marks for a to compact, replacing the file under b.
+	for i := 0; i < 2*fileDedupSlack; i++ {
+		if err := a.Mark("y"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Mark("z")
+	for _, key := range []string{"x", "y", "z"} {
+		if seen, _ := a.Seen(key); !seen {
+			t.Errorf("a lost %s", key)
+		}
+		if seen, _ := b.Seen(key); !seen {
+			t.Errorf("b lost %s", key)
+		}
+	}
+}
+
+const dedupHelperEnv = "PUBSUB_TEST_DEDUP_FILE"
+
+// TestFileDedupStoreAcrossProcesses runs two processes claiming the same
+// keys through one store. Every key must be handled exactly once.
+func TestFileDedupStoreAcrossProcesses(t *testing.T) {
+	const keys = 200
+
+	if path := os.Getenv(dedupHelperEnv); path != "" {
+		claimKeys(t, path, keys)
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "dedup")
+	outputs := make([][]byte, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestFileDedupStoreAcrossProcesses$", "-test.v")
+			cmd.Env = append(os.Environ(), dedupHelperEnv+"="+path)
+			outputs[i], errs[i] = cmd.CombinedOutput()
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for i, out := range outputs {
+		if errs[i] != nil {
+			t.Fatalf("helper failed: %v\n%s", errs[i], out)
+		}
+		_, after, ok := strings.Cut(string(out), "handled ")
+		if !ok {
+			t.Fatalf("helper printed no count:\n%s", out)
+		}
+		n, err := strconv.Atoi(strings.Fields(after)[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += n
+	}
+	if total != keys {
+		t.Errorf("%d keys handled across processes, want %d", total, keys)
+	}
+}
+
+func claimKeys(t *testing.T, path string, keys int) {
+	store, err := NewFileDedupStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	handled := 0
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		unlock, err := store.Lock(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen, err := store.Seen(key); err != nil {
+			t.Fatal(err)
+		} else if !seen {
+			handled++
+			time.Sleep(100 * time.Microsecond)
+			if err := store.Mark(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		unlock()
+	}
+	fmt.Printf("handled %d\n", handled)
+}
+
+func TestDeduplication(t *testing.T) {
+	_, conn := newTestBroker(t)
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	handled := make(chan string, 10)
+	sub, err := SubscribeDelivery(testContext(t), conn, testExchange, "dedup", "dedup.*", Transient, func(d Delivery[string]) AckType {
+		mu.Lock()
+		calls[d.Meta.MessageId]++
+		n := calls[d.Meta.MessageId]
+		mu.Unlock()
+
+		handled <- d.Meta.MessageId
+		// A requeued delivery isn't marked, so it comes back.
+		if d.Body == "flaky" && n == 1 {
+			return NackRequeue
+		}
+		return Ack
+	}, WithDeduplication(NewMemoryDedupStore(100, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(id, body string) {
+		t.Helper()
+		err := ch.PublishWithContext(context.Background(), testExchange, "dedup.alice", false, false, amqp.Publishing{
+			ContentType: ContentTypeJSON,
+			MessageId:   id,
+			Body:        []byte(strconv.Quote(body)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publish("m1", "once")
+	publish("m1", "once")
+	publish("m2", "flaky")
+	publish("", "no id")
+	publish("", "no id")
+
+	var got []string
+	for i := 0; i < 5; i++ {
+		got = append(got, receive(t, handled))
+	}
+	nothing(t, handled)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["m1"] != 1 || calls["m2"] != 2 || calls[""] != 2 {
+		t.Errorf("handled %v (in order %v)", calls, got)
+	}
+	if n := sub.Duplicates(); n != 1 {
+		t.Errorf("Duplicates() = %d, want 1", n)
+	}
+}
@@ -0,0 +1,205 @@
+package pubsub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// KeyIdHeader names the key an encrypted body was sealed with. Messages
+// without it are not encrypted.
+const KeyIdHeader = "x-key-id"
+
+// ErrNotEncrypted is a plaintext delivery to a subscription that only
+// accepts encrypted ones.
+var ErrNotEncrypted = errors.New("pubsub: message is not encrypted")
+
+// CipherKeySize is the size of keys from GenerateCipherKey, for AES-256.
+const CipherKeySize = 32
+
+// ErrNoCurrentKey is returned when publishing with keys that have nothing to
+// encrypt with yet.
+var ErrNoCurrentKey = errors.New("pubsub: no current encryption key")
+
+// UnknownKeyError is returned when a delivery was encrypted with a key the
+// subscriber doesn't have, such as one rotated in before it was shared.
+type UnknownKeyError struct {
+	KeyId string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("pubsub: unknown encryption key %q", e.KeyId)
+}
+
+// CipherKeys holds the AES keys for one recipient or group by ID. New
+// messages are sealed with the current key; older keys are kept so that
+// messages sealed before a rotation can still be opened. It is safe for
+// concurrent use.
+type CipherKeys struct {
+	mu      sync.RWMutex
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+func NewCipherKeys() *CipherKeys {
+	return &CipherKeys{keys: map[string]cipher.AEAD{}}
+}
+
+// GenerateCipherKey returns a random AES-256 key.
+func GenerateCipherKey() ([]byte, error) {
+	key := make([]byte, CipherKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Add makes key available for opening messages under id. The first key
+// added becomes the current one. key must be 16, 24 or 32 bytes.
+func (k *CipherKeys) Add(id string, key []byte) error {
+	if id == "" {
+		return errors.New("pubsub: encryption key needs an id")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys[id] = aead
+	if k.current == "" {
+		k.current = id
+	}
+
+	return nil
+}
+
+// Rotate adds key under id and seals every later message with it.
+func (k *CipherKeys) Rotate(id string, key []byte) error {
+	if err := k.Add(id, key); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.current = id
+
+	return nil
+}
+
+// Retire forgets a key once nothing sealed with it is left. The current key
+// can't be retired; rotate away from it first.
+func (k *CipherKeys) Retire(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if id == k.current {
+		return fmt.Errorf("pubsub: can't retire current encryption key %q", id)
+	}
+	delete(k.keys, id)
+
+	return nil
+}
+
+func (k *CipherKeys) Current() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.current
+}
+
+// Seal encrypts body with the current key and returns the key's id. The
+// random nonce is prepended to the ciphertext.
+func (k *CipherKeys) Seal(body []byte) ([]byte, string, error) {
+	k.mu.RLock()
+	id := k.current
+	aead := k.keys[id]
+	k.mu.RUnlock()
+
+	if aead == nil {
+		return nil, "", ErrNoCurrentKey
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(body)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+
+	return aead.Seal(nonce, nonce, body, []byte(id)), id, nil
+}
+
+// Open decrypts a body sealed with the key id.
+func (k *CipherKeys) Open(id string, body []byte) ([]byte, error) {
+	k.mu.RLock()
+	aead := k.keys[id]
+	k.mu.RUnlock()
+
+	if aead == nil {
+		return nil, &UnknownKeyError{KeyId: id}
+	}
+	if len(body) < aead.NonceSize() {
+		return nil, fmt.Errorf("pubsub: body sealed with %q is too short", id)
+	}
+
+	nonce, sealed := body[:aead.NonceSize()], body[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, []byte(id))
+}
+
+// WithEncryption seals the body with keys' current key, after any
+// compression, so that only holders of the key can read it.
+func WithEncryption(keys *CipherKeys) PublishOption {
+	return func(p *publishConfig) {
+		p.cipherKeys = keys
+	}
+}
+
+// WithDecryption opens deliveries with keys before decoding them, and
+// only accepts encrypted ones: a plaintext delivery fails with
+// ErrNotEncrypted, so that nobody can get around the encryption by leaving
+// it off. Deliveries sealed with a key keys can't find fail with an
+// *UnknownKeyError. Either is treated like any other undecodable message.
+// Encrypted deliveries arriving at a subscription without keys fail with an
+// *UnknownKeyError too.
+func WithDecryption(keys *CipherKeys) SubscribeOption {
+	return func(config *subscribeConfig) {
+		config.cipherKeys = keys
+	}
+}
+
+// Decrypt opens a body sealed with the key keyId. Without keys, a body
+// carrying no key id is passed through; with them, it is refused.
+func Decrypt(keys *CipherKeys, keyId string, body []byte) ([]byte, error) {
+	if keys == nil {
+		if keyId == "" {
+			return body, nil
+		}
+		return nil, &UnknownKeyError{KeyId: keyId}
+	}
+	if keyId == "" {
+		return nil, ErrNotEncrypted
+	}
+
+	return keys.Open(keyId, body)
+}
+
+// encrypt applies the configured encryption to a body and returns the id of
+// the key used.
+func (p publishConfig) encrypt(body []byte) ([]byte, string, error) {
+	if p.cipherKeys == nil {
+		return body, "", nil
+	}
+
+	return p.cipherKeys.Seal(body)
+}
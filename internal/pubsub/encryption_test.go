@@ -0,0 +1,176 @@
+package pubsub
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestCipherKeys(t *testing.T, ids ...string) *CipherKeys {
+	t.Helper()
+
+	keys := NewCipherKeys()
+	for _, id := range ids {
+		key, err := GenerateCipherKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keys.Rotate(id, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return keys
+}
+
+func TestCipherKeysSealOpen(t *testing.T) {
+	keys := newTestCipherKeys(t, "k1")
+	plain := []byte("alice won a war against bob")
+
+	sealed, id, err := keys.Seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "k1" || bytes.Contains(sealed, plain) {
+		t.Fatalf("sealed under %q as %q", id, sealed)
+	}
+	again, _, _ := keys.Seal(plain)
+	if bytes.Equal(sealed, again) {
+		t.Error("sealing twice gave the same bytes")
+	}
+
+	opened, err := keys.Open(id, sealed)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("Open() = %q, %v", opened, err)
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := keys.Open(id, tampered); err == nil {
+		t.Error("opened a tampered body")
+	}
+	if _, err := keys.Open(id, sealed[:4]); err == nil {
+		t.Error("opened a truncated body")
+	}
+}
+
+// TestCipherKeysBindId checks that a body only opens under the id it was
+// sealed with, even where two ids share a key.
+func TestCipherKeysBindId(t *testing.T) {
+	key, _ := GenerateCipherKey()
+	keys := NewCipherKeys()
+	keys.Add("k1", key)
+	keys.Add("k2", key)
+
+	sealed, _, err := keys.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Open("k2", sealed); err == nil {
+		t.Error("opened under another id")
+	}
+}
+
+func TestCipherKeysRotation(t *testing.T) {
+	keys := NewCipherKeys()
+	if _, _, err := keys.Seal([]byte("x")); !errors.Is(err, ErrNoCurrentKey) {
+		t.Errorf("Seal() with no keys = %v, want ErrNoCurrentKey", err)
+	}
+	if err := keys.Add("short", []byte("too short")); err == nil {
+		t.Error("added a key of the wrong size")
+	}
+
+	keys = newTestCipherKeys(t, "k1")
+	old, _, _ := keys.Seal([]byte("before"))
+
+	key, _ := GenerateCipherKey()
+	keys.Rotate("k2", key)
+	if _, id, _ := keys.Seal([]byte("after")); id != "k2" || keys.Current() != "k2" {
+		t.Errorf("sealed with %q after rotating", id)
+	}
+	if opened, err := keys.Open("k1", old); err != nil || string(opened) != "before" {
+		t.Errorf("opening under the old key = %q, %v", opened, err)
+	}
+
+	if err := keys.Retire("k2"); err == nil {
+		t.Error("retired the current key")
+	}
+	if err := keys.Retire("k1"); err != nil {
+		t.Fatal(err)
+	}
+	var unknown *UnknownKeyError
+	if _, err := keys.Open("k1", old); !errors.As(err, &unknown) || unknown.KeyId != "k1" {
+		t.Errorf("opening under a retired key = %v, want *UnknownKeyError", err)
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	keys := newTestCipherKeys(t, "k1")
+	sealed, id, _ := keys.Seal([]byte("secret"))
+
+	if body, err := Decrypt(nil, "", []byte("plain")); err != nil || string(body) != "plain" {
+		t.Errorf("without keys, plaintext: %q, %v", body, err)
+	}
+	var unknown *UnknownKeyError
+	if _, err := Decrypt(nil, id, sealed); !errors.As(err, &unknown) {
+		t.Errorf("without keys, sealed: %v, want *UnknownKeyError", err)
+	}
+	if _, err := Decrypt(keys, "", []byte("plain")); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("with keys, plaintext: %v, want ErrNotEncrypted", err)
+	}
+	if body, err := Decrypt(keys, id, sealed); err != nil || string(body) != "secret" {
+		t.Errorf("with keys, sealed: %q, %v", body, err)
+	}
+}
+
+func TestEncryptionSubscription(t *testing.T) {
+	_, conn := newTestBroker(t)
+	keys := newTestCipherKeys(t, "logs/1")
+
+	type gameLog struct {
+		Message string
+	}
+	handled := make(chan gameLog, 10)
+	decodeErrs := make(chan *DecodeError, 10)
+	_, err := Subscribe(testContext(t), conn, testExchange, "logs", "logs.*", Transient, func(gl gameLog) AckType {
+		handled <- gl
+		return Ack
+	},
+		WithDecryption(keys),
+		WithDecodeErrorPolicy(DiscardOnDecodeError),
+		WithDecodeErrorHandler(func(de *DecodeError) { decodeErrs <- de }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy of everything published, to see what went over the wire.
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare("wire", false, false, false, false, nil)
+	ch.QueueBind("wire", "logs.*", testExchange, false, nil)
+
+	message := strings.Repeat("alice won a war against bob. ", 20)
+	if err := PublishGob(ch, testExchange, "logs.alice", gameLog{Message: message}, WithCompression(Gzip, 0), WithEncryption(keys)); err != nil {
+		t.Fatal(err)
+	}
+	if gl := receive(t, handled); gl.Message != message {
+		t.Errorf("handled %q", gl.Message)
+	}
+	wire, _, _ := ch.Get("wire", true)
+	if wire.Headers[KeyIdHeader] != "logs/1" || bytes.Contains(wire.Body, []byte("alice")) {
+		t.Errorf("published with key %v as %q", wire.Headers[KeyIdHeader], wire.Body)
+	}
+
+	// Leaving the encryption off doesn't get a message in.
+	if err := PublishGob(ch, testExchange, "logs.alice", gameLog{Message: "forged"}); err != nil {
+		t.Fatal(err)
+	}
+	if de := receive(t, decodeErrs); !errors.Is(de.Err, ErrNotEncrypted) {
+		t.Errorf("decode error %v, want ErrNotEncrypted", de.Err)
+	}
+	nothing(t, handled)
+}
@@ -0,0 +1,152 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Envelope headers for what AMQP has no property for.
+const (
+	SchemaVersionHeader = "x-schema-version"
+	CausationIdHeader   = "x-causation-id"
+)
+
+// DefaultSchemaVersion is stamped on messages published without
+// WithSchemaVersion.
+const DefaultSchemaVersion = 1
+
+// Meta is the envelope around a payload.
+//
+// MessageId is unique per publish. CorrelationId is shared by every message
+// in a chain that started with one action, and CausationId is the MessageId
+// of the message that directly caused this one, so a game log can be traced
+// back through the war to the army move that started it.
+//
+// Trace is the span context the message was published under. Inside a
+// handler it is the handler's own span, so that messages published with
+// WithCausedBy continue the trace.
+//
+// Signer is who signed the message, set only by subscriptions
+// WithVerification once the signature has been checked.
+type Meta struct {
+	MessageId     string
+	CorrelationId string
+	CausationId   string
+	Timestamp     time.Time
+	AppId         string
+	ReplyTo       string
+	SchemaVersion int
+	Exchange      string
+	RoutingKey    string
+	Queue         string
+	ContentType   string
+	Redelivered   bool
+	Trace         tracing.SpanContext
+	Signer        string
+}
+
+// Delivery is a decoded payload together with its envelope.
+type Delivery[T any] struct {
+	Meta Meta
+	Body T
+
+	ctx context.Context
+}
+
+// MetaOf reads the envelope of a raw delivery. Messages from publishers that
+// predate envelopes have schema version 0 and empty IDs.
+func MetaOf(d amqp.Delivery) Meta {
+	version, _ := argInt(d.Headers, SchemaVersionHeader)
+	causationId, _ := d.Headers[CausationIdHeader].(string)
+	exchange, key := originalRoute(d)
+
+	return Meta{
+		MessageId:     d.MessageId,
+		CorrelationId: d.CorrelationId,
+		CausationId:   causationId,
+		Timestamp:     d.Timestamp,
+		AppId:         d.AppId,
+		ReplyTo:       d.ReplyTo,
+		SchemaVersion: int(version),
+		Exchange:      exchange,
+		RoutingKey:    key,
+		ContentType:   d.ContentType,
+		Redelivered:   d.Redelivered,
+		Trace:         traceOf(d),
+	}
+}
+
+// WithCausedBy marks the message as a consequence of the one described by
+// parent: it joins parent's correlation chain and trace and records parent
+// as its cause.
+func WithCausedBy(parent Meta) PublishOption {
+	return func(p *publishConfig) {
+		p.correlationId = parent.CorrelationId
+		if p.correlationId == "" {
+			p.correlationId = parent.MessageId
+		}
+		p.causationId = parent.MessageId
+		p.trace = parent.Trace
+	}
+}
+
+func WithSchemaVersion(version int) PublishOption {
+	return func(p *publishConfig) {
+		p.schemaVersion = version
+	}
+}
+
+// stamp fills in the envelope of an outgoing message. A message that starts
+// a chain is its own correlation ID.
+func (p publishConfig) stamp(msg *amqp.Publishing) {
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+
+	msg.MessageId = NewMessageId()
+	msg.Timestamp = time.Now()
+	msg.CorrelationId = p.correlationId
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = msg.MessageId
+	}
+	if p.causationId != "" {
+		msg.Headers[CausationIdHeader] = p.causationId
+	}
+	msg.Headers[SchemaVersionHeader] = int64(p.schemaVersion)
+}
+
+// NewMessageId returns a random (version 4) UUID.
+func NewMessageId() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+type appPublisher struct {
+	Publisher
+	appId string
+}
+
+// NewAppPublisher wraps pub so that every message it publishes without an
+// AppId is stamped with appId, identifying the sending program or player.
+func NewAppPublisher(pub Publisher, appId string) Publisher {
+	return appPublisher{Publisher: pub, appId: appId}
+}
+
+func (p appPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if msg.AppId == "" {
+		msg.AppId = p.appId
+	}
+
+	return p.Publisher.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
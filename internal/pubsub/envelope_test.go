@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestEnvelope(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+
+	handled := make(chan Meta, 10)
+	_, err := SubscribeDelivery(testContext(t), conn, testExchange, "stamped", "stamped.*", Transient, func(d Delivery[string]) AckType {
+		handled <- d.Meta
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub := NewAppPublisher(ch, "alice")
+	before := time.Now()
+	if err := PublishJSON(pub, testExchange, "stamped.move", "move"); err != nil {
+		t.Fatal(err)
+	}
+	parent := receive(t, handled)
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(parent.MessageId) {
+		t.Errorf("MessageId %q isn't a UUID", parent.MessageId)
+	}
+	if parent.CorrelationId != parent.MessageId || parent.CausationId != "" {
+		t.Errorf("first in its chain but correlated %q, caused by %q", parent.CorrelationId, parent.CausationId)
+	}
+	if parent.AppId != "alice" || parent.SchemaVersion != DefaultSchemaVersion || parent.RoutingKey != "stamped.move" {
+		t.Errorf("stamped %+v", parent)
+	}
+	if parent.Timestamp.Before(before.Truncate(time.Second)) {
+		t.Errorf("timestamped %v, before it was published", parent.Timestamp)
+	}
+
+	if err := PublishJSON(pub, testExchange, "stamped.war", "war", WithCausedBy(parent), WithSchemaVersion(2)); err != nil {
+		t.Fatal(err)
+	}
+	child := receive(t, handled)
+	if child.MessageId == parent.MessageId || child.CorrelationId != parent.MessageId || child.CausationId != parent.MessageId {
+		t.Errorf("child %+v of %+v", child, parent)
+	}
+	if child.SchemaVersion != 2 {
+		t.Errorf("child has schema version %d", child.SchemaVersion)
+	}
+}
+
+func TestMetaOfLegacy(t *testing.T) {
+	meta := MetaOf(amqp.Delivery{Exchange: testExchange, RoutingKey: "moves.alice"})
+	if meta.SchemaVersion != 0 || meta.MessageId != "" || meta.CorrelationId != "" {
+		t.Errorf("legacy delivery read as %+v", meta)
+	}
+	if meta.Exchange != testExchange || meta.RoutingKey != "moves.alice" {
+		t.Errorf("legacy delivery routed as %q %q", meta.Exchange, meta.RoutingKey)
+	}
+}
@@ -0,0 +1,81 @@
+package pubsub
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileLock serialises work across the processes sharing a lock file, one
+// stripe at a time. Record locks belong to the process rather than the
+// goroutine, and closing any descriptor of the file drops them all, so a
+// process opens each lock file once and every stripe also has a mutex for
+// the goroutines in it.
+type fileLock struct {
+	path    string
+	f       *os.File
+	stripes []sync.Mutex
+	refs    int
+}
+
+var (
+	fileLocksMu sync.Mutex
+	fileLocks   = map[string]*fileLock{}
+)
+
+// openFileLock opens the lock file at path, or shares the one this process
+// already has open. A lock file is always opened with the same stripes.
+func openFileLock(path string, stripes int) (*fileLock, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fileLocksMu.Lock()
+	defer fileLocksMu.Unlock()
+
+	if l, ok := fileLocks[path]; ok {
+		l.refs++
+		return l, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &fileLock{path: path, f: f, stripes: make([]sync.Mutex, max(stripes, 1)), refs: 1}
+	fileLocks[path] = l
+
+	return l, nil
+}
+
+// lock waits for a stripe, shared with other processes' shared holders or
+// exclusive, and returns the function that releases it.
+func (l *fileLock) lock(stripe int, exclusive bool) (func(), error) {
+	stripe %= len(l.stripes)
+	mu := &l.stripes[stripe]
+	mu.Lock()
+
+	if err := lockRecord(l.f, stripe, exclusive); err != nil {
+		mu.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		unlockRecord(l.f, stripe)
+		mu.Unlock()
+	}, nil
+}
+
+func (l *fileLock) close() error {
+	fileLocksMu.Lock()
+	defer fileLocksMu.Unlock()
+
+	if l.refs--; l.refs > 0 {
+		return nil
+	}
+	delete(fileLocks, l.path)
+
+	return l.f.Close()
+}
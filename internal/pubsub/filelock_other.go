@@ -0,0 +1,15 @@
+//go:build !unix
+
+package pubsub
+
+import "os"
+
+// Without fcntl record locks, a lock file only serialises the goroutines of
+// this process.
+func lockRecord(f *os.File, stripe int, exclusive bool) error {
+	return nil
+}
+
+func unlockRecord(f *os.File, stripe int) error {
+	return nil
+}
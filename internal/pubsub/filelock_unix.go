@@ -0,0 +1,33 @@
+//go:build unix
+
+package pubsub
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockRecord takes an fcntl lock on byte stripe of f.
+func lockRecord(f *os.File, stripe int, exclusive bool) error {
+	kind := int16(syscall.F_RDLCK)
+	if exclusive {
+		kind = syscall.F_WRLCK
+	}
+
+	return fcntlRecord(f, stripe, kind)
+}
+
+func unlockRecord(f *os.File, stripe int) error {
+	return fcntlRecord(f, stripe, syscall.F_UNLCK)
+}
+
+func fcntlRecord(f *os.File, stripe int, kind int16) error {
+	lk := syscall.Flock_t{Type: kind, Whence: io.SeekStart, Start: int64(stripe), Len: 1}
+	for {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &lk)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	ErrBlocked    = errors.New("pubsub: broker is blocking publishers")
+	ErrFlowBuffer = errors.New("pubsub: blocked publish buffer is full")
+)
+
+// FlowPolicy decides what publishes through a Manager do while the broker
+// is blocking publishers.
+type FlowPolicy int
+
+const (
+	FlowBlock FlowPolicy = iota
+	FlowFailFast
+	// FlowBuffer holds publishes in memory and sends them once the broker
+	// unblocks.
+	FlowBuffer
+)
+
+func (p FlowPolicy) String() string {
+	switch p {
+	case FlowBlock:
+		return "block"
+	case FlowFailFast:
+		return "fail-fast"
+	case FlowBuffer:
+		return "buffer"
+	default:
+		return "unknown"
+	}
+}
+
+// WithFlowPolicy defaults to FlowBlock. bufferSize only matters to FlowBuffer.
+func WithFlowPolicy(policy FlowPolicy, bufferSize int) ManagerOption {
+	return func(m *Manager) {
+		m.flowPolicy = policy
+		m.flowBuffer = bufferSize
+	}
+}
+
+type flowGate interface {
+	admit(ctx context.Context) (bool, error)
+	release()
+	unblockedCh() <-chan struct{}
+}
+
+func (m *Manager) Blocked() (bool, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.isBlocked(), m.blockReason
+}
+
+// NotifyBlocked keeps receiving notifications across reconnects and is
+// closed with the manager.
+func (m *Manager) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		close(receiver)
+		return receiver
+	}
+	m.blockings = append(m.blockings, newBlockingListener(receiver))
+
+	return receiver
+}
+
+type blockingListener struct {
+	receiver chan amqp.Blocking
+	events   *eventQueue
+}
+
+func newBlockingListener(receiver chan amqp.Blocking) *blockingListener {
+	return &blockingListener{receiver: receiver, events: newEventQueue()}
+}
+
+func (l *blockingListener) send(b amqp.Blocking) {
+	l.events.post(func() {
+		l.receiver <- b
+	})
+}
+
+func (l *blockingListener) close() {
+	l.events.post(func() {
+		close(l.receiver)
+	})
+	l.events.post(nil)
+}
+
+func (m *Manager) watchBlocked(conn Broker) {
+	blocker, ok := conn.(Blocker)
+	if !ok {
+		return
+	}
+
+	go m.followBlocked(conn, blocker.NotifyBlocked(make(chan amqp.Blocking, 1)))
+}
+
+func (m *Manager) followBlocked(conn Broker, blockings chan amqp.Blocking) {
+	for b := range blockings {
+		m.mu.Lock()
+		current := m.conn
+		m.mu.Unlock()
+		if current != conn {
+			return
+		}
+
+		m.setBlocked(b)
+	}
+}
+
+func (m *Manager) setBlocked(b amqp.Blocking) {
+	if !b.Active {
+		// Nothing may be published between unblocking and flushing what
+		// was held, or it would overtake it.
+		m.pubMu.Lock()
+		defer m.pubMu.Unlock()
+	}
+
+	m.mu.Lock()
+	if b.Active == m.isBlocked() {
+		m.mu.Unlock()
+		return
+	}
+
+	flush := false
+	if b.Active {
+		log.Printf("Broker is blocking publishers: %s", b.Reason)
+		m.blockReason = b.Reason
+		m.unblocked = make(chan struct{})
+	} else {
+		log.Print("Broker stopped blocking publishers")
+		m.blockReason = ""
+		close(m.unblocked)
+		flush = m.conn != nil && !m.restoring
+	}
+	for _, l := range m.blockings {
+		l.send(b)
+	}
+	m.mu.Unlock()
+
+	if flush {
+		m.flush()
+	}
+}
+
+// isBlocked requires the manager lock.
+func (m *Manager) isBlocked() bool {
+	select {
+	case <-m.unblocked:
+		return false
+	default:
+		return true
+	}
+}
+
+// admit reports whether the publish must be held until the broker unblocks,
+// in which case it has taken a buffer slot that release gives back.
+func (m *Manager) admit(ctx context.Context) (bool, error) {
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return false, ErrManagerClosed
+		}
+		if !m.isBlocked() {
+			m.mu.Unlock()
+			return false, nil
+		}
+
+		switch m.flowPolicy {
+		case FlowFailFast:
+			m.mu.Unlock()
+			return false, ErrBlocked
+		case FlowBuffer:
+			full := m.flowHeld >= m.flowBuffer
+			if !full {
+				m.flowHeld++
+			}
+			m.mu.Unlock()
+			if full {
+				return false, ErrFlowBuffer
+			}
+			return true, nil
+		}
+
+		unblocked := m.unblocked
+		m.mu.Unlock()
+
+		select {
+		case <-unblocked:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-m.done:
+			return false, ErrManagerClosed
+		}
+	}
+}
+
+func (m *Manager) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.flowHeld--
+}
+
+func (m *Manager) unblockedCh() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.unblocked
+}
@@ -0,0 +1,202 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// newTestManager returns a Manager on b, and a listener for its blocked
+// notifications.
+func newTestManager(t *testing.T, b *MemoryBroker, opts ...ManagerOption) (*Manager, chan amqp.Blocking) {
+	t.Helper()
+
+	opts = append([]ManagerOption{WithDialer(func(string) (Broker, error) { return b.Connect(), nil })}, opts...)
+	m, err := NewManager("", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	return m, m.NotifyBlocked(make(chan amqp.Blocking, 10))
+}
+
+// setBlocked blocks or unblocks b and waits for the manager to hear of it.
+func setBlocked(t *testing.T, b *MemoryBroker, blockings chan amqp.Blocking, active bool) {
+	t.Helper()
+
+	if active {
+		b.Block("low on memory")
+	} else {
+		b.Unblock()
+	}
+	if got := receive(t, blockings); got.Active != active {
+		t.Fatalf("notified %+v, want active %v", got, active)
+	}
+}
+
+func TestFlowFailFast(t *testing.T) {
+	b, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	m, blockings := newTestManager(t, b, WithFlowPolicy(FlowFailFast, 0))
+
+	setBlocked(t, b, blockings, true)
+	if blocked, reason := m.Blocked(); !blocked || reason != "low on memory" {
+		t.Errorf("Blocked() = %v, %q", blocked, reason)
+	}
+	if err := PublishJSON(m, testExchange, "batch.ok", "refused"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("publish while blocked = %v, want ErrBlocked", err)
+	}
+
+	setBlocked(t, b, blockings, false)
+	if err := PublishJSON(m, testExchange, "batch.ok", "sent"); err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 1 || got[0] != `"sent"` {
+		t.Errorf("queue holds %v", got)
+	}
+}
+
+func TestFlowBlock(t *testing.T) {
+	b, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	m, blockings := newTestManager(t, b)
+
+	setBlocked(t, b, blockings, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := PublishJSON(m, testExchange, "batch.ok", "gave up", WithContext(ctx)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("publish while blocked = %v, want DeadlineExceeded", err)
+	}
+
+	published := make(chan error, 1)
+	go func() {
+		published <- PublishJSON(m, testExchange, "batch.ok", "waited")
+	}()
+	nothing(t, published)
+
+	setBlocked(t, b, blockings, false)
+	if err := receive(t, published); err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 1 || got[0] != `"waited"` {
+		t.Errorf("queue holds %v", got)
+	}
+}
+
+func TestFlowBuffer(t *testing.T) {
+	b, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	m, blockings := newTestManager(t, b, WithFlowPolicy(FlowBuffer, 2))
+
+	setBlocked(t, b, blockings, true)
+	for _, body := range []string{"first", "second"} {
+		if err := PublishJSON(m, testExchange, "batch.ok", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := PublishJSON(m, testExchange, "batch.ok", "third"); !errors.Is(err, ErrFlowBuffer) {
+		t.Errorf("publish beyond the buffer = %v, want ErrFlowBuffer", err)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 0 {
+		t.Fatalf("%v sent while blocked", got)
+	}
+
+	setBlocked(t, b, blockings, false)
+	if err := PublishJSON(m, testExchange, "batch.ok", "after"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{`"first"`, `"second"`, `"after"`}
+	got := queued(t, ch, "batch")
+	if len(got) != len(want) {
+		t.Fatalf("queue holds %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("queue holds %v, want %v", got, want)
+		}
+	}
+
+	// The buffer's slots were given back.
+	setBlocked(t, b, blockings, true)
+	for _, body := range []string{"again", "and again"} {
+		if err := PublishJSON(m, testExchange, "batch.ok", body); err != nil {
+			t.Errorf("publish after the flush: %v", err)
+		}
+	}
+}
+
+// TestFlowBufferConfirms checks that publishes a ConfirmingPublisher holds
+// while blocked are confirmed once sent, or fail with their own context.
+func TestFlowBufferConfirms(t *testing.T) {
+	b, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	m, blockings := newTestManager(t, b, WithFlowPolicy(FlowBuffer, 10))
+	pub := newTestConfirmingPublisher(t, m)
+
+	setBlocked(t, b, blockings, true)
+
+	ctx := context.Background()
+	kept, err := pub.PublishAsync(ctx, testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte("kept")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandonedCtx, abandon := context.WithCancel(ctx)
+	abandoned, err := pub.PublishAsync(abandonedCtx, testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte("abandoned")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	behind, err := pub.PublishAsync(ctx, testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte("behind")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandon()
+
+	select {
+	case <-kept.Done():
+		t.Fatal("confirmed while blocked")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	setBlocked(t, b, blockings, false)
+	for name, c := range map[string]*PublishConfirmation{"kept": kept, "behind": behind} {
+		if err := c.Wait(ctx); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if err := abandoned.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("abandoned: %v, want Canceled", err)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 2 || got[0] != "kept" || got[1] != "behind" {
+		t.Errorf("queue holds %v", got)
+	}
+}
+
+// TestNotifyBlockedSlowListener checks that a listener that never reads
+// holds up neither the other listeners nor publishing.
+func TestNotifyBlockedSlowListener(t *testing.T) {
+	b, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	m, blockings := newTestManager(t, b, WithFlowPolicy(FlowBuffer, 10))
+	m.NotifyBlocked(make(chan amqp.Blocking))
+
+	for i := 0; i < 3; i++ {
+		setBlocked(t, b, blockings, true)
+		if err := PublishJSON(m, testExchange, "batch.ok", i); err != nil {
+			t.Fatal(err)
+		}
+		setBlocked(t, b, blockings, false)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 3 {
+		t.Errorf("queue holds %v", got)
+	}
+
+	m.Close()
+	for range blockings {
+	}
+}
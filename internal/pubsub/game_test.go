@@ -0,0 +1,210 @@
+package pubsub_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/topology"
+)
+
+// player is one client in the game: its state and a publisher signing as it.
+type player struct {
+	state  *gamelogic.GameState
+	sender pubsub.Publisher
+}
+
+func newPlayer(t *testing.T, broker pubsub.Broker, ring *pubsub.KeyRing, username string) *player {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := pubsub.NewSigner(username, priv)
+	if err := ring.Register(username, signer.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher, err := pubsub.NewConfirmingPublisher(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { publisher.Close() })
+
+	return &player{
+		state:  gamelogic.NewGameState(username),
+		sender: pubsub.NewSigningPublisher(publisher, signer),
+	}
+}
+
+// subscribe wires p up the way the client does, with its game logs
+// encrypted under logKeys.
+func (p *player) subscribe(t *testing.T, ctx context.Context, broker pubsub.Broker, ring *pubsub.KeyRing, logKeys *pubsub.CipherKeys) {
+	t.Helper()
+
+	username := p.state.GetUsername()
+	_, err := pubsub.SubscribeDelivery(
+		ctx,
+		broker,
+		routing.ExchangePerilTopic,
+		topology.QueueName(topology.ArmyMovesQueue, username),
+		topology.ArmyMovesKey,
+		pubsub.Transient,
+		func(d pubsub.Delivery[gamelogic.ArmyMove]) pubsub.AckType {
+			switch p.state.HandleMove(d.Body) {
+			case gamelogic.MoveOutComeSafe:
+				return pubsub.Ack
+			case gamelogic.MoveOutcomeMakeWar:
+				if err := pubsub.PublishJSON(
+					p.sender,
+					routing.ExchangePerilTopic,
+					fmt.Sprintf("%s.%s", routing.WarRecognitionsPrefix, username),
+					gamelogic.RecognitionOfWar{Attacker: d.Body.Player, Defender: p.state.GetPlayerSnap()},
+					pubsub.WithCausedBy(d.Meta),
+				); err != nil {
+					return pubsub.NackRequeue
+				}
+				return pubsub.Ack
+			}
+			return pubsub.NackDiscard
+		},
+		pubsub.WithQueueOptions(topology.ArmyMovesOptions...),
+		pubsub.WithVerification(ring),
+		pubsub.WithMiddleware(pubsub.RequireSigner(func(am gamelogic.ArmyMove) string { return am.Player.Username })),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pubsub.SubscribeDelivery(
+		ctx,
+		broker,
+		routing.ExchangePerilTopic,
+		topology.WarQueue,
+		topology.WarKey,
+		pubsub.Quorum,
+		func(d pubsub.Delivery[gamelogic.RecognitionOfWar]) pubsub.AckType {
+			outcome, winner, loser := p.state.HandleWar(d.Body)
+			switch outcome {
+			case gamelogic.WarOutcomeNotInvolved:
+				return pubsub.RetryLater
+			case gamelogic.WarOutcomeYouWon, gamelogic.WarOutcomeOpponentWon:
+				message := fmt.Sprintf("%s won a war against %s", winner, loser)
+				return pubsub.PublishGameLog(p.sender, message, username, pubsub.WithCausedBy(d.Meta), pubsub.WithEncryption(logKeys))
+			case gamelogic.WarOutcomeDraw:
+				message := fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
+				return pubsub.PublishGameLog(p.sender, message, username, pubsub.WithCausedBy(d.Meta), pubsub.WithEncryption(logKeys))
+			}
+			return pubsub.NackDiscard
+		},
+		pubsub.WithRetryPolicy(pubsub.RetryPolicy{InitialDelay: 10 * time.Millisecond}),
+		pubsub.WithDeduplication(pubsub.NewMemoryDedupStore(100, time.Minute)),
+		pubsub.WithVerification(ring),
+		pubsub.WithMiddleware(pubsub.RequireSigner(func(rw gamelogic.RecognitionOfWar) string { return rw.Defender.Username })),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMoveWarGameLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	memory := pubsub.NewMemoryBroker()
+	broker := memory.Connect()
+	ch, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := topology.Peril.Declare(ch, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	ring, err := pubsub.NewKeyRing("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logKeys := pubsub.NewCipherKeys()
+	key, err := pubsub.GenerateCipherKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logKeys.Rotate("logs-1", key); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := make(chan pubsub.Delivery[routing.GameLog], 10)
+	_, err = pubsub.SubscribeDelivery(
+		ctx,
+		broker,
+		routing.ExchangePerilTopic,
+		topology.GameLogsQueue,
+		topology.GameLogsKey,
+		pubsub.Quorum,
+		func(d pubsub.Delivery[routing.GameLog]) pubsub.AckType {
+			logs <- d
+			return pubsub.Ack
+		},
+		pubsub.WithDefaultCodec(pubsub.Gob),
+		pubsub.WithVerification(ring),
+		pubsub.WithDecryption(logKeys),
+		pubsub.WithMiddleware(pubsub.RequireSigner(func(gl routing.GameLog) string { return gl.Username })),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := newPlayer(t, memory.Connect(), ring, "alice")
+	bob := newPlayer(t, memory.Connect(), ring, "bob")
+	alice.subscribe(t, ctx, memory.Connect(), ring, logKeys)
+	bob.subscribe(t, ctx, memory.Connect(), ring, logKeys)
+
+	if err := alice.state.CommandSpawn([]string{"spawn", "asia", "infantry"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.state.CommandSpawn([]string{"spawn", "europe", "artillery"}); err != nil {
+		t.Fatal(err)
+	}
+
+	move, err := alice.state.CommandMove([]string{"move", "europe", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pubsub.PublishJSON(alice.sender, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".alice", move); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case d := <-logs:
+		if d.Body.Username != "alice" || d.Meta.Signer != "alice" {
+			t.Errorf("log from %q signed by %q, want alice", d.Body.Username, d.Meta.Signer)
+		}
+		if want := "bob won a war against alice"; d.Body.Message != want {
+			t.Errorf("log message %q, want %q", d.Body.Message, want)
+		}
+		if d.Meta.RoutingKey != routing.GameLogSlug+".alice" {
+			t.Errorf("log routed with %q", d.Meta.RoutingKey)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no game log after the war")
+	}
+
+	// The war is fought once, however many players saw it.
+	select {
+	case d := <-logs:
+		t.Errorf("unexpected second log %q", d.Body.Message)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if units := alice.state.GetPlayerSnap().Units; len(units) != 0 {
+		t.Errorf("alice still has %d units after losing", len(units))
+	}
+}
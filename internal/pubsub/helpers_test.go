@@ -0,0 +1,101 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testExchange is the topic exchange newTestBroker declares.
+const testExchange = "test"
+
+// newTestBroker returns a fresh in-memory broker with testExchange declared,
+// and a connection to it.
+func newTestBroker(t *testing.T) (*MemoryBroker, *MemoryConnection) {
+	t.Helper()
+
+	b := NewMemoryBroker()
+	conn := b.Connect()
+	t.Cleanup(func() { conn.Close() })
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if err := ch.ExchangeDeclare(testExchange, "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return b, conn
+}
+
+// testContext is cancelled when the test ends, which stops subscriptions
+// made with it.
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+// receive waits for the next value on ch.
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting")
+		var zero T
+		return zero
+	}
+}
+
+// nothing checks that ch stays quiet for a little while.
+func nothing[T any](t *testing.T, ch <-chan T) {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		t.Fatalf("unexpected %v", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// newBatchQueue declares a queue "batch" bound to testExchange with
+// "batch.ok" and returns a channel to read it with.
+func newBatchQueue(t *testing.T, conn *MemoryConnection) Channel {
+	t.Helper()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("batch", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("batch", "batch.ok", testExchange, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return ch
+}
+
+// queued drains the queue and returns the bodies in order.
+func queued(t *testing.T, ch Channel, queue string) []string {
+	t.Helper()
+
+	var bodies []string
+	for {
+		d, ok, err := ch.Get(queue, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return bodies
+		}
+		bodies = append(bodies, string(d.Body))
+	}
+}
@@ -0,0 +1,1448 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process stand-in for RabbitMQ. It emulates direct,
+// topic and fanout exchanges, the default exchange, durable, auto-delete and
+// exclusive queues, quorum queues with x-delivery-limit, stream queues read
+// from an x-stream-offset, message TTLs, length limits with every overflow
+// behaviour, priorities, per-consumer prefetch, ack/nack/requeue,
+// dead-lettering through x-dead-letter-exchange and blocking publishers
+// during a resource alarm. Like RabbitMQ, it closes a channel on a channel
+// error and the whole connection on a connection error. Each Connect call
+// returns a separate connection so that several clients can share one
+// broker.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	nextQueue int
+	conns     map[*MemoryConnection]struct{}
+	// unblocked is closed unless publishers are blocked.
+	unblocked chan struct{}
+}
+
+type MemoryConnection struct {
+	broker    *MemoryBroker
+	channels  map[*memChannel]struct{}
+	closes    []chan *amqp.Error
+	blockings []*blockingListener
+	closed    bool
+}
+
+type memExchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	args       amqp.Table
+	bindings   []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       amqp.Table
+	owner      *MemoryConnection
+	messages   []memMessage
+	consumers  []*memConsumer
+	next       int
+	// Streams keep every message; offset is the offset of messages[0].
+	offset int64
+}
+
+type memMessage struct {
+	exchange    string
+	key         string
+	msg         amqp.Publishing
+	redelivered bool
+	expires     time.Time
+	deliveries  int
+	published   time.Time
+}
+
+type memChannel struct {
+	conn      *MemoryConnection
+	prefetch  int
+	nextTag   uint64
+	nextCTag  int
+	unacked   map[uint64]*memUnacked
+	consumers map[string]*memConsumer
+	confirm   bool
+	published uint64
+	events    *eventQueue
+	closes    []chan *amqp.Error
+	publishes []chan amqp.Confirmation
+	returns   []chan amqp.Return
+	closed    bool
+}
+
+// eventQueue runs notifications in order on their own goroutine so that
+// listeners are never sent to while a lock is held or by whoever raised the
+// event. On a memChannel it also makes a return always reach its listener
+// before the matching confirmation.
+type eventQueue struct {
+	mu    sync.Mutex
+	queue []func()
+	wake  chan struct{}
+}
+
+type memUnacked struct {
+	queue    *memQueue
+	consumer *memConsumer
+	m        memMessage
+}
+
+type memConsumer struct {
+	tag      string
+	ch       *memChannel
+	queue    *memQueue
+	autoAck  bool
+	prefetch int
+	inflight int
+	// cursor is the next stream offset to deliver.
+	cursor int64
+
+	mu   sync.Mutex
+	buf  []amqp.Delivery
+	wake chan struct{}
+	done chan struct{}
+	out  chan amqp.Delivery
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	unblocked := make(chan struct{})
+	close(unblocked)
+
+	return &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		conns:     map[*MemoryConnection]struct{}{},
+		unblocked: unblocked,
+	}
+}
+
+func (b *MemoryBroker) Connect() *MemoryConnection {
+	c := &MemoryConnection{
+		broker:   b,
+		channels: map[*memChannel]struct{}{},
+	}
+
+	b.mu.Lock()
+	b.conns[c] = struct{}{}
+	b.mu.Unlock()
+
+	return c
+}
+
+// Block raises a resource alarm: every connection is told it is blocked
+// and publishes wait until Unblock.
+func (b *MemoryBroker) Block(reason string) {
+	b.mu.Lock()
+	if b.blocked() {
+		b.mu.Unlock()
+		return
+	}
+	b.unblocked = make(chan struct{})
+	for _, l := range b.blockings() {
+		l.send(amqp.Blocking{Active: true, Reason: reason})
+	}
+	b.mu.Unlock()
+}
+
+// Unblock clears the alarm raised by Block.
+func (b *MemoryBroker) Unblock() {
+	b.mu.Lock()
+	if !b.blocked() {
+		b.mu.Unlock()
+		return
+	}
+	close(b.unblocked)
+	for _, l := range b.blockings() {
+		l.send(amqp.Blocking{Active: false})
+	}
+	b.mu.Unlock()
+}
+
+// blocked reports whether publishers are blocked. The broker lock must be
+// held.
+func (b *MemoryBroker) blocked() bool {
+	select {
+	case <-b.unblocked:
+		return false
+	default:
+		return true
+	}
+}
+
+// blockings lists every connection's NotifyBlocked listener. The broker
+// lock must be held.
+func (b *MemoryBroker) blockings() []*blockingListener {
+	var listeners []*blockingListener
+	for c := range b.conns {
+		listeners = append(listeners, c.blockings...)
+	}
+
+	return listeners
+}
+
+func (c *MemoryConnection) Channel() (Channel, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	ch := &memChannel{
+		conn:      c,
+		unacked:   map[uint64]*memUnacked{},
+		consumers: map[string]*memConsumer{},
+		events:    newEventQueue(),
+	}
+	c.channels[ch] = struct{}{}
+
+	return ch, nil
+}
+
+func (c *MemoryConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.closes = append(c.closes, receiver)
+
+	return receiver
+}
+
+func (c *MemoryConnection) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.blockings = append(c.blockings, newBlockingListener(receiver))
+
+	return receiver
+}
+
+func (c *MemoryConnection) Close() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	b.closeConnection(c, nil)
+
+	return nil
+}
+
+// Shutdown closes the connection as if the broker had dropped it, delivering
+// reason to every NotifyClose listener on the connection and its channels.
+func (c *MemoryConnection) Shutdown(reason string) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	b.closeConnection(c, &amqp.Error{Code: amqp.ConnectionForced, Reason: reason, Server: true})
+}
+
+func (ch *memChannel) broker() *MemoryBroker {
+	return ch.conn.broker
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout:
+	default:
+		return ch.fail(&amqp.Error{Code: amqp.CommandInvalid, Reason: fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind)})
+	}
+
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable || ex.autoDelete != autoDelete || ex.internal != internal || !equalArgs(ex.args, args) {
+			return ch.fail(&amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for exchange '%s'", name)})
+		}
+		return nil
+	}
+
+	b.exchanges[name] = &memExchange{
+		name:       name,
+		kind:       kind,
+		durable:    durable,
+		autoDelete: autoDelete,
+		internal:   internal,
+		args:       args,
+	}
+
+	return nil
+}
+
+// ExchangeDeclarePassive fails with NOT_FOUND if the exchange doesn't exist.
+// Like RabbitMQ, it doesn't compare kinds, flags or arguments.
+func (ch *memChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if _, ok := b.exchanges[name]; !ok {
+		return ch.fail(notFound("exchange", name))
+	}
+
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	if name == "" {
+		b.nextQueue++
+		name = fmt.Sprintf("amq.gen-%d", b.nextQueue)
+	}
+
+	if q, ok := b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, ch.fail(&amqp.Error{Code: amqp.ResourceLocked, Reason: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)})
+		}
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive || !equalArgs(q.args, args) {
+			return amqp.Queue{}, ch.fail(&amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for queue '%s'", name)})
+		}
+		return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+	}
+
+	kind, _ := args["x-queue-type"].(string)
+	if kind == "quorum" || kind == "stream" {
+		if !durable || autoDelete || exclusive {
+			return amqp.Queue{}, ch.fail(&amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - %s queue '%s' must be durable, not exclusive and not auto-delete", kind, name)})
+		}
+	}
+
+	q := &memQueue{
+		name:       name,
+		kind:       kind,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+
+	return amqp.Queue{Name: name}, nil
+}
+
+// QueueDeclarePassive fails with NOT_FOUND if the queue doesn't exist, and
+// reports its depth if it does. Like RabbitMQ, it doesn't compare flags or
+// arguments.
+func (ch *memChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.fail(notFound("queue", name))
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return amqp.Queue{}, ch.fail(&amqp.Error{Code: amqp.ResourceLocked, Reason: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)})
+	}
+
+	return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if _, ok := b.queues[name]; !ok {
+		return ch.fail(notFound("queue", name))
+	}
+
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return ch.fail(notFound("exchange", exchange))
+	}
+
+	for _, binding := range ex.bindings {
+		if binding.queue == name && binding.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: name, key: key})
+
+	return nil
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ch.prefetch = prefetchCount
+
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, ch.fail(notFound("queue", queue))
+	}
+
+	if consumer == "" {
+		ch.nextCTag++
+		consumer = fmt.Sprintf("ctag-%p-%d", ch, ch.nextCTag)
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, ch.fail(&amqp.Error{Code: amqp.NotAllowed, Reason: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer)})
+	}
+
+	var cursor int64
+	if q.kind == "stream" {
+		if autoAck || ch.prefetch == 0 {
+			return nil, ch.fail(&amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - stream consumers need manual acks and a prefetch count"})
+		}
+		var err error
+		if cursor, err = q.streamCursor(args["x-stream-offset"]); err != nil {
+			return nil, ch.fail(err)
+		}
+	}
+
+	c := &memConsumer{
+		tag:      consumer,
+		ch:       ch,
+		queue:    q,
+		autoAck:  autoAck,
+		prefetch: ch.prefetch,
+		cursor:   cursor,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		out:      make(chan amqp.Delivery),
+	}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+
+	go c.pump()
+	b.dispatch(q)
+
+	return c.out, nil
+}
+
+func (ch *memChannel) QueuePurge(name string, noWait bool) (int, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, ch.fail(notFound("queue", name))
+	}
+	if q.kind == "stream" {
+		return 0, ch.fail(streamNotAllowed("purge", name))
+	}
+	purged := len(q.messages)
+	q.messages = nil
+
+	return purged, nil
+}
+
+func (ch *memChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, ch.fail(notFound("queue", queue))
+	}
+	if q.kind == "stream" {
+		return amqp.Delivery{}, false, ch.fail(streamNotAllowed("basic.get", queue))
+	}
+	b.expire(q)
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+
+	ch.nextTag++
+	tag := ch.nextTag
+	if !autoAck {
+		ch.unacked[tag] = &memUnacked{queue: q, m: m}
+	}
+
+	d := newMemDelivery(ch, m, "", tag)
+	d.MessageCount = uint32(len(q.messages))
+
+	return d, true, nil
+}
+
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	c, ok := ch.consumers[consumer]
+	if !ok {
+		return nil
+	}
+	b.cancelConsumer(c)
+
+	return nil
+}
+
+func (ch *memChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Like RabbitMQ, a blocked broker stops reading publishes until the
+	// alarm clears.
+	for b.blocked() {
+		unblocked := b.unblocked
+		b.mu.Unlock()
+		select {
+		case <-unblocked:
+		case <-ctx.Done():
+			b.mu.Lock()
+			return ctx.Err()
+		}
+		b.mu.Lock()
+	}
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	// Publishes aren't answered, so like RabbitMQ the broker only reports a
+	// missing exchange by closing the channel.
+	if exchange != "" {
+		if _, ok := b.exchanges[exchange]; !ok {
+			ch.fail(notFound("exchange", exchange))
+			return nil
+		}
+	}
+
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	routed, rejected := b.publish(exchange, key, msg)
+
+	if mandatory && routed == 0 {
+		returned := amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		}
+		returns := append([]chan amqp.Return{}, ch.returns...)
+		ch.events.post(func() {
+			for _, r := range returns {
+				r <- returned
+			}
+		})
+	}
+
+	if ch.confirm {
+		ch.published++
+		confirmation := amqp.Confirmation{DeliveryTag: ch.published, Ack: !rejected}
+		publishes := append([]chan amqp.Confirmation{}, ch.publishes...)
+		ch.events.post(func() {
+			for _, p := range publishes {
+				p <- confirmation
+			}
+		})
+	}
+
+	return nil
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirm = true
+
+	return nil
+}
+
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+	ch.publishes = append(ch.publishes, confirm)
+
+	return confirm
+}
+
+func (ch *memChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(returns)
+		return returns
+	}
+	ch.returns = append(ch.returns, returns)
+
+	return returns
+}
+
+func (ch *memChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(receiver)
+		return receiver
+	}
+	ch.closes = append(ch.closes, receiver)
+
+	return receiver
+}
+
+func (ch *memChannel) Close() error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	b.closeChannel(ch, nil)
+
+	return nil
+}
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return ch.settle(tag, multiple, func(u *memUnacked) {})
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple, requeue bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return ch.settle(tag, multiple, func(u *memUnacked) {
+		if u.queue.kind == "stream" {
+			return
+		}
+		if requeue {
+			b.requeue(u.queue, u.m)
+			return
+		}
+		b.deadLetter(u.queue, u.m, "rejected")
+	})
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// settle removes the given delivery tag (and, with multiple, every earlier
+// one) from the unacked set, applies fn to each and redispatches the queues
+// whose consumers gained capacity. The broker lock must be held.
+func (ch *memChannel) settle(tag uint64, multiple bool, fn func(*memUnacked)) error {
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	tags := []uint64{}
+	if multiple {
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = append(tags, tag)
+	}
+
+	// Acks aren't answered either.
+	if len(tags) == 0 {
+		ch.fail(&amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag)})
+		return nil
+	}
+
+	touched := map[*memQueue]struct{}{}
+	for _, t := range tags {
+		u := ch.unacked[t]
+		delete(ch.unacked, t)
+		if u.consumer != nil {
+			u.consumer.inflight--
+		}
+		fn(u)
+		touched[u.queue] = struct{}{}
+	}
+
+	b := ch.broker()
+	for q := range touched {
+		b.dispatch(q)
+	}
+
+	return nil
+}
+
+// publish routes msg to every matching queue and reports whether a full
+// queue turned it away. The broker lock must be held.
+func (b *MemoryBroker) publish(exchange, key string, msg amqp.Publishing) (int, bool) {
+	rejected := false
+	queues := b.route(exchange, key)
+	for _, q := range queues {
+		m := memMessage{
+			exchange:  exchange,
+			key:       key,
+			msg:       copyPublishing(msg),
+			published: time.Now(),
+		}
+		if ttl, ok := messageTTL(q, msg); ok && q.kind != "stream" {
+			m.expires = time.Now().Add(ttl)
+			b.scheduleExpiry(q, ttl)
+		}
+		if !b.admit(q, m) {
+			rejected = true
+			continue
+		}
+		q.enqueue(m)
+		b.trim(q)
+		b.dispatch(q)
+	}
+
+	return len(queues), rejected
+}
+
+// admit applies the reject-publish overflow behaviours of a full queue. The
+// broker lock must be held.
+func (b *MemoryBroker) admit(q *memQueue, m memMessage) bool {
+	if q.kind == "stream" || !q.over(1, len(m.msg.Body)) {
+		return true
+	}
+
+	switch q.args["x-overflow"] {
+	case "reject-publish":
+		return false
+	case "reject-publish-dlx":
+		b.deadLetter(q, m, "maxlen")
+		return false
+	}
+
+	return true
+}
+
+// trim drops messages from the head of a queue that is over its length
+// limits, the default drop-head overflow behaviour. The broker lock must be
+// held.
+func (b *MemoryBroker) trim(q *memQueue) {
+	for q.kind != "stream" && len(q.messages) > 0 && q.over(0, 0) {
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+		b.deadLetter(q, m, "maxlen")
+	}
+}
+
+// over reports whether q would break x-max-length or x-max-length-bytes
+// with extra more messages of extraBytes more body bytes.
+func (q *memQueue) over(extra, extraBytes int) bool {
+	if limit, ok := argInt(q.args, "x-max-length"); ok && int64(len(q.messages)+extra) > limit {
+		return true
+	}
+
+	if limit, ok := argInt(q.args, "x-max-length-bytes"); ok {
+		size := extraBytes
+		for _, m := range q.messages {
+			size += len(m.msg.Body)
+		}
+		return int64(size) > limit
+	}
+
+	return false
+}
+
+// enqueue adds m behind every ready message of the same or higher priority.
+// Queues without x-max-priority ignore priorities.
+func (q *memQueue) enqueue(m memMessage) {
+	maxPriority, ok := argInt(q.args, "x-max-priority")
+	if !ok || q.kind == "stream" {
+		q.messages = append(q.messages, m)
+		return
+	}
+
+	priority := min(int64(m.msg.Priority), maxPriority)
+	i := len(q.messages)
+	for i > 0 && min(int64(q.messages[i-1].msg.Priority), maxPriority) < priority {
+		i--
+	}
+	q.messages = append(q.messages[:i], append([]memMessage{m}, q.messages[i:]...)...)
+}
+
+func (b *MemoryBroker) route(exchange, key string) []*memQueue {
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			return []*memQueue{q}
+		}
+		return nil
+	}
+
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return nil
+	}
+
+	seen := map[string]struct{}{}
+	queues := []*memQueue{}
+	for _, binding := range ex.bindings {
+		if _, ok := seen[binding.queue]; ok {
+			continue
+		}
+
+		matched := false
+		switch ex.kind {
+		case amqp.ExchangeDirect:
+			matched = binding.key == key
+		case amqp.ExchangeTopic:
+			matched = topicMatch(binding.key, key)
+		case amqp.ExchangeFanout:
+			matched = true
+		}
+
+		if q, ok := b.queues[binding.queue]; matched && ok {
+			seen[binding.queue] = struct{}{}
+			queues = append(queues, q)
+		}
+	}
+
+	return queues
+}
+
+// requeue puts m back at the head of q. A quorum queue dead-letters it
+// instead once it has been delivered more than x-delivery-limit times, and a
+// stream never takes messages back.
+func (b *MemoryBroker) requeue(q *memQueue, m memMessage) {
+	if _, ok := b.queues[q.name]; !ok || q.kind == "stream" {
+		return
+	}
+	m.redelivered = true
+	if q.kind == "quorum" {
+		m.deliveries++
+		if limit, ok := argInt(q.args, "x-delivery-limit"); ok && int64(m.deliveries) > limit {
+			b.deadLetter(q, m, "delivery_limit")
+			return
+		}
+	}
+	q.messages = append([]memMessage{m}, q.messages...)
+}
+
+// deadLetter republishes m to the queue's dead-letter exchange, recording
+// why in the x-death header the same way RabbitMQ does.
+func (b *MemoryBroker) deadLetter(q *memQueue, m memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+
+	key := m.key
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+
+	msg := copyPublishing(m.msg)
+	msg.Expiration = ""
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+
+	death := amqp.Table{
+		"count":        int64(1),
+		"reason":       reason,
+		"queue":        q.name,
+		"exchange":     m.exchange,
+		"routing-keys": []interface{}{m.key},
+		"time":         time.Now(),
+	}
+	deaths, _ := msg.Headers["x-death"].([]interface{})
+	for i, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && t["queue"] == q.name && t["reason"] == reason {
+			count, _ := t["count"].(int64)
+			death["count"] = count + 1
+			deaths = append(deaths[:i:i], deaths[i+1:]...)
+			break
+		}
+	}
+	msg.Headers["x-death"] = append([]interface{}{death}, deaths...)
+
+	if _, ok := msg.Headers["x-first-death-queue"]; !ok {
+		msg.Headers["x-first-death-queue"] = q.name
+		msg.Headers["x-first-death-reason"] = reason
+		msg.Headers["x-first-death-exchange"] = m.exchange
+	}
+
+	b.publish(dlx, key, msg)
+}
+
+// dispatch hands ready messages to consumers round-robin, respecting each
+// consumer's prefetch. The broker lock must be held.
+func (b *MemoryBroker) dispatch(q *memQueue) {
+	if q.kind == "stream" {
+		b.dispatchStream(q)
+		return
+	}
+	b.expire(q)
+
+	for len(q.messages) > 0 && len(q.consumers) > 0 {
+		var c *memConsumer
+		for i := 0; i < len(q.consumers); i++ {
+			candidate := q.consumers[(q.next+i)%len(q.consumers)]
+			if candidate.prefetch == 0 || candidate.inflight < candidate.prefetch {
+				c = candidate
+				q.next = (q.next + i + 1) % len(q.consumers)
+				break
+			}
+		}
+		if c == nil {
+			return
+		}
+
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+		if !m.expires.IsZero() && !time.Now().Before(m.expires) {
+			b.deadLetter(q, m, "expired")
+			continue
+		}
+
+		ch := c.ch
+		ch.nextTag++
+		tag := ch.nextTag
+		if !c.autoAck {
+			ch.unacked[tag] = &memUnacked{queue: q, consumer: c, m: m}
+			c.inflight++
+		}
+
+		c.push(newMemDelivery(ch, m, c.tag, tag))
+	}
+}
+
+// dispatchStream delivers to each stream consumer from its own cursor up to
+// its prefetch. The broker lock must be held.
+func (b *MemoryBroker) dispatchStream(q *memQueue) {
+	for _, c := range q.consumers {
+		for c.inflight < c.prefetch && c.cursor < q.offset+int64(len(q.messages)) {
+			m := q.messages[c.cursor-q.offset]
+			m.msg = copyPublishing(m.msg)
+			if m.msg.Headers == nil {
+				m.msg.Headers = amqp.Table{}
+			}
+			m.msg.Headers["x-stream-offset"] = c.cursor
+			c.cursor++
+
+			ch := c.ch
+			ch.nextTag++
+			ch.unacked[ch.nextTag] = &memUnacked{queue: q, consumer: c, m: m}
+			c.inflight++
+
+			c.push(newMemDelivery(ch, m, c.tag, ch.nextTag))
+		}
+	}
+}
+
+// streamCursor turns an x-stream-offset argument into the offset a new
+// consumer starts at: "first", "last", "next" (the default), an offset, or
+// a timestamp.
+func (q *memQueue) streamCursor(arg any) (int64, error) {
+	end := q.offset + int64(len(q.messages))
+
+	switch v := arg.(type) {
+	case nil:
+		return end, nil
+	case string:
+		switch v {
+		case "first":
+			return q.offset, nil
+		case "last":
+			return max(end-1, q.offset), nil
+		case "next":
+			return end, nil
+		}
+	case time.Time:
+		for i, m := range q.messages {
+			if !m.published.Before(v) {
+				return q.offset + int64(i), nil
+			}
+		}
+		return end, nil
+	default:
+		if n, ok := argInt(amqp.Table{"n": arg}, "n"); ok {
+			return min(max(n, q.offset), end), nil
+		}
+	}
+
+	return 0, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - invalid x-stream-offset %v", arg)}
+}
+
+func newMemDelivery(ch *memChannel, m memMessage, consumerTag string, tag uint64) amqp.Delivery {
+	if m.deliveries > 0 {
+		m.msg = copyPublishing(m.msg)
+		if m.msg.Headers == nil {
+			m.msg.Headers = amqp.Table{}
+		}
+		m.msg.Headers["x-delivery-count"] = int64(m.deliveries)
+	}
+
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         m.msg.Headers,
+		ContentType:     m.msg.ContentType,
+		ContentEncoding: m.msg.ContentEncoding,
+		DeliveryMode:    m.msg.DeliveryMode,
+		Priority:        m.msg.Priority,
+		CorrelationId:   m.msg.CorrelationId,
+		ReplyTo:         m.msg.ReplyTo,
+		Expiration:      m.msg.Expiration,
+		MessageId:       m.msg.MessageId,
+		Timestamp:       m.msg.Timestamp,
+		Type:            m.msg.Type,
+		UserId:          m.msg.UserId,
+		AppId:           m.msg.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            m.msg.Body,
+	}
+}
+
+// expire dead-letters messages at the head of q whose TTL has passed. Like
+// RabbitMQ, only the head is checked. The broker lock must be held.
+func (b *MemoryBroker) expire(q *memQueue) {
+	now := time.Now()
+	for len(q.messages) > 0 {
+		m := q.messages[0]
+		if m.expires.IsZero() || now.Before(m.expires) {
+			return
+		}
+		q.messages = q.messages[1:]
+		b.deadLetter(q, m, "expired")
+	}
+}
+
+func (b *MemoryBroker) scheduleExpiry(q *memQueue, ttl time.Duration) {
+	time.AfterFunc(ttl, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if b.queues[q.name] == q {
+			b.dispatch(q)
+		}
+	})
+}
+
+// messageTTL combines the queue's x-message-ttl with the message's own
+// Expiration, picking whichever is shorter.
+func messageTTL(q *memQueue, msg amqp.Publishing) (time.Duration, bool) {
+	ttl, ok := argInt(q.args, "x-message-ttl")
+	if ms, err := strconv.ParseInt(msg.Expiration, 10, 64); err == nil && (!ok || ms < ttl) {
+		ttl, ok = ms, true
+	}
+
+	return time.Duration(ttl) * time.Millisecond, ok
+}
+
+func argInt(args amqp.Table, key string) (int64, bool) {
+	switch v := args[key].(type) {
+	case int:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+func (b *MemoryBroker) cancelConsumer(c *memConsumer) {
+	ch := c.ch
+	q := c.queue
+	delete(ch.consumers, c.tag)
+
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if q.next >= len(q.consumers) {
+		q.next = 0
+	}
+	close(c.done)
+
+	if q.autoDelete && len(q.consumers) == 0 {
+		b.deleteQueue(q.name)
+	}
+}
+
+func (b *MemoryBroker) closeConnection(c *MemoryConnection, err *amqp.Error) {
+	for ch := range c.channels {
+		b.closeChannel(ch, err)
+	}
+	c.closed = true
+	notifyClosed(c.closes, err)
+	for _, l := range c.blockings {
+		l.close()
+	}
+	c.blockings = nil
+	delete(b.conns, c)
+
+	for name, q := range b.queues {
+		if q.exclusive && q.owner == c {
+			b.deleteQueue(name)
+		}
+	}
+}
+
+func (b *MemoryBroker) closeChannel(ch *memChannel, err *amqp.Error) {
+	for _, c := range ch.consumers {
+		b.cancelConsumer(c)
+	}
+
+	tags := make([]uint64, 0, len(ch.unacked))
+	for t := range ch.unacked {
+		tags = append(tags, t)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+
+	touched := map[*memQueue]struct{}{}
+	for _, t := range tags {
+		u := ch.unacked[t]
+		b.requeue(u.queue, u.m)
+		touched[u.queue] = struct{}{}
+	}
+	ch.unacked = map[uint64]*memUnacked{}
+	ch.closed = true
+	delete(ch.conn.channels, ch)
+
+	closes, publishes, returns := ch.closes, ch.publishes, ch.returns
+	ch.events.post(func() {
+		notifyClosed(closes, err)
+		for _, p := range publishes {
+			close(p)
+		}
+		for _, r := range returns {
+			close(r)
+		}
+	})
+	ch.events.post(nil)
+
+	for q := range touched {
+		b.dispatch(q)
+	}
+}
+
+// fail closes the channel with err, or its whole connection if err is a
+// connection error, and returns err. The broker lock must be held.
+func (ch *memChannel) fail(err error) error {
+	e := err.(*amqp.Error)
+	e.Server = true
+	e.Recover = e.Code != amqp.CommandInvalid
+	if e.Recover {
+		ch.broker().closeChannel(ch, e)
+	} else {
+		ch.broker().closeConnection(ch.conn, e)
+	}
+
+	return err
+}
+
+func (b *MemoryBroker) deleteQueue(name string) {
+	q, ok := b.queues[name]
+	if !ok {
+		return
+	}
+	delete(b.queues, name)
+
+	for _, c := range append([]*memConsumer{}, q.consumers...) {
+		delete(c.ch.consumers, c.tag)
+		close(c.done)
+	}
+	q.consumers = nil
+
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if binding.queue != name {
+				bindings = append(bindings, binding)
+			}
+		}
+		ex.bindings = bindings
+	}
+}
+
+func notifyClosed(receivers []chan *amqp.Error, err *amqp.Error) {
+	for _, receiver := range receivers {
+		if err != nil {
+			select {
+			case receiver <- err:
+			default:
+			}
+		}
+		close(receiver)
+	}
+}
+
+func newEventQueue() *eventQueue {
+	e := &eventQueue{wake: make(chan struct{}, 1)}
+	go e.run()
+
+	return e
+}
+
+// post queues fn behind every earlier event. A nil fn stops the goroutine
+// once everything before it has run.
+func (e *eventQueue) post(fn func()) {
+	e.mu.Lock()
+	e.queue = append(e.queue, fn)
+	e.mu.Unlock()
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *eventQueue) run() {
+	for {
+		e.mu.Lock()
+		if len(e.queue) == 0 {
+			e.mu.Unlock()
+			<-e.wake
+			continue
+		}
+		fn := e.queue[0]
+		e.queue = e.queue[1:]
+		e.mu.Unlock()
+
+		if fn == nil {
+			return
+		}
+		fn()
+	}
+}
+
+func (c *memConsumer) push(d amqp.Delivery) {
+	c.mu.Lock()
+	c.buf = append(c.buf, d)
+	c.mu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pump forwards buffered deliveries to the consumer without holding the
+// broker lock, so a slow handler never blocks publishers or acks.
+func (c *memConsumer) pump() {
+	defer close(c.out)
+
+	for {
+		c.mu.Lock()
+		if len(c.buf) == 0 {
+			c.mu.Unlock()
+			select {
+			case <-c.wake:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+		d := c.buf[0]
+		c.buf = c.buf[1:]
+		c.mu.Unlock()
+
+		select {
+		case c.out <- d:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// topicMatch reports whether a routing key matches a topic binding pattern,
+// where "*" matches exactly one word and "#" matches zero or more.
+func topicMatch(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+func equalArgs(a, b amqp.Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		other, ok := b[k]
+		if !ok || fmt.Sprint(v) != fmt.Sprint(other) {
+			return false
+		}
+	}
+	return true
+}
+
+func copyPublishing(msg amqp.Publishing) amqp.Publishing {
+	if msg.Headers != nil {
+		headers := amqp.Table{}
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		msg.Headers = headers
+	}
+	return msg
+}
+
+func streamNotAllowed(op, name string) error {
+	return &amqp.Error{Code: amqp.NotAllowed, Reason: fmt.Sprintf("NOT_ALLOWED - %s is not supported by stream queue '%s'", op, name)}
+}
+
+func notFound(kind, name string) error {
+	return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no %s '%s'", kind, name)}
+}
@@ -0,0 +1,214 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newTestChannel(t *testing.T, conn *MemoryConnection) Channel {
+	t.Helper()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ch.Close() })
+
+	return ch
+}
+
+func TestMemoryTopicWildcards(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+
+	bindings := map[string]string{
+		"star": "army_moves.*",
+		"hash": "war.#",
+		"all":  "#",
+		"mid":  "game.*.over",
+	}
+	for queue, key := range bindings {
+		ch.QueueDeclare(queue, false, false, false, false, nil)
+		if err := ch.QueueBind(queue, key, testExchange, false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, key := range []string{"army_moves.alice", "army_moves.alice.extra", "war", "war.alice.bob", "game.1.over", "game.over"} {
+		if err := ch.PublishWithContext(context.Background(), testExchange, key, false, false, amqp.Publishing{Body: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string][]string{
+		"star": {"army_moves.alice"},
+		"hash": {"war", "war.alice.bob"},
+		"all":  {"army_moves.alice", "army_moves.alice.extra", "war", "war.alice.bob", "game.1.over", "game.over"},
+		"mid":  {"game.1.over"},
+	}
+	for queue, keys := range want {
+		got := queued(t, ch, queue)
+		if len(got) != len(keys) {
+			t.Errorf("%s holds %v, want %v", queue, got, keys)
+			continue
+		}
+		for i := range keys {
+			if got[i] != keys[i] {
+				t.Errorf("%s holds %v, want %v", queue, got, keys)
+				break
+			}
+		}
+	}
+}
+
+func TestMemoryPrefetch(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	for i := 0; i < 3; i++ {
+		ch.PublishWithContext(context.Background(), testExchange, "batch.ok", false, false, amqp.Publishing{})
+	}
+
+	consumer := newTestChannel(t, conn)
+	consumer.Qos(2, 0, false)
+	deliveries, err := consumer.Consume("batch", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, deliveries)
+	receive(t, deliveries)
+	nothing(t, deliveries)
+
+	first.Ack(false)
+	receive(t, deliveries)
+}
+
+func TestMemoryNackRequeue(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	ch.PublishWithContext(context.Background(), testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte("again")})
+
+	d, ok, _ := ch.Get("batch", false)
+	if !ok || d.Redelivered {
+		t.Fatalf("first get: %v, redelivered %v", ok, d.Redelivered)
+	}
+	if err := d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	d, ok, _ = ch.Get("batch", false)
+	if !ok || !d.Redelivered || string(d.Body) != "again" {
+		t.Fatalf("after requeue: %v, redelivered %v, %q", ok, d.Redelivered, d.Body)
+	}
+	d.Nack(false, false)
+	if got := queued(t, ch, "batch"); len(got) != 0 {
+		t.Errorf("discarded message still queued: %v", got)
+	}
+}
+
+func TestMemoryDeadLetter(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+
+	ch.ExchangeDeclare("dlx", "fanout", true, false, false, false, nil)
+	ch.QueueDeclare("dlq", true, false, false, false, nil)
+	ch.QueueBind("dlq", "", "dlx", false, nil)
+	ch.QueueDeclare("work", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "dlx"})
+	ch.QueueBind("work", "work.*", testExchange, false, nil)
+
+	ch.PublishWithContext(context.Background(), testExchange, "work.rejected", false, false, amqp.Publishing{Body: []byte("rejected")})
+	ch.PublishWithContext(context.Background(), testExchange, "work.expired", false, false, amqp.Publishing{Body: []byte("expired"), Expiration: "0"})
+
+	d, ok, _ := ch.Get("work", false)
+	if !ok || string(d.Body) != "rejected" {
+		t.Fatalf("got %q", d.Body)
+	}
+	d.Nack(false, false)
+
+	for _, want := range []struct{ body, reason string }{{"rejected", "rejected"}, {"expired", "expired"}} {
+		dead, ok, _ := ch.Get("dlq", true)
+		if !ok {
+			t.Fatalf("%s wasn't dead-lettered", want.body)
+		}
+		deaths, _ := dead.Headers["x-death"].([]interface{})
+		if len(deaths) == 0 {
+			t.Fatalf("%s has no x-death", want.body)
+		}
+		death := deaths[0].(amqp.Table)
+		if string(dead.Body) != want.body || death["reason"] != want.reason || death["queue"] != "work" {
+			t.Errorf("dead-lettered %q with %v", dead.Body, death)
+		}
+	}
+}
+
+func TestMemoryChannelErrors(t *testing.T) {
+	_, conn := newTestBroker(t)
+
+	closes := func(ch Channel) chan *amqp.Error {
+		return ch.NotifyClose(make(chan *amqp.Error, 1))
+	}
+	wantClosed := func(t *testing.T, ch Channel, closed chan *amqp.Error, code int) {
+		t.Helper()
+		if err := receive(t, closed); err == nil || err.Code != code {
+			t.Errorf("closed with %v, want code %d", err, code)
+		}
+		if _, err := ch.QueueDeclare("", false, true, true, false, nil); !errors.Is(err, amqp.ErrClosed) {
+			t.Errorf("channel still usable: %v", err)
+		}
+	}
+
+	t.Run("missing queue", func(t *testing.T) {
+		ch := newTestChannel(t, conn)
+		closed := closes(ch)
+		if _, err := ch.QueueDeclarePassive("nowhere", false, false, false, false, nil); err == nil {
+			t.Fatal("declared a missing queue")
+		}
+		wantClosed(t, ch, closed, amqp.NotFound)
+	})
+
+	t.Run("inequivalent queue", func(t *testing.T) {
+		ch := newTestChannel(t, conn)
+		ch.QueueDeclare("classic", true, false, false, false, nil)
+		closed := closes(ch)
+		if _, err := ch.QueueDeclare("classic", true, false, false, false, amqp.Table{"x-queue-type": "quorum"}); err == nil {
+			t.Fatal("redeclared with other arguments")
+		}
+		wantClosed(t, ch, closed, amqp.PreconditionFailed)
+	})
+
+	t.Run("missing exchange", func(t *testing.T) {
+		ch := newTestChannel(t, conn)
+		closed := closes(ch)
+		if err := ch.PublishWithContext(context.Background(), "nowhere", "", false, false, amqp.Publishing{}); err != nil {
+			t.Fatalf("publish returned %v; the broker only closes the channel", err)
+		}
+		wantClosed(t, ch, closed, amqp.NotFound)
+	})
+
+	t.Run("unknown delivery tag", func(t *testing.T) {
+		ch := newTestChannel(t, conn)
+		closed := closes(ch)
+		if err := ch.(amqp.Acknowledger).Ack(42, false); err != nil {
+			t.Fatalf("ack returned %v; the broker only closes the channel", err)
+		}
+		wantClosed(t, ch, closed, amqp.PreconditionFailed)
+	})
+
+	t.Run("unknown exchange type", func(t *testing.T) {
+		other := NewMemoryBroker().Connect()
+		connClosed := other.NotifyClose(make(chan *amqp.Error, 1))
+		ch, _ := other.Channel()
+		if err := ch.ExchangeDeclare("odd", "headers-ish", false, false, false, false, nil); err == nil {
+			t.Fatal("declared an unknown exchange type")
+		}
+		if err := receive(t, connClosed); err == nil || err.Code != amqp.CommandInvalid {
+			t.Errorf("connection closed with %v", err)
+		}
+		if _, err := other.Channel(); !errors.Is(err, amqp.ErrClosed) {
+			t.Errorf("connection still usable: %v", err)
+		}
+	})
+}
@@ -0,0 +1,33 @@
+package pubsub
+
+import (
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/metrics"
+)
+
+var (
+	publishesTotal = metrics.NewCounter("pubsub_publishes_total",
+		"Messages published, by exchange and the first word of the routing key.", "exchange", "route")
+	publishErrorsTotal = metrics.NewCounter("pubsub_publish_errors_total",
+		"Publishes that failed, by exchange and the first word of the routing key.", "exchange", "route")
+	deliveriesTotal = metrics.NewCounter("pubsub_deliveries_total",
+		"Deliveries received, by queue.", "queue")
+	settledTotal = metrics.NewCounter("pubsub_settled_total",
+		"Deliveries settled by a handler, by queue and how they were settled.", "queue", "ack")
+	decodeFailuresTotal = metrics.NewCounter("pubsub_decode_failures_total",
+		"Deliveries that could not be decoded, by queue.", "queue")
+	duplicatesTotal = metrics.NewCounter("pubsub_duplicates_total",
+		"Deliveries suppressed as duplicates, by queue.", "queue")
+	forgeriesTotal = metrics.NewCounter("pubsub_rejected_signatures_total",
+		"Deliveries rejected as unsigned or forged, by queue.", "queue")
+	handlerSeconds = metrics.NewHistogram("pubsub_handler_duration_seconds",
+		"Time spent in handlers, by queue.", nil, "queue")
+)
+
+// routeLabel keeps the routing key's first word, so that per-player keys
+// such as "army_moves.alice" don't make a series per player.
+func routeLabel(key string) string {
+	route, _, _ := strings.Cut(key, ".")
+	return route
+}
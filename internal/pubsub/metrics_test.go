@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/metrics"
+)
+
+// exposed reads the value of series from what the default registry serves,
+// or 0 if it isn't there yet.
+func exposed(t *testing.T, series string) float64 {
+	t.Helper()
+
+	var b strings.Builder
+	if _, err := metrics.Default.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			return f
+		}
+	}
+
+	return 0
+}
+
+// TestSettledMetrics checks that deliveries are counted by queue and by how
+// their handler settled them.
+func TestSettledMetrics(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+
+	series := []string{
+		`pubsub_deliveries_total{queue="metered"}`,
+		`pubsub_settled_total{queue="metered",ack="ack"}`,
+		`pubsub_settled_total{queue="metered",ack="nack-discard"}`,
+		`pubsub_decode_failures_total{queue="metered"}`,
+		`pubsub_handler_duration_seconds_count{queue="metered"}`,
+		`pubsub_handler_duration_seconds_bucket{queue="metered",le="+Inf"}`,
+		`pubsub_publishes_total{exchange="test",route="metered"}`,
+	}
+	before := map[string]float64{}
+	for _, s := range series {
+		before[s] = exposed(t, s)
+	}
+
+	handled := make(chan AckType, 10)
+	decodeErrs := make(chan *DecodeError, 1)
+	_, err := Subscribe(testContext(t), conn, testExchange, "metered", "metered.*", Transient, func(ack AckType) AckType {
+		handled <- ack
+		return ack
+	},
+		WithDecodeErrorPolicy(DiscardOnDecodeError),
+		WithDecodeErrorHandler(func(de *DecodeError) { decodeErrs <- de }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ack := range []AckType{Ack, NackDiscard, Ack} {
+		if err := PublishJSON(ch, testExchange, "metered.alice", ack); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, handled)
+	}
+	if err := PublishJSON(ch, testExchange, "metered.alice", "not an ack"); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, decodeErrs)
+
+	for i, want := range []float64{4, 2, 1, 1, 3, 3, 4} {
+		if got := exposed(t, series[i]) - before[series[i]]; got != want {
+			t.Errorf("%s went up by %v, want %v", series[i], got, want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// Handler handles one decoded delivery.
+type Handler[T any] func(Delivery[T]) AckType
+
+// Middleware wraps a handler for one payload type.
+type Middleware[T any] func(next Handler[T]) Handler[T]
+
+// Interceptor is middleware that works for every payload type because it
+// only sees the envelope. ctx is the delivery's context (see
+// Delivery.Context). An interceptor must call next at most once, with ctx
+// or a context derived from it, and return what the delivery should be
+// settled with.
+type Interceptor func(ctx context.Context, meta Meta, next func(ctx context.Context) AckType) AckType
+
+// WithInterceptors wraps this subscription's handler in interceptors, the
+// first one outermost, outside of any typed middleware.
+func WithInterceptors(interceptors ...Interceptor) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.interceptors = append(c.interceptors, interceptors...)
+	}
+}
+
+// WithMiddleware wraps this subscription's handler in typed middleware, the
+// first one outermost. T must match the subscription's payload type.
+func WithMiddleware[T any](middleware ...Middleware[T]) SubscribeOption {
+	return func(c *subscribeConfig) {
+		for _, mw := range middleware {
+			c.middleware = append(c.middleware, mw)
+		}
+	}
+}
+
+// Intercept turns an interceptor into middleware for T.
+func Intercept[T any](interceptor Interceptor) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) AckType {
+			return interceptor(d.Context(), d.Meta, func(ctx context.Context) AckType {
+				d.ctx = ctx
+				return next(d)
+			})
+		}
+	}
+}
+
+// chain wraps handler in the subscription's interceptors, then its typed
+// middleware.
+func chain[T any](config subscribeConfig, handler Handler[T]) (Handler[T], error) {
+	for i := len(config.middleware) - 1; i >= 0; i-- {
+		mw, ok := config.middleware[i].(Middleware[T])
+		if !ok {
+			var zero T
+			return nil, fmt.Errorf("pubsub: middleware %d is %T, not for %T payloads", i, config.middleware[i], zero)
+		}
+		handler = mw(handler)
+	}
+
+	for i := len(config.interceptors) - 1; i >= 0; i-- {
+		handler = Intercept[T](config.interceptors[i])(handler)
+	}
+
+	return handler, nil
+}
+
+// Recover turns a panicking handler into a log line and settles the
+// delivery with ack instead of crashing the program.
+func Recover(ack AckType) Interceptor {
+	return func(ctx context.Context, meta Meta, next func(context.Context) AckType) (result AckType) {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("handler panicked",
+					"queue", meta.Queue,
+					"message_id", meta.MessageId,
+					"routing_key", meta.RoutingKey,
+					"panic", fmt.Sprint(r),
+					"stack", string(debug.Stack()))
+				result = ack
+			}
+		}()
+
+		return next(ctx)
+	}
+}
+
+// Logging logs every settled delivery to logger, or the default logger if
+// it is nil.
+func Logging(logger *slog.Logger) Interceptor {
+	return func(ctx context.Context, meta Meta, next func(context.Context) AckType) AckType {
+		logger := logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+
+		start := time.Now()
+		ack := next(ctx)
+		logger.InfoContext(ctx, "handled delivery",
+			"queue", meta.Queue,
+			"message_id", meta.MessageId,
+			"routing_key", meta.RoutingKey,
+			"app_id", meta.AppId,
+			"ack", ack.String(),
+			"duration", time.Since(start))
+
+		return ack
+	}
+}
+
+// Timing reports how long each delivery took to handle and how it was
+// settled.
+func Timing(observe func(meta Meta, ack AckType, d time.Duration)) Interceptor {
+	return func(ctx context.Context, meta Meta, next func(context.Context) AckType) AckType {
+		start := time.Now()
+		ack := next(ctx)
+		observe(meta, ack, time.Since(start))
+
+		return ack
+	}
+}
+
+// Timeout cancels the handler's context after d, and settles the delivery
+// with ack instead of the handler's answer if it returns after that. It
+// doesn't stop the handler: only one that watches Delivery.Context, for
+// example by publishing WithContext(d.Context()), gives up early. One that
+// doesn't runs to the end, holding its worker and leaving the delivery
+// unsettled until it does.
+func Timeout(d time.Duration, ack AckType) Interceptor {
+	return func(ctx context.Context, meta Meta, next func(context.Context) AckType) AckType {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+
+		start := time.Now()
+		result := next(ctx)
+		if ctx.Err() != context.DeadlineExceeded {
+			return result
+		}
+
+		slog.WarnContext(ctx, "handler timed out",
+			"queue", meta.Queue,
+			"message_id", meta.MessageId,
+			"timeout", d,
+			"took", time.Since(start),
+			"ack", result.String())
+
+		return ack
+	}
+}
@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	named := func(name string) Interceptor {
+		return func(ctx context.Context, meta Meta, next func(context.Context) AckType) AckType {
+			calls = append(calls, name)
+			return next(ctx)
+		}
+	}
+	typed := func(next Handler[string]) Handler[string] {
+		return func(d Delivery[string]) AckType {
+			calls = append(calls, "typed "+d.Body)
+			return next(d)
+		}
+	}
+
+	config := newSubscribeConfig([]SubscribeOption{
+		WithMiddleware(typed),
+		WithInterceptors(named("outer"), named("inner")),
+	})
+	handler, err := chain(config, func(d Delivery[string]) AckType {
+		calls = append(calls, "handler")
+		return NackDiscard
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ack := handler(Delivery[string]{Body: "body"}); ack != NackDiscard {
+		t.Errorf("chain returned %v", ack)
+	}
+	want := []string{"outer", "inner", "typed body", "handler"}
+	if len(calls) != len(want) {
+		t.Fatalf("called %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("called %v, want %v", calls, want)
+		}
+	}
+
+	config = newSubscribeConfig([]SubscribeOption{WithMiddleware(typed)})
+	if _, err := chain(config, func(d Delivery[int]) AckType { return Ack }); err == nil {
+		t.Error("chained string middleware onto an int handler")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	handler := Intercept[string](Recover(NackDiscard))(func(d Delivery[string]) AckType {
+		panic("boom")
+	})
+	if ack := handler(Delivery[string]{}); ack != NackDiscard {
+		t.Errorf("recovered with %v", ack)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	handler := Intercept[string](Timeout(10*time.Millisecond, NackRequeue))(func(d Delivery[string]) AckType {
+		<-d.Context().Done()
+		return Ack
+	})
+	if ack := handler(Delivery[string]{}); ack != NackRequeue {
+		t.Errorf("timed out with %v", ack)
+	}
+
+	quick := Intercept[string](Timeout(time.Hour, NackRequeue))(func(d Delivery[string]) AckType {
+		return Ack
+	})
+	if ack := quick(Delivery[string]{}); ack != Ack {
+		t.Errorf("finished in time with %v", ack)
+	}
+}
+
+// TestHandlerContext checks that handlers are given the subscription's
+// context, so that they stop when it does.
+func TestHandlerContext(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "game"))
+	defer cancel()
+
+	started := make(chan context.Context, 1)
+	stopped := make(chan error, 1)
+	_, err := SubscribeDelivery(ctx, conn, testExchange, "slow", "slow.*", Transient, func(d Delivery[string]) AckType {
+		started <- d.Context()
+		<-d.Context().Done()
+		stopped <- d.Context().Err()
+		return NackRequeue
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PublishJSON(ch, testExchange, "slow.alice", "move"); err != nil {
+		t.Fatal(err)
+	}
+	if hctx := receive(t, started); hctx.Value(key{}) != "game" {
+		t.Error("handler context doesn't come from the subscription's")
+	}
+	cancel()
+	if err := receive(t, stopped); !errors.Is(err, context.Canceled) {
+		t.Errorf("handler context ended with %v", err)
+	}
+}
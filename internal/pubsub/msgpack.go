@@ -0,0 +1,735 @@
+package pubsub
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// msgpackCodec is a reflection based MessagePack codec covering what the
+// game sends: scalars, strings, byte slices, slices, maps, structs (as maps
+// keyed by field name) and time.Time (as the timestamp extension).
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return ContentTypeMsgPack }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	e := &msgpackEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("msgpack: Unmarshal needs a non-nil pointer")
+	}
+
+	d := &msgpackDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(d.data)-d.pos)
+	}
+
+	return nil
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	errMsgPackEOF  = errors.New("msgpack: unexpected end of data")
+	msgpackTimeExt = int8(-1)
+)
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) byte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *msgpackEncoder) uint(u uint64, bits int) {
+	switch bits {
+	case 8:
+		e.buf = append(e.buf, byte(u))
+	case 16:
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(u))
+	case 32:
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(u))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(e.buf, u)
+	}
+}
+
+// length writes a length header using the fixed form when it fits and
+// otherwise the 8, 16 or 32 bit form. Formats without an 8 bit form pass 0
+// for it.
+func (e *msgpackEncoder) length(n int, fixed byte, fixedMax int, f8, f16, f32 byte) {
+	switch {
+	case n <= fixedMax:
+		e.byte(fixed | byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		e.byte(f8)
+		e.uint(uint64(n), 8)
+	case n <= math.MaxUint16:
+		e.byte(f16)
+		e.uint(uint64(n), 16)
+	default:
+		e.byte(f32)
+		e.uint(uint64(n), 32)
+	}
+}
+
+func (e *msgpackEncoder) int(i int64) {
+	switch {
+	case i >= 0:
+		e.uintValue(uint64(i))
+	case i >= -32:
+		e.byte(byte(i))
+	case i >= math.MinInt8:
+		e.byte(0xd0)
+		e.uint(uint64(i), 8)
+	case i >= math.MinInt16:
+		e.byte(0xd1)
+		e.uint(uint64(i), 16)
+	case i >= math.MinInt32:
+		e.byte(0xd2)
+		e.uint(uint64(i), 32)
+	default:
+		e.byte(0xd3)
+		e.uint(uint64(i), 64)
+	}
+}
+
+func (e *msgpackEncoder) uintValue(u uint64) {
+	switch {
+	case u < 0x80:
+		e.byte(byte(u))
+	case u <= math.MaxUint8:
+		e.byte(0xcc)
+		e.uint(u, 8)
+	case u <= math.MaxUint16:
+		e.byte(0xcd)
+		e.uint(u, 16)
+	case u <= math.MaxUint32:
+		e.byte(0xce)
+		e.uint(u, 32)
+	default:
+		e.byte(0xcf)
+		e.uint(u, 64)
+	}
+}
+
+func (e *msgpackEncoder) string(s string) {
+	e.length(len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) time(t time.Time) {
+	// timestamp 96: 4 byte nanoseconds then 8 byte seconds.
+	e.byte(0xc7)
+	e.byte(12)
+	e.byte(byte(msgpackTimeExt))
+	e.uint(uint64(t.Nanosecond()), 32)
+	e.uint(uint64(t.Unix()), 64)
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.byte(0xc0)
+		return nil
+	}
+
+	if v.Type() == timeType {
+		e.time(v.Interface().(time.Time))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.byte(0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.byte(0xc3)
+		} else {
+			e.byte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.uintValue(v.Uint())
+	case reflect.Float32:
+		e.byte(0xca)
+		e.uint(uint64(math.Float32bits(float32(v.Float()))), 32)
+	case reflect.Float64:
+		e.byte(0xcb)
+		e.uint(math.Float64bits(v.Float()), 64)
+	case reflect.String:
+		e.string(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.byte(0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.length(v.Len(), 0, -1, 0xc4, 0xc5, 0xc6)
+			e.buf = append(e.buf, v.Bytes()...)
+			return nil
+		}
+		return e.array(v)
+	case reflect.Array:
+		return e.array(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.byte(0xc0)
+			return nil
+		}
+		e.length(v.Len(), 0x80, 15, 0, 0xde, 0xdf)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := msgpackFields(v.Type())
+		e.length(len(fields), 0x80, 15, 0, 0xde, 0xdf)
+		for _, f := range fields {
+			e.string(f.name)
+			if err := e.encode(v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot encode %s", v.Type())
+	}
+
+	return nil
+}
+
+func (e *msgpackEncoder) array(v reflect.Value) error {
+	e.length(v.Len(), 0x90, 15, 0, 0xdc, 0xdd)
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type msgpackField struct {
+	name  string
+	index int
+}
+
+// msgpackFields lists the exported fields of a struct. A `msgpack:"name"`
+// tag renames a field and `msgpack:"-"` skips it.
+func msgpackFields(t reflect.Type) []msgpackField {
+	fields := []msgpackField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("msgpack"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		fields = append(fields, msgpackField{name: name, index: i})
+	}
+
+	return fields
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgPackEOF
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+
+	return b, nil
+}
+
+func (d *msgpackDecoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errMsgPackEOF
+	}
+
+	return d.data[d.pos], nil
+}
+
+func (d *msgpackDecoder) uint(bits int) (uint64, error) {
+	b, err := d.next(bits / 8)
+	if err != nil {
+		return 0, err
+	}
+
+	switch bits {
+	case 8:
+		return uint64(b[0]), nil
+	case 16:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 32:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// value reads the next item into a generic Go value: nil, bool, int64,
+// uint64, float64, string, []byte, []any, map[any]any or time.Time.
+func (d *msgpackDecoder) value() (any, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f, c >= 0xe0, c >= 0xcc && c <= 0xd3:
+		return d.integer()
+	case c >= 0x80 && c <= 0x8f, c == 0xde, c == 0xdf:
+		n, err := d.mapLen()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[any]any, n)
+		for i := 0; i < n; i++ {
+			k, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, fmt.Errorf("msgpack: unhashable map key %T", k)
+			}
+			m[k] = v
+		}
+		return m, nil
+	case c >= 0x90 && c <= 0x9f, c == 0xdc, c == 0xdd:
+		n, err := d.arrayLen()
+		if err != nil {
+			return nil, err
+		}
+		a := make([]any, n)
+		for i := range a {
+			if a[i], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case c >= 0xa0 && c <= 0xbf, c == 0xd9, c == 0xda, c == 0xdb:
+		return d.string()
+	case c == 0xc4, c == 0xc5, c == 0xc6:
+		b, err := d.bytes()
+		return append([]byte(nil), b...), err
+	case c == 0xc0:
+		d.pos++
+		return nil, nil
+	case c == 0xc2, c == 0xc3:
+		d.pos++
+		return c == 0xc3, nil
+	case c == 0xca, c == 0xcb:
+		return d.float()
+	case c == 0xd6, c == 0xd7, c == 0xc7:
+		return d.time()
+	default:
+		return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", c)
+	}
+}
+
+// integer returns an int64, or a uint64 for values too large for one.
+func (d *msgpackDecoder) integer() (any, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	d.pos++
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	}
+
+	switch c {
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(8 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if u > math.MaxInt64 {
+			return u, nil
+		}
+		return int64(u), nil
+	case 0xd0:
+		u, err := d.uint(8)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := d.uint(16)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := d.uint(32)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := d.uint(64)
+		return int64(u), err
+	default:
+		return nil, fmt.Errorf("msgpack: expected integer, got 0x%02x", c)
+	}
+}
+
+func (d *msgpackDecoder) float() (float64, error) {
+	c, err := d.peek()
+	if err != nil {
+		return 0, err
+	}
+
+	switch c {
+	case 0xca:
+		d.pos++
+		u, err := d.uint(32)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		d.pos++
+		u, err := d.uint(64)
+		return math.Float64frombits(u), err
+	}
+
+	i, err := d.integer()
+	if err != nil {
+		return 0, err
+	}
+	if u, ok := i.(uint64); ok {
+		return float64(u), nil
+	}
+
+	return float64(i.(int64)), nil
+}
+
+func (d *msgpackDecoder) header(fixedLo, fixedHi byte, f8, f16, f32 byte, what string) (int, error) {
+	c, err := d.peek()
+	if err != nil {
+		return 0, err
+	}
+	d.pos++
+
+	var n uint64
+	switch {
+	case c >= fixedLo && c <= fixedHi:
+		return int(c - fixedLo), nil
+	case f8 != 0 && c == f8:
+		n, err = d.uint(8)
+	case c == f16:
+		n, err = d.uint(16)
+	case c == f32:
+		n, err = d.uint(32)
+	default:
+		return 0, fmt.Errorf("msgpack: expected %s, got 0x%02x", what, c)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		// Every element takes at least a byte, so this can't be real.
+		return 0, errMsgPackEOF
+	}
+
+	return int(n), nil
+}
+
+func (d *msgpackDecoder) mapLen() (int, error) {
+	return d.header(0x80, 0x8f, 0, 0xde, 0xdf, "map")
+}
+
+func (d *msgpackDecoder) arrayLen() (int, error) {
+	return d.header(0x90, 0x9f, 0, 0xdc, 0xdd, "array")
+}
+
+func (d *msgpackDecoder) string() (string, error) {
+	n, err := d.header(0xa0, 0xbf, 0xd9, 0xda, 0xdb, "string")
+	if err != nil {
+		return "", err
+	}
+	b, err := d.next(n)
+
+	return string(b), err
+}
+
+func (d *msgpackDecoder) bytes() ([]byte, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	if c >= 0xa0 && c <= 0xbf || c == 0xd9 || c == 0xda || c == 0xdb {
+		s, err := d.string()
+		return []byte(s), err
+	}
+
+	// bin has no fixed form; 0xc1 is never used so the range is empty.
+	n, err := d.header(0xc1, 0xc0, 0xc4, 0xc5, 0xc6, "binary")
+	if err != nil {
+		return nil, err
+	}
+
+	return d.next(n)
+}
+
+func (d *msgpackDecoder) time() (time.Time, error) {
+	c, err := d.peek()
+	if err != nil {
+		return time.Time{}, err
+	}
+	d.pos++
+
+	size := 0
+	switch c {
+	case 0xd6:
+		size = 4
+	case 0xd7:
+		size = 8
+	case 0xc7:
+		n, err := d.uint(8)
+		if err != nil {
+			return time.Time{}, err
+		}
+		size = int(n)
+	default:
+		return time.Time{}, fmt.Errorf("msgpack: expected timestamp, got 0x%02x", c)
+	}
+
+	typ, err := d.uint(8)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if int8(typ) != msgpackTimeExt {
+		return time.Time{}, fmt.Errorf("msgpack: unsupported extension type %d", int8(typ))
+	}
+
+	switch size {
+	case 4:
+		sec, err := d.uint(32)
+		return time.Unix(int64(sec), 0), err
+	case 8:
+		u, err := d.uint(64)
+		return time.Unix(int64(u&(1<<34-1)), int64(u>>34)), err
+	case 12:
+		nsec, err := d.uint(32)
+		if err != nil {
+			return time.Time{}, err
+		}
+		sec, err := d.uint(64)
+		return time.Unix(int64(sec), int64(nsec)), err
+	default:
+		return time.Time{}, fmt.Errorf("msgpack: bad timestamp length %d", size)
+	}
+}
+
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+
+	if c == 0xc0 {
+		d.pos++
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if v.Type() == timeType {
+		t, err := d.time()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("msgpack: cannot decode into %s", v.Type())
+		}
+		x, err := d.value()
+		if err != nil {
+			return err
+		}
+		if x != nil {
+			v.Set(reflect.ValueOf(x))
+		}
+	case reflect.Bool:
+		x, err := d.value()
+		if err != nil {
+			return err
+		}
+		b, ok := x.(bool)
+		if !ok {
+			return fmt.Errorf("msgpack: cannot decode %T into %s", x, v.Type())
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := d.integer()
+		if err != nil {
+			return err
+		}
+		i, ok := x.(int64)
+		if !ok || v.OverflowInt(i) {
+			return fmt.Errorf("msgpack: %v overflows %s", x, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, err := d.integer()
+		if err != nil {
+			return err
+		}
+		var u uint64
+		switch x := x.(type) {
+		case uint64:
+			u = x
+		case int64:
+			if x < 0 {
+				return fmt.Errorf("msgpack: %d overflows %s", x, v.Type())
+			}
+			u = uint64(x)
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("msgpack: %d overflows %s", u, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := d.float()
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		s, err := d.string()
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		n, err := d.arrayLen()
+		if err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		n, err := d.arrayLen()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if i >= v.Len() {
+				if _, err := d.value(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := d.mapLen()
+		if err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(v.Type(), n)
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			val := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(val); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, val)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		n, err := d.mapLen()
+		if err != nil {
+			return err
+		}
+		fields := msgpackFields(v.Type())
+		for i := 0; i < n; i++ {
+			name, err := d.string()
+			if err != nil {
+				return err
+			}
+			index := -1
+			for _, f := range fields {
+				if f.name == name {
+					index = f.index
+					break
+				}
+			}
+			if index < 0 {
+				if _, err := d.value(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Field(index)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot decode into %s", v.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package pubsub
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type msgpackUnit struct {
+	ID       int
+	Rank     string
+	Location string `msgpack:"loc"`
+	Secret   string `msgpack:"-"`
+}
+
+type msgpackMove struct {
+	Player   string
+	Units    []msgpackUnit
+	Lead     *msgpackUnit
+	Reserve  *msgpackUnit
+	Scores   map[string]int64
+	Tags     []string
+	Payload  []byte
+	Big      uint64
+	Small    int8
+	Negative int64
+	Ratio    float64
+	Half     float32
+	Active   bool
+	At       time.Time
+	Long     string
+	Fixed    [3]uint16
+}
+
+func TestMsgPackRoundTrip(t *testing.T) {
+	in := msgpackMove{
+		Player:   "alice",
+		Units:    []msgpackUnit{{ID: 1, Rank: "infantry", Location: "europe"}, {ID: 300, Rank: "artillery", Location: "asia"}},
+		Lead:     &msgpackUnit{ID: 70000, Rank: "cavalry"},
+		Scores:   map[string]int64{"wins": 3, "losses": -40000},
+		Tags:     []string{},
+		Payload:  bytes.Repeat([]byte{0xc1}, 300),
+		Big:      math.MaxUint64,
+		Small:    math.MinInt8,
+		Negative: math.MinInt64,
+		Ratio:    -0.125,
+		Half:     1.5,
+		Active:   true,
+		At:       time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC),
+		Long:     strings.Repeat("peril ", 20000),
+		Fixed:    [3]uint16{1, 256, math.MaxUint16},
+	}
+
+	data, err := MsgPack.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out msgpackMove
+	if err := MsgPack.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.At.Equal(in.At) {
+		t.Errorf("time %v, want %v", out.At, in.At)
+	}
+	out.At = in.At
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip\n got %+v\nwant %+v", out, in)
+	}
+}
+
+func TestMsgPackSkipsTaggedFields(t *testing.T) {
+	data, err := MsgPack.Marshal(msgpackUnit{ID: 1, Location: "europe", Secret: "hidden"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("hidden")) || bytes.Contains(data, []byte("Secret")) {
+		t.Errorf("skipped field was encoded: %q", data)
+	}
+	if !bytes.Contains(data, []byte("loc")) {
+		t.Errorf("renamed field missing: %q", data)
+	}
+}
+
+// TestMsgPackWireFormat checks encodings against the MessagePack spec, so
+// other implementations can read what we send.
+func TestMsgPackWireFormat(t *testing.T) {
+	tests := []struct {
+		in   any
+		want []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0xcc, 0x80}},
+		{-1, []byte{0xff}},
+		{-33, []byte{0xd0, 0xdf}},
+		{65536, []byte{0xce, 0x00, 0x01, 0x00, 0x00}},
+		{"a", []byte{0xa1, 'a'}},
+		{[]byte{1, 2}, []byte{0xc4, 0x02, 0x01, 0x02}},
+		{[]int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{map[string]bool{"x": false}, []byte{0x81, 0xa1, 'x', 0xc2}},
+		{1.0, []byte{0xcb, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		got, err := MsgPack.Marshal(tt.in)
+		if err != nil {
+			t.Errorf("Marshal(%#v): %v", tt.in, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("Marshal(%#v) = % x, want % x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMsgPackDecodeErrors(t *testing.T) {
+	data, err := MsgPack.Marshal(msgpackUnit{ID: 1, Rank: "infantry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var u msgpackUnit
+	if err := MsgPack.Unmarshal(data[:len(data)-1], &u); err == nil {
+		t.Error("truncated data decoded")
+	}
+	if err := MsgPack.Unmarshal(append(data, 0x01), &u); err == nil {
+		t.Error("trailing data decoded")
+	}
+	if err := MsgPack.Unmarshal(data, u); err == nil {
+		t.Error("decoded into a non-pointer")
+	}
+	if err := MsgPack.Unmarshal([]byte{0xc1}, &u); err == nil {
+		t.Error("decoded the never-used format")
+	}
+	if _, err := MsgPack.Marshal(make(chan int)); err == nil {
+		t.Error("encoded a channel")
+	}
+}
+
+// TestMsgPackSubscription checks that a subscriber picks the codec from the
+// content type rather than its default.
+func TestMsgPackSubscription(t *testing.T) {
+	_, conn := newTestBroker(t)
+
+	got := make(chan msgpackUnit, 1)
+	_, err := Subscribe(testContext(t), conn, testExchange, "units", "units.*", Transient, func(u msgpackUnit) AckType {
+		got <- u
+		return Ack
+	}, WithDefaultCodec(JSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := msgpackUnit{ID: 2, Rank: "cavalry", Location: "africa"}
+	if err := Publish(ch, testExchange, "units.alice", want, WithCodec(MsgPack)); err != nil {
+		t.Fatal(err)
+	}
+
+	if u := receive(t, got); u != want {
+		t.Errorf("received %+v, want %+v", u, want)
+	}
+}
@@ -0,0 +1,572 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Outbox relay tuning.
+const (
+	// outboxBatch is how many messages the relay sends before waiting for
+	// their confirms.
+	outboxBatch = 100
+	// outboxSlack is how many delivered records the file may collect before
+	// it is rewritten.
+	outboxSlack = 1024
+
+	outboxMinBackoff = 500 * time.Millisecond
+	outboxMaxBackoff = 30 * time.Second
+
+	// outboxMaxNacks is how many times the broker may nack a message before
+	// the outbox drops it, rather than hold up everything behind it.
+	outboxMaxNacks = 3
+)
+
+// Outbox is a Publisher that writes every message to an append-only local
+// file before returning, and relays the file to the broker in the
+// background. A message is marked delivered only once the broker has
+// confirmed it, so messages survive broker outages and process crashes.
+// Delivery is at least once: a crash between a confirm and its mark sends
+// the message again on restart, with the same message id. Messages are
+// relayed in order, so pub should send them in order too: a
+// ConfirmingPublisher does, a PublisherPool spreading them over several
+// channels doesn't. It is safe for concurrent use.
+//
+// A message published WithExpiration expires that long after it was
+// published, not after it was relayed; one that expires while waiting in
+// the outbox is dropped, and so are one the broker returns as unroutable
+// and one it keeps nacking. Dropped counts them all.
+//
+// Header values must be strings, integers or booleans, which is all the
+// file keeps; PublishWithContext refuses a message with any other kind.
+//
+// Each line of the file is a JSON record, either a message or the mark that
+// a message was delivered. The file is compacted when it holds many
+// delivered messages.
+type Outbox struct {
+	path string
+	pub  AsyncPublisher
+
+	mu      sync.Mutex
+	w       *os.File
+	seq     uint64
+	pending []outboxRecord
+	records int
+	empty   chan struct{}
+	closed  bool
+	dropped uint64
+	// nacks is how many times the oldest pending message has been nacked.
+	nacks int
+
+	wake chan struct{}
+	// ctx is cancelled by Close, which stops the relay even while it waits
+	// for a blocked broker.
+	ctx  context.Context
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+type outboxRecord struct {
+	Seq       uint64         `json:"seq"`
+	Delivered bool           `json:"delivered,omitempty"`
+	Exchange  string         `json:"exchange,omitempty"`
+	Key       string         `json:"key,omitempty"`
+	Mandatory bool           `json:"mandatory,omitempty"`
+	Msg       *outboxMessage `json:"msg,omitempty"`
+}
+
+// outboxMessage is an amqp.Publishing that survives a round trip through
+// JSON. Header values keep their type.
+type outboxMessage struct {
+	Headers         map[string]outboxValue `json:"headers,omitempty"`
+	ContentType     string                 `json:"content_type,omitempty"`
+	ContentEncoding string                 `json:"content_encoding,omitempty"`
+	DeliveryMode    uint8                  `json:"delivery_mode,omitempty"`
+	Priority        uint8                  `json:"priority,omitempty"`
+	CorrelationId   string                 `json:"correlation_id,omitempty"`
+	ReplyTo         string                 `json:"reply_to,omitempty"`
+	Expiration      string                 `json:"expiration,omitempty"`
+	Expires         *time.Time             `json:"expires,omitempty"`
+	MessageId       string                 `json:"message_id,omitempty"`
+	Timestamp       time.Time              `json:"timestamp"`
+	Type            string                 `json:"type,omitempty"`
+	AppId           string                 `json:"app_id,omitempty"`
+	Body            []byte                 `json:"body"`
+}
+
+type outboxValue struct {
+	String *string `json:"s,omitempty"`
+	Int    *int64  `json:"i,omitempty"`
+	Bool   *bool   `json:"b,omitempty"`
+}
+
+// NewOutbox opens (or creates) the outbox at path and starts relaying
+// whatever is pending in it through pub.
+func NewOutbox(path string, pub AsyncPublisher) (*Outbox, error) {
+	ctx, stop := context.WithCancel(context.Background())
+	o := &Outbox{
+		path: path,
+		pub:  pub,
+		wake: make(chan struct{}, 1),
+		ctx:  ctx,
+		stop: stop,
+		done: make(chan struct{}),
+	}
+	if err := o.load(); err != nil {
+		stop()
+		return nil, err
+	}
+	if err := o.compact(); err != nil {
+		stop()
+		return nil, err
+	}
+	if len(o.pending) > 0 {
+		log.Printf("Outbox %s has %d messages to relay", path, len(o.pending))
+		o.empty = make(chan struct{})
+		o.wake <- struct{}{}
+	}
+
+	go o.relay()
+
+	return o, nil
+}
+
+// PublishWithContext records msg in the outbox and returns once it is on
+// disk. The broker sees it later.
+func (o *Outbox) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stored, err := storeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return amqp.ErrClosed
+	}
+
+	record := outboxRecord{Seq: o.seq + 1, Exchange: exchange, Key: key, Mandatory: mandatory, Msg: stored}
+	if err := o.append(record); err != nil {
+		return err
+	}
+	o.seq++
+	if len(o.pending) == 0 {
+		o.empty = make(chan struct{})
+	}
+	o.pending = append(o.pending, record)
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Dropped is how many messages the outbox gave up on because they expired
+// before they could be relayed, or the broker couldn't route them or kept
+// nacking them.
+func (o *Outbox) Dropped() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.dropped
+}
+
+// Pending is how many messages are waiting for the broker.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.pending)
+}
+
+// Flush waits until every message in the outbox has been delivered.
+func (o *Outbox) Flush(ctx context.Context) error {
+	o.mu.Lock()
+	empty := o.empty
+	if len(o.pending) == 0 {
+		empty = nil
+	}
+	o.mu.Unlock()
+
+	if empty == nil {
+		return nil
+	}
+
+	select {
+	case <-empty:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the relay. Messages not yet delivered stay in the file and
+// are relayed by the next Outbox opened on it.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	o.closed = true
+	o.mu.Unlock()
+
+	o.stop()
+	<-o.done
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.pending) > 0 {
+		log.Printf("Outbox %s closed with %d messages still to relay", o.path, len(o.pending))
+	}
+
+	return o.w.Close()
+}
+
+// relay sends pending messages in order, backing off while the broker is
+// unavailable.
+func (o *Outbox) relay() {
+	defer close(o.done)
+
+	backoff := outboxMinBackoff
+	for {
+		select {
+		case <-o.ctx.Done():
+			return
+		case <-o.wake:
+		}
+
+		for {
+			err := o.send()
+			if err == nil {
+				backoff = outboxMinBackoff
+				break
+			}
+
+			log.Printf("Outbox %s could not relay, retrying in %s: %v", o.path, backoff, err)
+			select {
+			case <-o.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, outboxMaxBackoff)
+		}
+	}
+}
+
+// send relays pending messages a batch at a time until none are left. It
+// stops at the first message the broker doesn't take, so that it is retried
+// before anything published after it.
+func (o *Outbox) send() error {
+	for {
+		o.mu.Lock()
+		size := outboxBatch
+		if o.nacks > 0 {
+			// Don't send the rest again with every retry of a nacked one.
+			size = 1
+		}
+		batch := o.pending[:min(len(o.pending), size)]
+		o.mu.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		// A nil confirmation is a message that expired unsent.
+		confirmations := make([]*PublishConfirmation, 0, len(batch))
+		var sendErr error
+		for _, record := range batch {
+			msg, live := record.Msg.publishing(time.Now())
+			if !live {
+				confirmations = append(confirmations, nil)
+				continue
+			}
+
+			c, err := o.pub.PublishAsync(o.ctx, record.Exchange, record.Key, record.Mandatory, false, msg)
+			if err != nil {
+				sendErr = err
+				break
+			}
+			confirmations = append(confirmations, c)
+		}
+
+		for i, c := range confirmations {
+			drop := c == nil
+			if c == nil {
+				log.Printf("Outbox %s dropping message %s: it expired before it could be relayed", o.path, batch[i].Msg.MessageId)
+			} else {
+				err := c.Wait(o.ctx)
+
+				var returned *ReturnedError
+				if errors.As(err, &returned) {
+					// Nothing will route it on a second try either.
+					log.Printf("Outbox %s dropping message %s: %v", o.path, batch[i].Msg.MessageId, err)
+					drop, err = true, nil
+				} else if errors.Is(err, ErrNacked) && o.nacked() {
+					log.Printf("Outbox %s dropping message %s: nacked %d times", o.path, batch[i].Msg.MessageId, outboxMaxNacks)
+					drop, err = true, nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			if err := o.delivered(batch[i].Seq, drop); err != nil {
+				return err
+			}
+		}
+
+		if sendErr != nil {
+			return sendErr
+		}
+	}
+}
+
+// nacked counts a nack of the oldest pending message and reports whether it
+// has had too many.
+func (o *Outbox) nacked() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.nacks++
+	return o.nacks >= outboxMaxNacks
+}
+
+// delivered marks the oldest pending message, which has the given seq, as
+// delivered, or as dropped if it never reached a queue.
+func (o *Outbox) delivered(seq uint64, dropped bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.append(outboxRecord{Seq: seq, Delivered: true}); err != nil {
+		return err
+	}
+	o.pending = o.pending[1:]
+	o.nacks = 0
+	if dropped {
+		o.dropped++
+	}
+
+	if len(o.pending) == 0 {
+		close(o.empty)
+	}
+
+	// Everything but the pending messages is dead weight, even while the
+	// relay is still behind.
+	if o.records-len(o.pending) > outboxSlack {
+		return o.compact()
+	}
+
+	return nil
+}
+
+// append writes one record and syncs it to disk. The lock must be held.
+func (o *Outbox) append(record outboxRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := o.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	o.records++
+
+	return o.w.Sync()
+}
+
+// load reads the messages that haven't been marked delivered. A torn last
+// line, from a crash halfway through a write, is ignored.
+func (o *Outbox) load() error {
+	f, err := os.Open(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	messages := map[uint64]outboxRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxDecompressedSize)
+	for scanner.Scan() {
+		var record outboxRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Outbox %s: skipping unreadable record: %v", o.path, err)
+			continue
+		}
+
+		o.seq = max(o.seq, record.Seq)
+		if record.Delivered {
+			delete(messages, record.Seq)
+		} else if record.Msg != nil {
+			messages[record.Seq] = record
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("pubsub: reading outbox %s: %w", o.path, err)
+	}
+
+	for seq := uint64(1); seq <= o.seq; seq++ {
+		if record, ok := messages[seq]; ok {
+			o.pending = append(o.pending, record)
+		}
+	}
+
+	return nil
+}
+
+// compact rewrites the file with only the pending messages and swaps it in.
+func (o *Outbox) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(o.path), ".outbox-*")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, record := range o.pending {
+		if err := enc.Encode(record); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), o.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if o.w != nil {
+		o.w.Close()
+	}
+	o.w, err = os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND, 0644)
+	o.records = len(o.pending)
+
+	return err
+}
+
+func storeMessage(msg amqp.Publishing) (*outboxMessage, error) {
+	stored := &outboxMessage{
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+	if msg.Expiration != "" {
+		ms, err := strconv.ParseInt(msg.Expiration, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("pubsub: bad expiration %q: %w", msg.Expiration, err)
+		}
+		expires := time.Now().Add(time.Duration(ms) * time.Millisecond)
+		stored.Expires = &expires
+	}
+	if len(msg.Headers) > 0 {
+		stored.Headers = make(map[string]outboxValue, len(msg.Headers))
+	}
+	for name, v := range msg.Headers {
+		var value outboxValue
+		switch v := v.(type) {
+		case string:
+			value.String = &v
+		case bool:
+			value.Bool = &v
+		case int:
+			n := int64(v)
+			value.Int = &n
+		case int32:
+			n := int64(v)
+			value.Int = &n
+		case int64:
+			value.Int = &v
+		default:
+			return nil, fmt.Errorf("pubsub: outbox can't store header %s of type %T", name, v)
+		}
+		stored.Headers[name] = value
+	}
+
+	return stored, nil
+}
+
+// publishing rebuilds the message to relay at now, with only the time it
+// has left to live. It reports false if it has none left.
+func (m *outboxMessage) publishing(now time.Time) (amqp.Publishing, bool) {
+	msg := amqp.Publishing{
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		DeliveryMode:    m.DeliveryMode,
+		Priority:        m.Priority,
+		CorrelationId:   m.CorrelationId,
+		ReplyTo:         m.ReplyTo,
+		Expiration:      m.Expiration,
+		MessageId:       m.MessageId,
+		Timestamp:       m.Timestamp,
+		Type:            m.Type,
+		AppId:           m.AppId,
+		Body:            m.Body,
+	}
+	if len(m.Headers) > 0 {
+		msg.Headers = make(amqp.Table, len(m.Headers))
+	}
+	for name, value := range m.Headers {
+		switch {
+		case value.String != nil:
+			msg.Headers[name] = *value.String
+		case value.Int != nil:
+			msg.Headers[name] = *value.Int
+		case value.Bool != nil:
+			msg.Headers[name] = *value.Bool
+		}
+	}
+
+	if m.Expires != nil {
+		left := m.Expires.Sub(now).Milliseconds()
+		if left <= 0 {
+			return msg, false
+		}
+		msg.Expiration = strconv.FormatInt(left, 10)
+	}
+
+	return msg, true
+}
@@ -0,0 +1,242 @@
+package pubsub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// downPublisher is a broker that can't be reached.
+type downPublisher struct{}
+
+func (downPublisher) PublishAsync(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*PublishConfirmation, error) {
+	return nil, ErrDisconnected
+}
+
+func newTestOutbox(t *testing.T, path string, pub AsyncPublisher) *Outbox {
+	t.Helper()
+
+	outbox, err := NewOutbox(path, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { outbox.Close() })
+
+	return outbox
+}
+
+func flushOutbox(t *testing.T, outbox *Outbox) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := outbox.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboxRelaysInOrder(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	outbox := newTestOutbox(t, filepath.Join(t.TempDir(), "outbox"), newTestConfirmingPublisher(t, conn))
+
+	parent := Meta{MessageId: "cause", CorrelationId: "game-1"}
+	for i := 0; i < 5; i++ {
+		if err := PublishJSON(outbox, testExchange, "batch.ok", i, WithCausedBy(parent), WithPriority(3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushOutbox(t, outbox)
+
+	for i := 0; i < 5; i++ {
+		d, ok, err := ch.Get("batch", true)
+		if err != nil || !ok {
+			t.Fatalf("message %d missing: %v", i, err)
+		}
+		if string(d.Body) != strconv.Itoa(i) {
+			t.Errorf("message %d is %s", i, d.Body)
+		}
+		meta := MetaOf(d)
+		if meta.CausationId != "cause" || meta.CorrelationId != "game-1" || meta.SchemaVersion != DefaultSchemaVersion || d.Priority != 3 {
+			t.Errorf("envelope lost on the way through: %+v, priority %d", meta, d.Priority)
+		}
+	}
+	if n := outbox.Pending(); n != 0 {
+		t.Errorf("%d still pending", n)
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	down, err := NewOutbox(path, downPublisher{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for i := 0; i < 3; i++ {
+		rec := &recordingPublisher{}
+		PublishJSON(rec, testExchange, "batch.ok", i)
+		ids = append(ids, rec.msg.MessageId)
+		if err := down.PublishWithContext(context.Background(), testExchange, "batch.ok", false, false, rec.msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := down.Pending(); n != 3 {
+		t.Fatalf("%d pending while the broker is down, want 3", n)
+	}
+	down.Close()
+
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	outbox := newTestOutbox(t, path, newTestConfirmingPublisher(t, conn))
+	flushOutbox(t, outbox)
+
+	for i, id := range ids {
+		d, ok, _ := ch.Get("batch", true)
+		if !ok || d.MessageId != id {
+			t.Errorf("message %d: got %q, want %q", i, d.MessageId, id)
+		}
+	}
+
+	// Nothing is sent twice once it has been marked.
+	outbox.Close()
+	outbox = newTestOutbox(t, path, newTestConfirmingPublisher(t, conn))
+	flushOutbox(t, outbox)
+	if got := queued(t, ch, "batch"); len(got) != 0 {
+		t.Errorf("relayed %v again after reopening", got)
+	}
+}
+
+func TestOutboxExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	down, err := NewOutbox(path, downPublisher{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	PublishJSON(down, testExchange, "batch.ok", "stale", WithExpiration(10*time.Millisecond))
+	PublishJSON(down, testExchange, "batch.ok", "fresh", WithExpiration(time.Hour))
+	time.Sleep(20 * time.Millisecond)
+	down.Close()
+
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	outbox := newTestOutbox(t, path, newTestConfirmingPublisher(t, conn))
+	flushOutbox(t, outbox)
+
+	d, ok, _ := ch.Get("batch", true)
+	if !ok || string(d.Body) != `"fresh"` {
+		t.Fatalf("relayed %q, want only the fresh message", d.Body)
+	}
+	// The broker is told how long is left, not the original expiration.
+	if ms, err := strconv.Atoi(d.Expiration); err != nil || ms <= 0 || ms >= int(time.Hour.Milliseconds()) {
+		t.Errorf("relayed with expiration %q", d.Expiration)
+	}
+	if got := queued(t, ch, "batch"); len(got) != 0 {
+		t.Errorf("also relayed %v", got)
+	}
+	if n := outbox.Dropped(); n != 1 {
+		t.Errorf("Dropped() = %d, want 1", n)
+	}
+}
+
+// TestOutboxDropsUnroutable checks that a message no queue takes doesn't
+// hold up the ones behind it.
+func TestOutboxDropsUnroutable(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	outbox := newTestOutbox(t, filepath.Join(t.TempDir(), "outbox"), newTestConfirmingPublisher(t, conn, WithMandatory()))
+
+	PublishJSON(outbox, testExchange, "batch.nowhere", "lost")
+	PublishJSON(outbox, testExchange, "batch.ok", "found")
+	flushOutbox(t, outbox)
+
+	if got := queued(t, ch, "batch"); len(got) != 1 || got[0] != `"found"` {
+		t.Errorf("queue holds %v", got)
+	}
+	if n := outbox.Dropped(); n != 1 {
+		t.Errorf("Dropped() = %d, want 1", n)
+	}
+}
+
+// TestOutboxDropsNacked checks that a message the broker keeps refusing is
+// given up on after a few tries.
+func TestOutboxDropsNacked(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	if _, err := ch.QueueDeclare("full", false, false, false, false, amqp.Table{"x-max-length": int64(0), "x-overflow": "reject-publish"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("full", "batch.full", testExchange, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	outbox := newTestOutbox(t, filepath.Join(t.TempDir(), "outbox"), newTestConfirmingPublisher(t, conn))
+
+	PublishJSON(outbox, testExchange, "batch.full", "refused")
+	PublishJSON(outbox, testExchange, "batch.ok", "behind")
+	flushOutbox(t, outbox)
+
+	// The message behind may have gone out with the first try as well.
+	got := queued(t, ch, "batch")
+	if len(got) == 0 || len(got) > 2 {
+		t.Errorf("queue holds %v", got)
+	}
+	for _, body := range got {
+		if body != `"behind"` {
+			t.Errorf("queue holds %v", got)
+		}
+	}
+	if n := outbox.Dropped(); n != 1 {
+		t.Errorf("Dropped() = %d, want 1", n)
+	}
+}
+
+func TestOutboxHeaderTypes(t *testing.T) {
+	outbox := newTestOutbox(t, filepath.Join(t.TempDir(), "outbox"), downPublisher{})
+
+	msg := amqp.Publishing{Headers: amqp.Table{"x-when": time.Now()}}
+	if err := outbox.PublishWithContext(context.Background(), testExchange, "batch.ok", false, false, msg); err == nil {
+		t.Error("stored a time header")
+	}
+	if n := outbox.Pending(); n != 0 {
+		t.Errorf("%d pending after a refused publish", n)
+	}
+
+	stored, err := storeMessage(amqp.Publishing{Headers: amqp.Table{"s": "x", "i": int32(7), "b": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ = stored.publishing(time.Now())
+	if msg.Headers["s"] != "x" || msg.Headers["i"] != int64(7) || msg.Headers["b"] != true {
+		t.Errorf("headers came back as %v", msg.Headers)
+	}
+}
+
+func TestOutboxCompacts(t *testing.T) {
+	_, conn := newTestBroker(t)
+	newBatchQueue(t, conn)
+	path := filepath.Join(t.TempDir(), "outbox")
+	outbox := newTestOutbox(t, path, newTestConfirmingPublisher(t, conn))
+
+	for i := 0; i < outboxSlack+100; i++ {
+		if err := PublishJSON(outbox, testExchange, "batch.ok", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushOutbox(t, outbox)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines > outboxSlack {
+		t.Errorf("file has %d lines once everything was delivered", lines)
+	}
+}
@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers added to a poison message when it is dead-lettered.
+const (
+	PoisonErrorHeader      = "x-poison-error"
+	PoisonQueueHeader      = "x-poison-queue"
+	PoisonExchangeHeader   = "x-poison-exchange"
+	PoisonRoutingKeyHeader = "x-poison-routing-key"
+	PoisonCodecHeader      = "x-poison-codec"
+)
+
+// DecodeErrorPolicy decides what happens to a delivery whose body cannot be
+// decoded.
+type DecodeErrorPolicy int
+
+const (
+	// DeadLetterOnDecodeError republishes the body to the dead-letter
+	// exchange with headers describing the failure and acks the original.
+	DeadLetterOnDecodeError DecodeErrorPolicy = iota
+	// DiscardOnDecodeError acks and drops the delivery.
+	DiscardOnDecodeError
+)
+
+// DecodeError describes a poison message.
+type DecodeError struct {
+	Queue      string
+	RoutingKey string
+	Codec      string
+	Body       []byte
+	Err        error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("pubsub: could not decode %s message from queue %q (key %q): %v", e.Codec, e.Queue, e.RoutingKey, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func WithDecodeErrorPolicy(policy DecodeErrorPolicy) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.decodePolicy = policy
+	}
+}
+
+// WithDecodeErrorHandler registers a callback that is told about every
+// poison message before the policy is applied.
+func WithDecodeErrorHandler(fn func(*DecodeError)) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.onDecodeError = fn
+	}
+}
+
+// Poisoned returns how many undecodable deliveries this subscription has
+// seen.
+func (s *Subscription) Poisoned() uint64 {
+	return s.poisoned.Load()
+}
+
+func (s *Subscription) poison(delivery amqp.Delivery, codec Codec, err error) {
+	s.poisoned.Add(1)
+
+	_, key := originalRoute(delivery)
+	decodeErr := &DecodeError{
+		Queue:      s.queue,
+		RoutingKey: key,
+		Codec:      codec.ContentType(),
+		Body:       delivery.Body,
+		Err:        err,
+	}
+	log.Print(decodeErr)
+
+	if s.config.onDecodeError != nil {
+		s.config.onDecodeError(decodeErr)
+	}
+
+	if s.config.decodePolicy == DiscardOnDecodeError {
+		delivery.Ack(false)
+		return
+	}
+
+	if err := s.deadLetter(delivery, decodeErr); err != nil {
+		log.Printf("Could not dead-letter poison message, rejecting instead: %v", err)
+		delivery.Nack(false, false)
+		return
+	}
+	delivery.Ack(false)
+}
+
+// deadLetter republishes a poison delivery to the dead-letter exchange on a
+// side channel, so that a missing exchange can never take down the
+// consuming channel, and waits for the broker to confirm it.
+func (s *Subscription) deadLetter(delivery amqp.Delivery, decodeErr *DecodeError) error {
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	exchange, _ := originalRoute(delivery)
+	headers[PoisonErrorHeader] = decodeErr.Err.Error()
+	headers[PoisonQueueHeader] = decodeErr.Queue
+	headers[PoisonExchangeHeader] = exchange
+	headers[PoisonRoutingKeyHeader] = decodeErr.RoutingKey
+	headers[PoisonCodecHeader] = decodeErr.Codec
+
+	return s.publishConfirmed(routing.ExchangePerilDeadLetter, decodeErr.RoutingKey, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		MessageId:       delivery.MessageId,
+		CorrelationId:   delivery.CorrelationId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	})
+}
@@ -0,0 +1,96 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type poisonMove struct {
+	Units int `json:"units"`
+}
+
+// TestPoisonDeadLetters checks that an undecodable message is dead-lettered
+// with what went wrong, and that the subscription carries on.
+func TestPoisonDeadLetters(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	if err := DeclareDeadLetter(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan poisonMove, 10)
+	sub, err := Subscribe(testContext(t), conn, testExchange, "poisoned", "poisoned.*", Durable, func(m poisonMove) AckType {
+		handled <- m
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch.PublishWithContext(context.Background(), testExchange, "poisoned.alice", false, false, amqp.Publishing{
+		ContentType: ContentTypeJSON,
+		Body:        []byte(`{"units": "lots"}`),
+	})
+	PublishJSON(ch, testExchange, "poisoned.alice", poisonMove{Units: 3})
+	if m := receive(t, handled); m.Units != 3 {
+		t.Errorf("handled %+v", m)
+	}
+	if n := sub.Poisoned(); n != 1 {
+		t.Errorf("Poisoned() = %d, want 1", n)
+	}
+
+	d, ok, err := ch.Get(routing.QueuePerilDeadLetter, true)
+	if err != nil || !ok {
+		t.Fatalf("nothing dead-lettered: %v", err)
+	}
+	if string(d.Body) != `{"units": "lots"}` {
+		t.Errorf("dead-lettered %q", d.Body)
+	}
+	for header, want := range map[string]string{
+		PoisonQueueHeader:      "poisoned",
+		PoisonExchangeHeader:   testExchange,
+		PoisonRoutingKeyHeader: "poisoned.alice",
+		PoisonCodecHeader:      ContentTypeJSON,
+	} {
+		if got := d.Headers[header]; got != want {
+			t.Errorf("%s = %v, want %q", header, got, want)
+		}
+	}
+	if d.Headers[PoisonErrorHeader] == nil {
+		t.Error("dead letter doesn't say why it couldn't be decoded")
+	}
+}
+
+func TestPoisonDiscarded(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	if err := DeclareDeadLetter(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	decodeErrs := make(chan *DecodeError, 1)
+	_, err := Subscribe(testContext(t), conn, testExchange, "discarded", "discarded.*", Durable, func(m poisonMove) AckType {
+		return Ack
+	}, WithDecodeErrorPolicy(DiscardOnDecodeError), WithDecodeErrorHandler(func(de *DecodeError) { decodeErrs <- de }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch.PublishWithContext(context.Background(), testExchange, "discarded.alice", false, false, amqp.Publishing{
+		ContentType: ContentTypeJSON,
+		Body:        []byte("not json"),
+	})
+	if de := receive(t, decodeErrs); de.Queue != "discarded" || de.RoutingKey != "discarded.alice" {
+		t.Errorf("decode error %+v", de)
+	}
+	nothing(t, decodeErrs)
+	if got := queued(t, ch, "discarded"); len(got) != 0 {
+		t.Errorf("queue still holds %v", got)
+	}
+	if got := queued(t, ch, routing.QueuePerilDeadLetter); len(got) != 0 {
+		t.Errorf("dead-letter queue holds %v", got)
+	}
+}
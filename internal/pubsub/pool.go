@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// AsyncPublisher publishes without waiting for the broker's confirmation.
+// *ConfirmingPublisher and *PublisherPool implement it.
+type AsyncPublisher interface {
+	PublishAsync(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*PublishConfirmation, error)
+}
+
+// PublisherPool spreads publishes over several ConfirmingPublishers, each
+// with its own channel, so that concurrent publishers (the REPL, handlers,
+// batches) don't queue up behind one channel. A publish takes an idle
+// channel for as long as it takes to send and then waits for its
+// confirmation without holding it. It is safe for concurrent use, and each
+// channel is reopened if the broker closes it.
+//
+// A publish that has been confirmed is always ahead of later ones, but
+// messages still waiting for their confirmations may overtake each other on
+// different channels. Use a single ConfirmingPublisher where pipelined
+// messages must stay in order.
+type PublisherPool struct {
+	publishers []*ConfirmingPublisher
+	idle       chan *ConfirmingPublisher
+}
+
+func NewPublisherPool(broker Broker, size int, opts ...ConfirmOption) (*PublisherPool, error) {
+	size = max(size, 1)
+	p := &PublisherPool{idle: make(chan *ConfirmingPublisher, size)}
+
+	for range size {
+		pub, err := NewConfirmingPublisher(broker, opts...)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.publishers = append(p.publishers, pub)
+		p.idle <- pub
+	}
+
+	return p, nil
+}
+
+// PublishWithContext publishes and waits for the broker's confirmation.
+func (p *PublisherPool) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	confirmation, err := p.PublishAsync(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		return err
+	}
+
+	return confirmation.Wait(ctx)
+}
+
+// PublishAsync publishes on the first channel to become idle, waiting for
+// one no longer than ctx allows.
+func (p *PublisherPool) PublishAsync(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*PublishConfirmation, error) {
+	var pub *ConfirmingPublisher
+	select {
+	case pub = <-p.idle:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { p.idle <- pub }()
+
+	return pub.PublishAsync(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// Close closes every channel. Publishing afterwards fails with
+// amqp.ErrClosed.
+func (p *PublisherPool) Close() error {
+	var errs []error
+	for _, pub := range p.publishers {
+		errs = append(errs, pub.Close())
+	}
+
+	return errors.Join(errs...)
+}
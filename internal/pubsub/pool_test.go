@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newTestPool(t *testing.T, conn Broker, size int) *PublisherPool {
+	t.Helper()
+
+	pool, err := NewPublisherPool(conn, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+
+	return pool
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	pool := newTestPool(t, conn, 3)
+	ctx := testContext(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- pool.PublishWithContext(ctx, testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte(fmt.Sprint(i))})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, body := range queued(t, ch, "batch") {
+		seen[body] = true
+	}
+	if len(seen) != 100 {
+		t.Errorf("queue holds %d distinct messages, want 100", len(seen))
+	}
+}
+
+// TestPoolReopens checks that a channel the broker closes is replaced, so
+// the pool keeps its size.
+func TestPoolReopens(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+	pool := newTestPool(t, conn, 2)
+	ctx := testContext(t)
+
+	for i := 0; i < 2; i++ {
+		if err := pool.PublishWithContext(ctx, "nowhere", "batch.ok", false, false, amqp.Publishing{}); err == nil {
+			t.Fatal("published to a missing exchange")
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if err := pool.PublishWithContext(ctx, testExchange, "batch.ok", false, false, amqp.Publishing{Body: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatalf("publish %d after the channels closed: %v", i, err)
+		}
+	}
+	if got := queued(t, ch, "batch"); len(got) != 4 {
+		t.Errorf("queue holds %v", got)
+	}
+}
+
+func TestPoolClosed(t *testing.T) {
+	_, conn := newTestBroker(t)
+	pool := newTestPool(t, conn, 2)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pool.PublishWithContext(cancelled, testExchange, "batch.ok", false, false, amqp.Publishing{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("publish with a cancelled context = %v", err)
+	}
+
+	pool.Close()
+	if err := pool.PublishWithContext(testContext(t), testExchange, "batch.ok", false, false, amqp.Publishing{}); !errors.Is(err, amqp.ErrClosed) {
+		t.Errorf("publish after Close() = %v, want amqp.ErrClosed", err)
+	}
+}
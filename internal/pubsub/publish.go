@@ -1,53 +1,171 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"fmt"
-	"log"
+	"strconv"
 	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	marshalledValue, err := json.Marshal(val)
+// DefaultPublishTimeout is the deadline of a publish made without one. Only
+// publishers that wait themselves keep to it, such as a Manager holding
+// publishes while the broker blocks them; amqp091 ignores the context, so a
+// publish straight to an *amqp.Channel still blocks as long as the broker
+// does.
+const DefaultPublishTimeout = 10 * time.Second
 
+// PublishOption tunes a single publish.
+type PublishOption func(*publishConfig)
+
+type publishConfig struct {
+	ctx           context.Context
+	codec         Codec
+	correlationId string
+	causationId   string
+	schemaVersion int
+	trace         tracing.SpanContext
+	priority      uint8
+	expiration    time.Duration
+
+	compressor        Compressor
+	compressThreshold int
+	cipherKeys        *CipherKeys
+}
+
+// WithContext publishes under ctx, joining any trace in it. A ctx without a
+// deadline gets DefaultPublishTimeout.
+func WithContext(ctx context.Context) PublishOption {
+	return func(p *publishConfig) {
+		p.ctx = ctx
+		if sc := tracing.FromContext(ctx); sc.IsValid() {
+			p.trace = sc
+		}
+	}
+}
+
+// WithCodec picks the encoder for Publish. The default is JSON.
+func WithCodec(c Codec) PublishOption {
+	return func(p *publishConfig) {
+		p.codec = c
+	}
+}
+
+// WithPriority publishes the message with the given priority, which only
+// matters to queues declared WithMaxPriority.
+func WithPriority(priority uint8) PublishOption {
+	return func(p *publishConfig) {
+		p.priority = priority
+	}
+}
+
+// WithExpiration makes the message expire if it hasn't been consumed within
+// d. Expired messages are dead-lettered.
+func WithExpiration(d time.Duration) PublishOption {
+	return func(p *publishConfig) {
+		p.expiration = d
+	}
+}
+
+// Publish encodes val with the configured codec and labels the message with
+// the codec's content type so that subscribers can pick the right decoder.
+// Every message is stamped with a fresh envelope (see Meta) and traced.
+func Publish[T any](ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	msg, config, err := encode(val, opts)
+	if err == nil {
+		ctx, cancel := config.context()
+		span := config.startSpan(exchange, key, &msg)
+		err = ch.PublishWithContext(ctx, exchange, key, false, false, msg)
+		span.SetError(err)
+		span.End()
+		cancel()
+	}
+
+	publishesTotal.With(exchange, routeLabel(key)).Inc()
 	if err != nil {
-		log.Fatalf("Error in marshalling value %v", err)
+		publishErrorsTotal.With(exchange, routeLabel(key)).Inc()
 	}
 
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "json",
-		Body:        marshalledValue,
-	})
+	return err
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var gobedValue bytes.Buffer
-	enc := gob.NewEncoder(&gobedValue)
+// context returns the context to publish under, with the default deadline
+// if it has none.
+func (p publishConfig) context() (context.Context, context.CancelFunc) {
+	ctx := p.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
 
-	if err := enc.Encode(val); err != nil {
-		log.Fatalf("Error in gobbingn value %v", err)
+	return context.WithTimeout(ctx, DefaultPublishTimeout)
+}
+
+// encode builds the stamped message Publish would send for val.
+func encode[T any](val T, opts []PublishOption) (amqp.Publishing, publishConfig, error) {
+	config := publishConfig{codec: JSON, schemaVersion: DefaultSchemaVersion}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	body, err := config.codec.Marshal(val)
+	if err != nil {
+		return amqp.Publishing{}, config, err
 	}
 
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "json",
-		Body:        gobedValue.Bytes(),
-	})
+	body, encoding, err := config.compress(body)
+	if err != nil {
+		return amqp.Publishing{}, config, err
+	}
+
+	body, keyId, err := config.encrypt(body)
+	if err != nil {
+		return amqp.Publishing{}, config, err
+	}
+
+	msg := amqp.Publishing{
+		ContentType:     config.codec.ContentType(),
+		ContentEncoding: encoding,
+		Priority:        config.priority,
+		Body:            body,
+	}
+	if config.expiration > 0 {
+		msg.Expiration = strconv.FormatInt(max(config.expiration.Milliseconds(), 1), 10)
+	}
+	config.stamp(&msg)
+	if keyId != "" {
+		msg.Headers[KeyIdHeader] = keyId
+	}
+
+	return msg, config, nil
+}
+
+func PublishJSON[T any](ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ch, exchange, key, val, append([]PublishOption{WithCodec(JSON)}, opts...)...)
+}
+
+func PublishGob[T any](ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ch, exchange, key, val, append([]PublishOption{WithCodec(Gob)}, opts...)...)
 }
 
-func PublishGameLog(ch *amqp.Channel, message, userName string) AckType {
+// PublishGameLog publishes a game log and returns how the delivery that
+// caused it should be settled. What Ack promises depends on ch: with a
+// ConfirmingPublisher or PublisherPool the broker has confirmed the log,
+// and with an Outbox the log is on disk and will reach the broker later.
+// With a plain channel it only means the log was handed to the connection.
+func PublishGameLog(ch Publisher, message, userName string, opts ...PublishOption) AckType {
 	routingKey := fmt.Sprintf("%s.%s", routing.GameLogSlug, userName)
 
 	if err := PublishGob(ch, routing.ExchangePerilTopic, routingKey, routing.GameLog{
 		CurrentTime: time.Now(),
 		Message:     message,
 		Username:    userName,
-	}); err != nil {
+	}, opts...); err != nil {
 		return NackRequeue
 	}
 
@@ -0,0 +1,131 @@
+package pubsub
+
+import (
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// QueueSpec is everything needed to declare a queue. DeclareAndBind and the
+// topology manifest both build queues from it so that they can never
+// disagree about flags or arguments.
+type QueueSpec struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       amqp.Table
+}
+
+// DefaultDeliveryLimit is how many times a Quorum queue redelivers a
+// requeued message before dead-lettering it.
+const DefaultDeliveryLimit = 10
+
+// DefaultStreamMaxAge is how long a Stream keeps messages.
+const DefaultStreamMaxAge = "7D"
+
+// NewQueueSpec maps a SimpleQueueType onto queue flags and arguments. Every
+// queue but a stream, which can't dead-letter, dead-letters to peril_dlx.
+func NewQueueSpec(name string, queueType SimpleQueueType, opts ...QueueOption) QueueSpec {
+	spec := QueueSpec{
+		Name:       name,
+		Durable:    queueType.durable(),
+		AutoDelete: queueType == Transient,
+		Exclusive:  queueType == Transient,
+		Args: amqp.Table{
+			"x-dead-letter-exchange": routing.ExchangePerilDeadLetter,
+		},
+	}
+
+	switch queueType {
+	case Quorum:
+		spec.Args["x-queue-type"] = "quorum"
+		spec.Args["x-delivery-limit"] = int64(DefaultDeliveryLimit)
+	case Stream:
+		spec.Args = amqp.Table{
+			"x-queue-type": "stream",
+			"x-max-age":    DefaultStreamMaxAge,
+		}
+	}
+
+	for _, opt := range opts {
+		opt(&spec)
+	}
+
+	return spec
+}
+
+// QueueOption sets a queue argument. A queue must always be declared with
+// the same options, so subscriptions and the topology manifest should share
+// them.
+type QueueOption func(*QueueSpec)
+
+// Overflow is what a queue at its length limit does with a new message.
+type Overflow string
+
+const (
+	// OverflowDropHead dead-letters the oldest messages to make room. It is
+	// the default.
+	OverflowDropHead Overflow = "drop-head"
+	// OverflowRejectPublish refuses the new message; a publisher using
+	// confirms gets a nack.
+	OverflowRejectPublish Overflow = "reject-publish"
+	// OverflowRejectPublishDLX refuses the new message and dead-letters it.
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// WithMessageTTL dead-letters messages that have waited in the queue for
+// longer than d.
+func WithMessageTTL(d time.Duration) QueueOption {
+	return func(q *QueueSpec) {
+		q.Args["x-message-ttl"] = d.Milliseconds()
+	}
+}
+
+// WithQueueExpiry deletes the queue once it has gone unused for d.
+func WithQueueExpiry(d time.Duration) QueueOption {
+	return func(q *QueueSpec) {
+		q.Args["x-expires"] = d.Milliseconds()
+	}
+}
+
+// WithMaxLength limits the queue to count ready messages.
+func WithMaxLength(count int) QueueOption {
+	return func(q *QueueSpec) {
+		q.Args["x-max-length"] = int64(count)
+	}
+}
+
+// WithMaxLengthBytes limits the total body size of the queue's ready
+// messages.
+func WithMaxLengthBytes(bytes int) QueueOption {
+	return func(q *QueueSpec) {
+		q.Args["x-max-length-bytes"] = int64(bytes)
+	}
+}
+
+// WithOverflow sets what happens once the queue reaches its length limit.
+func WithOverflow(overflow Overflow) QueueOption {
+	return func(q *QueueSpec) {
+		q.Args["x-overflow"] = string(overflow)
+	}
+}
+
+// WithMaxPriority makes the queue deliver higher priority messages first,
+// for priorities up to max (at most 255; RabbitMQ suggests 10 or less).
+func WithMaxPriority(max uint8) QueueOption {
+	return func(q *QueueSpec) {
+		q.Args["x-max-priority"] = int64(max)
+	}
+}
+
+func (q QueueSpec) Declare(ch Channel) (amqp.Queue, error) {
+	return ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args)
+}
+
+// DeclarePassive checks that the queue exists without creating it. Like
+// RabbitMQ, it ignores the spec's flags and arguments.
+func (q QueueSpec) DeclarePassive(ch Channel) (amqp.Queue, error) {
+	return ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args)
+}
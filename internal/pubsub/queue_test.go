@@ -0,0 +1,106 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// newPolicyQueue declares name with opts, bound to testExchange under
+// name.*, and the dead-letter exchange it dead-letters to.
+func newPolicyQueue(t *testing.T, ch Channel, name string, opts ...QueueOption) {
+	t.Helper()
+
+	if err := DeclareDeadLetter(ch); err != nil {
+		t.Fatal(err)
+	}
+	newDeadLetterQueue(t, ch, name, name+".*", opts...)
+}
+
+func TestQueueTTL(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	newPolicyQueue(t, ch, "timed", WithMessageTTL(time.Hour))
+
+	PublishJSON(ch, testExchange, "timed.alice", "kept")
+	PublishJSON(ch, testExchange, "timed.alice", "expired", WithExpiration(time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+
+	if got := queued(t, ch, "timed"); len(got) != 1 || got[0] != `"kept"` {
+		t.Errorf("queue holds %v", got)
+	}
+	if got := queued(t, ch, routing.QueuePerilDeadLetter); len(got) != 1 || got[0] != `"expired"` {
+		t.Errorf("dead-letter queue holds %v", got)
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	for overflow, want := range map[Overflow]struct {
+		queue, dead string
+		nacked      int
+	}{
+		OverflowDropHead:         {`"1" "2"`, `"0"`, 0},
+		OverflowRejectPublish:    {`"0" "1"`, ``, 1},
+		OverflowRejectPublishDLX: {`"0" "1"`, `"2"`, 1},
+	} {
+		t.Run(string(overflow), func(t *testing.T) {
+			_, conn := newTestBroker(t)
+			ch := newTestChannel(t, conn)
+			newPolicyQueue(t, ch, "full", WithMaxLength(2), WithOverflow(overflow))
+
+			pub := newTestConfirmingPublisher(t, conn)
+			var nacked int
+			for i := 0; i < 3; i++ {
+				err := PublishJSON(pub, testExchange, "full.alice", fmt.Sprint(i))
+				if errors.Is(err, ErrNacked) {
+					nacked++
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := strings.Join(queued(t, ch, "full"), " "); got != want.queue {
+				t.Errorf("queue holds %s, want %s", got, want.queue)
+			}
+			if got := strings.Join(queued(t, ch, routing.QueuePerilDeadLetter), " "); got != want.dead {
+				t.Errorf("dead-letter queue holds %s, want %s", got, want.dead)
+			}
+			if nacked != want.nacked {
+				t.Errorf("%d publishes nacked, want %d", nacked, want.nacked)
+			}
+		})
+	}
+}
+
+func TestQueueMaxLengthBytes(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	newPolicyQueue(t, ch, "small", WithMaxLengthBytes(8))
+
+	for _, body := range []string{"first", "second"} {
+		PublishJSON(ch, testExchange, "small.alice", body)
+	}
+	if got := queued(t, ch, "small"); len(got) != 1 || got[0] != `"second"` {
+		t.Errorf("queue holds %v", got)
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	newPolicyQueue(t, ch, "ranked", WithMaxPriority(5))
+
+	PublishJSON(ch, testExchange, "ranked.alice", "low")
+	PublishJSON(ch, testExchange, "ranked.alice", "capped", WithPriority(200))
+	PublishJSON(ch, testExchange, "ranked.alice", "high", WithPriority(5))
+	PublishJSON(ch, testExchange, "ranked.alice", "middle", WithPriority(3))
+
+	// Priorities above the queue's maximum count as the maximum.
+	if got := strings.Join(queued(t, ch, "ranked"), " "); got != `"capped" "high" "middle" "low"` {
+		t.Errorf("queue delivered %s", got)
+	}
+}
@@ -0,0 +1,482 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const resubscribeTimeout = 5 * time.Second
+
+var (
+	ErrDisconnected  = errors.New("pubsub: broker connection is down")
+	ErrOutageBuffer  = errors.New("pubsub: outage publish buffer is full")
+	ErrManagerClosed = errors.New("pubsub: connection manager is closed")
+)
+
+// OutagePolicy decides what publishing does while the Manager reconnects.
+type OutagePolicy int
+
+const (
+	OutageFail OutagePolicy = iota
+	OutageBuffer
+)
+
+// Manager is a Broker that redials with backoff when the connection drops
+// and resubscribes everything subscribed through it.
+type Manager struct {
+	url        string
+	dial       func(url string) (Broker, error)
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	policy     OutagePolicy
+	bufferSize int
+	flowPolicy FlowPolicy
+	flowBuffer int
+
+	// pubMu is taken before mu, which is never held during network I/O.
+	pubMu sync.Mutex
+
+	mu           sync.Mutex
+	conn         Broker
+	pubCh        Channel
+	ready        chan struct{}
+	done         chan struct{}
+	closed       bool
+	restoring    bool
+	onReconnect  []func(Channel) error
+	buffer       []bufferedPublish
+	subs         int
+	resubscribed chan struct{}
+
+	blockReason string
+	unblocked   chan struct{}
+	flowHeld    int
+	blockings   []*blockingListener
+}
+
+type bufferedPublish struct {
+	exchange  string
+	key       string
+	mandatory bool
+	immediate bool
+	msg       amqp.Publishing
+	held      bool
+}
+
+type ManagerOption func(*Manager)
+
+func WithDialer(dial func(url string) (Broker, error)) ManagerOption {
+	return func(m *Manager) {
+		m.dial = dial
+	}
+}
+
+func WithBackoff(min, max time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.minBackoff = min
+		m.maxBackoff = max
+	}
+}
+
+func WithOutagePolicy(policy OutagePolicy, bufferSize int) ManagerOption {
+	return func(m *Manager) {
+		m.policy = policy
+		m.bufferSize = bufferSize
+	}
+}
+
+// NewManager fails if the first dial does; later ones are retried.
+func NewManager(url string, opts ...ManagerOption) (*Manager, error) {
+	m := &Manager{
+		url:        url,
+		dial:       Dial,
+		minBackoff: 500 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		unblocked:  make(chan struct{}),
+	}
+	close(m.unblocked)
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	conn, err := m.dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	pubCh, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	m.conn = conn
+	m.pubCh = pubCh
+	close(m.ready)
+
+	go m.watch(conn.NotifyClose(make(chan *amqp.Error, 1)))
+	m.watchBlocked(conn)
+
+	return m, nil
+}
+
+// OnReconnect runs fn now and again after every reconnect, before
+// subscriptions are restored.
+func (m *Manager) OnReconnect(fn func(Channel) error) error {
+	ch, err := m.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := fn(ch); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.onReconnect = append(m.onReconnect, fn)
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *Manager) Channel() (Channel, error) {
+	m.mu.Lock()
+	ready := m.ready
+	m.mu.Unlock()
+
+	select {
+	case <-ready:
+	case <-m.done:
+		return nil, ErrManagerClosed
+	}
+
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+
+	if conn == nil {
+		return nil, ErrDisconnected
+	}
+
+	return conn.Channel()
+}
+
+// NotifyClose only reports the manager itself being closed.
+func (m *Manager) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	go func() {
+		<-m.done
+		close(receiver)
+	}()
+
+	return receiver
+}
+
+func (m *Manager) Connected() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.conn != nil
+}
+
+func (m *Manager) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	hold, err := m.admit(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.pubMu.Lock()
+	defer m.pubMu.Unlock()
+
+	m.mu.Lock()
+	if hold && (m.closed || !m.isBlocked()) {
+		// Unblocked (and flushed) in the meantime.
+		m.flowHeld--
+		hold = false
+	}
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+
+	p := bufferedPublish{
+		exchange:  exchange,
+		key:       key,
+		mandatory: mandatory,
+		immediate: immediate,
+		msg:       msg,
+		held:      hold,
+	}
+
+	if hold {
+		m.buffer = append(m.buffer, p)
+		m.mu.Unlock()
+		return nil
+	}
+
+	if m.conn == nil || m.restoring {
+		defer m.mu.Unlock()
+		return m.outage(p)
+	}
+	conn, pubCh := m.conn, m.pubCh
+	m.mu.Unlock()
+
+	err = pubCh.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	if !errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+
+	pubCh, err = conn.Channel()
+
+	m.mu.Lock()
+	if err != nil || m.conn != conn {
+		// The connection is gone, whether or not watch has noticed yet.
+		defer m.mu.Unlock()
+		if err == nil {
+			pubCh.Close()
+		}
+		return m.outage(p)
+	}
+	m.pubCh = pubCh
+	m.mu.Unlock()
+
+	return pubCh.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// outage applies the outage policy to p. The manager lock must be held.
+func (m *Manager) outage(p bufferedPublish) error {
+	if m.policy == OutageFail {
+		return ErrDisconnected
+	}
+	if len(m.buffer) >= m.bufferSize {
+		return ErrOutageBuffer
+	}
+	m.buffer = append(m.buffer, p)
+
+	return nil
+}
+
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+	m.closed = true
+	close(m.done)
+	conn := m.conn
+	m.conn = nil
+	if m.isBlocked() {
+		close(m.unblocked)
+	}
+	for _, l := range m.blockings {
+		l.close()
+	}
+	m.blockings = nil
+	m.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	return conn.Close()
+}
+
+func (m *Manager) watch(closed chan *amqp.Error) {
+	for {
+		select {
+		case err := <-closed:
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			log.Printf("Connection to broker lost: %v", err)
+		case <-m.done:
+			return
+		}
+
+		closed = m.reconnect()
+		if closed == nil {
+			return
+		}
+	}
+}
+
+func (m *Manager) reconnect() chan *amqp.Error {
+	m.mu.Lock()
+	m.conn = nil
+	m.pubCh = nil
+	m.ready = make(chan struct{})
+	m.resubscribed = make(chan struct{}, m.subs)
+	m.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-time.After(backoff(attempt, m.minBackoff, m.maxBackoff)):
+		case <-m.done:
+			return nil
+		}
+
+		conn, err := m.dial(m.url)
+		if err != nil {
+			log.Printf("Reconnect attempt %d failed: %v", attempt+1, err)
+			continue
+		}
+
+		pubCh, err := m.restore(conn)
+		if err != nil {
+			log.Printf("Could not restore topology after reconnect: %v", err)
+			conn.Close()
+			continue
+		}
+
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		m.conn = conn
+		m.pubCh = pubCh
+		m.restoring = true
+		subs, resubscribed := m.subs, m.resubscribed
+		close(m.ready)
+		m.mu.Unlock()
+
+		m.setBlocked(amqp.Blocking{Active: false})
+		m.watchBlocked(conn)
+
+		log.Print("Reconnected to broker")
+
+		// Buffered publishes may target queues that only exist once their
+		// subscriptions are redeclared, so give those a chance first.
+		timeout := time.After(resubscribeTimeout)
+	wait:
+		for i := 0; i < subs; i++ {
+			select {
+			case <-resubscribed:
+			case <-timeout:
+				break wait
+			case <-m.done:
+				return nil
+			}
+		}
+
+		m.pubMu.Lock()
+		m.flush()
+		m.mu.Lock()
+		m.restoring = false
+		m.mu.Unlock()
+		m.pubMu.Unlock()
+
+		return closed
+	}
+}
+
+func (m *Manager) restore(conn Broker) (Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	declarations := append([]func(Channel) error{}, m.onReconnect...)
+	m.mu.Unlock()
+
+	for _, declare := range declarations {
+		if err := declare(ch); err != nil {
+			ch.Close()
+			return nil, err
+		}
+	}
+
+	return ch, nil
+}
+
+// flush requires pubMu but not the manager lock.
+func (m *Manager) flush() {
+	for {
+		m.mu.Lock()
+		if len(m.buffer) == 0 || m.pubCh == nil {
+			m.mu.Unlock()
+			return
+		}
+		p, pubCh := m.buffer[0], m.pubCh
+		m.mu.Unlock()
+
+		if err := pubCh.PublishWithContext(context.Background(), p.exchange, p.key, p.mandatory, p.immediate, p.msg); err != nil {
+			log.Printf("Could not flush buffered publish: %v", err)
+			return
+		}
+
+		m.mu.Lock()
+		m.buffer = m.buffer[1:]
+		if p.held {
+			m.flowHeld--
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *Manager) track() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subs++
+}
+
+func (m *Manager) untrack() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subs--
+}
+
+func (m *Manager) resubscribe(ctx context.Context, start func() (chan *amqp.Error, error)) (chan *amqp.Error, error) {
+	for attempt := 0; ; attempt++ {
+		closed, err := start()
+		if err == nil {
+			m.mu.Lock()
+			resubscribed := m.resubscribed
+			m.mu.Unlock()
+
+			select {
+			case resubscribed <- struct{}{}:
+			default:
+			}
+			return closed, nil
+		}
+		if errors.Is(err, ErrManagerClosed) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		log.Printf("Resubscribe attempt %d failed: %v", attempt+1, err)
+		select {
+		case <-time.After(backoff(attempt, m.minBackoff, m.maxBackoff)):
+		case <-m.done:
+			return nil, ErrManagerClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// backoff jitters so that clients don't reconnect in lockstep.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	d := max
+	if attempt < 32 && min<<attempt > 0 && min<<attempt < max {
+		d = min << attempt
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,173 @@
+package pubsub
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDialer connects to a memory broker, except while it is down, and
+// keeps the latest connection so that a test can drop it.
+type testDialer struct {
+	broker *MemoryBroker
+
+	mu   sync.Mutex
+	down bool
+	conn *MemoryConnection
+}
+
+func (d *testDialer) dial(string) (Broker, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.down {
+		return nil, errors.New("connection refused")
+	}
+	d.conn = d.broker.Connect()
+	return d.conn, nil
+}
+
+// drop cuts the current connection and keeps the broker unreachable until
+// restore.
+func (d *testDialer) drop() {
+	d.mu.Lock()
+	d.down = true
+	conn := d.conn
+	d.mu.Unlock()
+
+	conn.Shutdown("broker restarting")
+}
+
+func (d *testDialer) restore() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.down = false
+}
+
+func newReconnectingManager(t *testing.T, d *testDialer, opts ...ManagerOption) *Manager {
+	t.Helper()
+
+	opts = append([]ManagerOption{WithDialer(d.dial), WithBackoff(time.Millisecond, 5*time.Millisecond)}, opts...)
+	m, err := NewManager("", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	return m
+}
+
+func waitConnected(t *testing.T, m *Manager) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !m.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("never reconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestManagerResubscribes(t *testing.T) {
+	b, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	d := &testDialer{broker: b}
+	m := newReconnectingManager(t, d)
+
+	declared := 0
+	if err := m.OnReconnect(func(ch Channel) error {
+		declared++
+		return ch.ExchangeDeclare("extra", "fanout", true, false, false, false, nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan string, 10)
+	_, err := SubscribeJSON(testContext(t), m, testExchange, "moves", "moves.*", Transient, func(body string) AckType {
+		handled <- body
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PublishJSON(ch, testExchange, "moves.alice", "before")
+	if got := receive(t, handled); got != "before" {
+		t.Fatalf("handled %q", got)
+	}
+
+	d.drop()
+	d.restore()
+	waitConnected(t, m)
+
+	// The transient queue went with the connection; the subscription
+	// declares it again.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		PublishJSON(ch, testExchange, "moves.alice", "after")
+		select {
+		case got := <-handled:
+			if got != "after" {
+				t.Fatalf("handled %q", got)
+			}
+		case <-time.After(10 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("subscription never came back")
+			}
+			continue
+		}
+		break
+	}
+	if declared != 2 {
+		t.Errorf("declarations ran %d times, want 2", declared)
+	}
+}
+
+func TestManagerOutage(t *testing.T) {
+	b, conn := newTestBroker(t)
+	ch := newBatchQueue(t, conn)
+
+	failing := &testDialer{broker: b}
+	m := newReconnectingManager(t, failing)
+	failing.drop()
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("never noticed the connection go")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := PublishJSON(m, testExchange, "batch.ok", "lost"); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("publish while down = %v, want ErrDisconnected", err)
+	}
+
+	buffering := &testDialer{broker: b}
+	m = newReconnectingManager(t, buffering, WithOutagePolicy(OutageBuffer, 2))
+	buffering.drop()
+	for m.Connected() {
+		time.Sleep(time.Millisecond)
+	}
+	for _, body := range []string{"first", "second"} {
+		if err := PublishJSON(m, testExchange, "batch.ok", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := PublishJSON(m, testExchange, "batch.ok", "third"); !errors.Is(err, ErrOutageBuffer) {
+		t.Errorf("publish past the buffer = %v, want ErrOutageBuffer", err)
+	}
+
+	buffering.restore()
+	waitConnected(t, m)
+	deadline = time.Now().Add(5 * time.Second)
+	var got []string
+	for len(got) < 2 && time.Now().Before(deadline) {
+		got = append(got, queued(t, ch, "batch")...)
+		time.Sleep(time.Millisecond)
+	}
+	if len(got) != 2 || got[0] != `"first"` || got[1] != `"second"` {
+		t.Errorf("queue holds %v", got)
+	}
+}
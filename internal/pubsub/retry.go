@@ -0,0 +1,192 @@
+package pubsub
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers carried by a message while it is being retried.
+const (
+	RetryAttemptHeader    = "x-retry-attempt"
+	RetryExchangeHeader   = "x-retry-exchange"
+	RetryRoutingKeyHeader = "x-retry-routing-key"
+)
+
+// retryQueueGrace is how long a transient retry queue outlives its delay
+// once it is idle.
+const retryQueueGrace = time.Minute
+
+// RetryPolicy controls RetryLater. Attempt n waits InitialDelay * 2^(n-1),
+// capped at MaxDelay. Once MaxAttempts retries have been made the delivery is
+// rejected and dead-letters like a NackDiscard. A MaxAttempts of zero retries
+// forever.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	MaxAttempts  int
+}
+
+// DefaultRetryPolicy gives a message about five minutes of retries before
+// it dead-letters, from where cmd/dlq can replay it once whatever kept it
+// failing is fixed.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialDelay: time.Second,
+	MaxDelay:     time.Minute,
+	MaxAttempts:  10,
+}
+
+func WithRetryPolicy(policy RetryPolicy) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.retry = policy
+	}
+}
+
+// Delay returns how long to wait before the given attempt, counting from 1.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return delay
+}
+
+// RetryQueueName is the holding queue for messages from queue waiting delay.
+// There is one per distinct delay, so each queue's TTL applies to all of its
+// messages and they expire in order.
+func RetryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", queue, delay.Milliseconds())
+}
+
+// RetryAttempt returns how many times a delivery has already been retried.
+// Like the other retry headers, the count is only believed on a delivery
+// back from a retry queue, so a publisher can't skip ahead to the last
+// attempt or reset it.
+func RetryAttempt(d amqp.Delivery) int {
+	if !fromRetryQueue(d) {
+		return 0
+	}
+	attempt, _ := argInt(d.Headers, RetryAttemptHeader)
+	return int(attempt)
+}
+
+// originalRoute returns the exchange and routing key a delivery was first
+// published with, looking through any retries it has been through. The retry
+// headers are only believed on a delivery that has just expired out of one
+// of its queue's retry queues, so that a publisher can't use them to pass a
+// message off as sent to a different key.
+func originalRoute(d amqp.Delivery) (string, string) {
+	exchange, ok := d.Headers[RetryExchangeHeader].(string)
+	if !ok || !fromRetryQueue(d) {
+		return d.Exchange, d.RoutingKey
+	}
+	key, _ := d.Headers[RetryRoutingKeyHeader].(string)
+
+	return exchange, key
+}
+
+// fromRetryQueue reports whether the broker dead-lettered d from a retry
+// queue back to the queue named by its routing key, which is how every
+// retried delivery returns.
+func fromRetryQueue(d amqp.Delivery) bool {
+	if d.Exchange != "" {
+		return false
+	}
+
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return false
+	}
+	newest, _ := deaths[0].(amqp.Table)
+	queue, _ := newest["queue"].(string)
+	reason, _ := newest["reason"].(string)
+
+	return reason == "expired" && strings.HasPrefix(queue, d.RoutingKey+".retry.")
+}
+
+// retry parks the delivery in a retry queue whose TTL is the backoff delay.
+// When it expires the broker dead-letters it through the default exchange
+// straight back to this subscription's queue. The delivery is only acked
+// once the broker has confirmed the copy, and requeued if it doesn't.
+func (s *Subscription) retry(delivery amqp.Delivery) {
+	if s.queueType == Stream {
+		log.Printf("Can't retry a message from stream %s, skipping it", s.queue)
+		delivery.Nack(false, false)
+		return
+	}
+
+	policy := s.config.retry
+	attempt := RetryAttempt(delivery) + 1
+
+	if policy.MaxAttempts > 0 && attempt > policy.MaxAttempts {
+		log.Printf("Giving up on message from %s after %d retries", s.queue, policy.MaxAttempts)
+		delivery.Nack(false, false)
+		return
+	}
+
+	delay := policy.Delay(attempt)
+	if err := s.publishRetry(delivery, attempt, delay); err != nil {
+		log.Printf("Could not schedule retry, requeueing instead: %v", err)
+		delivery.Nack(false, true)
+		return
+	}
+	delivery.Ack(false)
+}
+
+func (s *Subscription) publishRetry(delivery amqp.Delivery, attempt int, delay time.Duration) error {
+	spec := QueueSpec{
+		Name:    RetryQueueName(s.queue, delay),
+		Durable: s.queueType.durable(),
+		Args: amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": s.queue,
+		},
+	}
+	if !s.queueType.durable() {
+		spec.Args["x-expires"] = (delay + retryQueueGrace).Milliseconds()
+	}
+
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	exchange, key := originalRoute(delivery)
+	headers[RetryAttemptHeader] = int64(attempt)
+	headers[RetryExchangeHeader] = exchange
+	headers[RetryRoutingKeyHeader] = key
+
+	deliveryMode := amqp.Transient
+	if s.queueType.durable() {
+		deliveryMode = amqp.Persistent
+	}
+
+	if err := s.withSide(func(ch Channel) error {
+		_, err := spec.Declare(ch)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return s.publishConfirmed("", spec.Name, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    deliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	})
+}
@@ -0,0 +1,79 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 40: 10 * time.Second} {
+		if got := policy.Delay(attempt); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestRetryAttempt(t *testing.T) {
+	forged := amqp.Delivery{
+		Exchange:   testExchange,
+		RoutingKey: "moves.alice",
+		Headers:    amqp.Table{RetryAttemptHeader: int64(99)},
+	}
+	if n := RetryAttempt(forged); n != 0 {
+		t.Errorf("RetryAttempt() of a fresh publish = %d, want 0", n)
+	}
+
+	retried := amqp.Delivery{
+		RoutingKey: "moves",
+		Headers: amqp.Table{
+			RetryAttemptHeader: int64(3),
+			"x-death":          []interface{}{amqp.Table{"queue": RetryQueueName("moves", time.Second), "reason": "expired"}},
+		},
+	}
+	if n := RetryAttempt(retried); n != 3 {
+		t.Errorf("RetryAttempt() back from a retry queue = %d, want 3", n)
+	}
+}
+
+// TestRetryGivesUp checks that a message that keeps failing is retried
+// MaxAttempts times and then dead-letters, whatever headers it was
+// published with.
+func TestRetryGivesUp(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	if err := DeclareDeadLetter(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan Meta, 10)
+	_, err := SubscribeDelivery(testContext(t), conn, testExchange, "retried", "retried.*", Durable, func(d Delivery[string]) AckType {
+		handled <- d.Meta
+		return RetryLater
+	}, WithRetryPolicy(RetryPolicy{InitialDelay: 5 * time.Millisecond, MaxAttempts: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forged := amqp.Publishing{
+		Headers:     amqp.Table{RetryAttemptHeader: int64(99)},
+		ContentType: ContentTypeJSON,
+		Body:        []byte(`"again"`),
+	}
+	if err := ch.PublishWithContext(testContext(t), testExchange, "retried.alice", false, false, forged); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if meta := receive(t, handled); meta.RoutingKey != "retried.alice" {
+			t.Errorf("attempt %d routed with %q", i, meta.RoutingKey)
+		}
+	}
+	nothing(t, handled)
+
+	if got := queued(t, ch, routing.QueuePerilDeadLetter); len(got) != 1 {
+		t.Errorf("dead-letter queue holds %v", got)
+	}
+}
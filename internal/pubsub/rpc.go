@@ -0,0 +1,324 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RPCErrorHeader carries the error returned by a Serve handler.
+const RPCErrorHeader = "x-rpc-error"
+
+const directReplyTo = "amq.rabbitmq.reply-to"
+
+const defaultCallTimeout = 10 * time.Second
+
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "pubsub: remote: " + e.Message
+}
+
+// RPCClient is safe for concurrent use and reopens its channel if the broker
+// closes it.
+type RPCClient struct {
+	broker  Broker
+	timeout time.Duration
+
+	mu      sync.Mutex
+	ch      Channel
+	replyTo string
+	pending map[string]chan rpcReply
+	closed  bool
+}
+
+type rpcReply struct {
+	delivery amqp.Delivery
+	err      error
+}
+
+type RPCOption func(*RPCClient)
+
+// WithCallTimeout bounds calls whose context has no deadline.
+func WithCallTimeout(d time.Duration) RPCOption {
+	return func(c *RPCClient) {
+		c.timeout = d
+	}
+}
+
+func NewRPCClient(broker Broker, opts ...RPCOption) (*RPCClient, error) {
+	c := &RPCClient{
+		broker:  broker,
+		timeout: defaultCallTimeout,
+		pending: map[string]chan rpcReply{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Call publishes req and waits for the reply. It fails with a *ReturnedError
+// if no server is listening and a *RemoteError if the server's handler fails.
+func Call[Req, Resp any](ctx context.Context, c *RPCClient, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	opts = append([]PublishOption{WithTraceContext(ctx)}, opts...)
+	msg, config, err := encode(req, opts)
+	if err != nil {
+		return resp, err
+	}
+
+	span := config.startSpan(exchange, key, &msg)
+	defer span.End()
+
+	reply, err := c.call(ctx, exchange, key, msg)
+	if err == nil {
+		if remote, ok := reply.Headers[RPCErrorHeader].(string); ok {
+			err = &RemoteError{Message: remote}
+		}
+	}
+	span.SetError(err)
+	if err != nil {
+		return resp, err
+	}
+
+	body, err := Decompress(reply.ContentEncoding, reply.Body)
+	if err == nil {
+		err = decoderFor(reply.ContentType, JSON).Unmarshal(body, &resp)
+	}
+
+	return resp, err
+}
+
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closed = true
+
+	if c.ch == nil {
+		return nil
+	}
+
+	return c.ch.Close()
+}
+
+func (c *RPCClient) call(ctx context.Context, exchange, key string, msg amqp.Publishing) (amqp.Delivery, error) {
+	replies := make(chan rpcReply, 1)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return amqp.Delivery{}, amqp.ErrClosed
+	}
+	if c.ch == nil {
+		if err := c.open(); err != nil {
+			c.mu.Unlock()
+			return amqp.Delivery{}, err
+		}
+	}
+
+	// A request nobody picks up in time is useless, so let it expire.
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Expiration = strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10)
+	}
+	msg.ReplyTo = c.replyTo
+
+	c.pending[msg.MessageId] = replies
+	err := c.ch.PublishWithContext(ctx, exchange, key, true, false, msg)
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, msg.MessageId)
+		c.mu.Unlock()
+	}()
+
+	if err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	select {
+	case reply := <-replies:
+		return reply.delivery, reply.err
+	case <-ctx.Done():
+		return amqp.Delivery{}, ctx.Err()
+	}
+}
+
+// open starts consuming replies, preferring direct reply-to, which needs
+// requests published on the same channel. The client lock must be held.
+func (c *RPCClient) open() error {
+	ch, err := c.broker.Channel()
+	if err != nil {
+		return err
+	}
+
+	replyTo := directReplyTo
+	deliveries, err := ch.Consume(replyTo, "", true, false, false, false, nil)
+	if err != nil {
+		// The failed consume may have closed the channel.
+		ch.Close()
+		if ch, err = c.broker.Channel(); err != nil {
+			return err
+		}
+
+		q, err := ch.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			ch.Close()
+			return err
+		}
+		replyTo = q.Name
+
+		if deliveries, err = ch.Consume(replyTo, "", true, true, false, false, nil); err != nil {
+			ch.Close()
+			return err
+		}
+	}
+
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	go c.listen(ch, deliveries, returns)
+
+	c.ch = ch
+	c.replyTo = replyTo
+
+	return nil
+}
+
+// listen matches replies to calls by their causation ID.
+func (c *RPCClient) listen(ch Channel, deliveries <-chan amqp.Delivery, returns chan amqp.Return) {
+	for deliveries != nil || returns != nil {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				deliveries = nil
+				continue
+			}
+			id, _ := d.Headers[CausationIdHeader].(string)
+			c.resolve(id, rpcReply{delivery: d})
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.resolve(r.MessageId, rpcReply{err: &ReturnedError{
+				Exchange: r.Exchange,
+				Key:      r.RoutingKey,
+				Code:     r.ReplyCode,
+				Reason:   r.ReplyText,
+			}})
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ch == ch {
+		c.ch = nil
+	}
+	for id, replies := range c.pending {
+		replies <- rpcReply{err: amqp.ErrClosed}
+		delete(c.pending, id)
+	}
+}
+
+func (c *RPCClient) resolve(id string, reply rpcReply) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if replies, ok := c.pending[id]; ok {
+		replies <- reply
+		delete(c.pending, id)
+	}
+}
+
+// Serve answers Calls sent to queueName, acking each request once it is
+// answered, whether or not the handler failed.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(Delivery[Req]) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	var sub *Subscription
+	ready := make(chan struct{})
+
+	sub, err := SubscribeDelivery(ctx, broker, exchange, queueName, key, queueType, func(d Delivery[Req]) AckType {
+		<-ready
+
+		if d.Meta.ReplyTo == "" {
+			log.Printf("Dropping request %s on %s with no reply-to", d.Meta.MessageId, queueName)
+			return NackDiscard
+		}
+
+		resp, err := handler(d)
+		if err := sub.reply(d.Meta, resp, err); err != nil {
+			log.Printf("Could not reply to request %s: %v", d.Meta.MessageId, err)
+		}
+
+		return Ack
+	}, opts...)
+	close(ready)
+
+	return sub, err
+}
+
+func (s *Subscription) reply(request Meta, resp any, handlerErr error) error {
+	codec, ok := CodecFor(request.ContentType)
+	if !ok {
+		codec = s.config.codec
+	}
+
+	msg := amqp.Publishing{}
+	if handlerErr != nil {
+		msg.Headers = amqp.Table{RPCErrorHeader: handlerErr.Error()}
+	} else {
+		body, err := codec.Marshal(resp)
+		if err != nil {
+			return fmt.Errorf("encoding reply: %w", err)
+		}
+		msg.ContentType = codec.ContentType()
+		msg.Body = body
+	}
+
+	config := publishConfig{schemaVersion: DefaultSchemaVersion}
+	WithCausedBy(request)(&config)
+	config.stamp(&msg)
+
+	span := config.startSpan("", request.ReplyTo, &msg)
+	defer span.End()
+
+	err := s.publishSide(context.Background(), "", request.ReplyTo, msg)
+	span.SetError(err)
+
+	return err
+}
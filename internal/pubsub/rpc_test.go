@@ -0,0 +1,123 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+const rpcExchange = "rpc"
+
+type statusRequest struct {
+	Player string
+}
+
+type statusReply struct {
+	Player string
+	Units  int
+}
+
+// serveStatus answers "status" requests with handler and returns a client
+// to call it with.
+func serveStatus(t *testing.T, handler func(Delivery[statusRequest]) (statusReply, error), opts ...RPCOption) *RPCClient {
+	t.Helper()
+
+	_, conn := newTestBroker(t)
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare(rpcExchange, "direct", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Serve(testContext(t), conn, rpcExchange, "status", "status", Durable, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewRPCClient(conn, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestCall(t *testing.T) {
+	client := serveStatus(t, func(d Delivery[statusRequest]) (statusReply, error) {
+		return statusReply{Player: d.Body.Player, Units: len(d.Body.Player)}, nil
+	})
+
+	for _, codec := range []Codec{JSON, Gob, MsgPack} {
+		resp, err := Call[statusRequest, statusReply](context.Background(), client, rpcExchange, "status", statusRequest{Player: "alice"}, WithCodec(codec))
+		if err != nil {
+			t.Fatalf("%s: %v", codec.ContentType(), err)
+		}
+		if resp != (statusReply{Player: "alice", Units: 5}) {
+			t.Errorf("%s: reply %+v", codec.ContentType(), resp)
+		}
+	}
+}
+
+func TestCallConcurrent(t *testing.T) {
+	client := serveStatus(t, func(d Delivery[statusRequest]) (statusReply, error) {
+		return statusReply{Player: d.Body.Player}, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(player string) {
+			defer wg.Done()
+			resp, err := Call[statusRequest, statusReply](context.Background(), client, rpcExchange, "status", statusRequest{Player: player})
+			if err != nil {
+				t.Error(err)
+			} else if resp.Player != player {
+				t.Errorf("call for %s got the reply for %s", player, resp.Player)
+			}
+		}(fmt.Sprintf("p%d", i))
+	}
+	wg.Wait()
+}
+
+func TestCallRemoteError(t *testing.T) {
+	client := serveStatus(t, func(d Delivery[statusRequest]) (statusReply, error) {
+		return statusReply{}, fmt.Errorf("no such player %s", d.Body.Player)
+	})
+
+	_, err := Call[statusRequest, statusReply](context.Background(), client, rpcExchange, "status", statusRequest{Player: "mallory"})
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Message != "no such player mallory" {
+		t.Errorf("Call() = %v, want the handler's error", err)
+	}
+}
+
+func TestCallNoServer(t *testing.T) {
+	client := serveStatus(t, func(d Delivery[statusRequest]) (statusReply, error) {
+		return statusReply{}, nil
+	})
+
+	_, err := Call[statusRequest, statusReply](context.Background(), client, rpcExchange, "nobody", statusRequest{})
+	var returned *ReturnedError
+	if !errors.As(err, &returned) {
+		t.Errorf("Call() = %v, want a *ReturnedError", err)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+	client := serveStatus(t, func(d Delivery[statusRequest]) (statusReply, error) {
+		<-stuck
+		return statusReply{}, nil
+	}, WithCallTimeout(20*time.Millisecond))
+
+	_, err := Call[statusRequest, statusReply](context.Background(), client, rpcExchange, "status", statusRequest{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Call() = %v, want DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,433 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Signing headers. The signature is ed25519 over the signer, the routing
+// key, the envelope (message, correlation and causation IDs, schema
+// version), how the body is encoded (content type and encoding, cipher key
+// id) and the body exactly as published, so a signed message can't be
+// re-addressed, replayed under another ID or altered.
+const (
+	SignerHeader    = "x-signer"
+	SignatureHeader = "x-signature"
+)
+
+var (
+	// ErrUnsigned is a delivery without a signature.
+	ErrUnsigned = errors.New("pubsub: message is not signed")
+	// ErrBadSignature is a delivery whose signature doesn't match its
+	// signer's key.
+	ErrBadSignature = errors.New("pubsub: bad message signature")
+	// ErrUnknownSigner is returned by a KeyStore that has no key for a
+	// signer.
+	ErrUnknownSigner = errors.New("pubsub: unknown signer")
+	// ErrSignerTaken is returned when registering a different key for a
+	// signer that already has one.
+	ErrSignerTaken = errors.New("pubsub: signer already has a different key")
+)
+
+// Signer signs messages as one identity, such as a player.
+type Signer struct {
+	id  string
+	key ed25519.PrivateKey
+}
+
+func NewSigner(id string, key ed25519.PrivateKey) *Signer {
+	return &Signer{id: id, key: key}
+}
+
+func (s *Signer) Id() string {
+	return s.id
+}
+
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// LoadOrCreateKey reads an ed25519 private key from path, generating and
+// saving a new one, readable only by the owner, if there is none.
+func LoadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := os.ReadFile(path)
+	if err == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("pubsub: %s is not an ed25519 key", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, key.Seed(), 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+type signingPublisher struct {
+	Publisher
+	signer *Signer
+}
+
+// NewSigningPublisher wraps pub so that every message it publishes is signed
+// by signer.
+func NewSigningPublisher(pub Publisher, signer *Signer) Publisher {
+	return signingPublisher{Publisher: pub, signer: signer}
+}
+
+func (p signingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[SignerHeader] = p.signer.id
+	msg.Headers = headers
+	headers[SignatureHeader] = base64.StdEncoding.EncodeToString(ed25519.Sign(p.signer.key, signedContent(p.signer.id, key, msg)))
+
+	return p.Publisher.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// signedContentVersion is bumped whenever signedContent changes, so that an
+// old signature can never match content laid out differently.
+const signedContentVersion = "peril-sig-v2"
+
+// signedContent lays out everything the signature covers, each field length
+// prefixed so that no two messages share an encoding.
+func signedContent(signer, key string, msg amqp.Publishing) []byte {
+	causationId, _ := msg.Headers[CausationIdHeader].(string)
+	keyId, _ := msg.Headers[KeyIdHeader].(string)
+	version, _ := argInt(msg.Headers, SchemaVersionHeader)
+
+	var b []byte
+	for _, field := range [][]byte{
+		[]byte(signedContentVersion),
+		[]byte(signer),
+		[]byte(key),
+		[]byte(msg.MessageId),
+		[]byte(msg.CorrelationId),
+		[]byte(causationId),
+		[]byte(strconv.FormatInt(version, 10)),
+		[]byte(msg.ContentType),
+		[]byte(msg.ContentEncoding),
+		[]byte(keyId),
+		msg.Body,
+	} {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(field)))
+		b = append(b, field...)
+	}
+
+	return b
+}
+
+// KeyStore finds the public key of a signer. It returns ErrUnknownSigner
+// for signers it has no key for.
+type KeyStore interface {
+	PublicKey(id string) (ed25519.PublicKey, error)
+}
+
+// WithVerification makes the subscription check every delivery's signature
+// against keys before decoding it. Unsigned and forged deliveries are
+// dead-lettered. Deliveries whose key can't be looked up right now, or whose
+// signer keys doesn't know yet, are retried a few times in case the signer
+// has only just registered, and then dead-lettered too. The verified signer
+// is in Meta.Signer.
+func WithVerification(keys KeyStore) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.keys = keys
+	}
+}
+
+// RequireSigner rejects deliveries not signed by the identity claimant
+// finds in the payload, such as the player a move claims to be from. Use it
+// with WithVerification.
+func RequireSigner[T any](claimant func(T) string) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) AckType {
+			if claimed := claimant(d.Body); d.Meta.Signer == "" || d.Meta.Signer != claimed {
+				log.Printf("Rejecting message %s on %s: signed by %q but claims to be from %q", d.Meta.MessageId, d.Meta.Queue, d.Meta.Signer, claimed)
+				forgeriesTotal.With(d.Meta.Queue).Inc()
+				return NackDiscard
+			}
+
+			return next(d)
+		}
+	}
+}
+
+// Verify checks a delivery's signature and returns who signed it. The
+// routing key checked is the one the message was first published with, so
+// messages coming back from a retry queue still verify.
+func Verify(keys KeyStore, d amqp.Delivery) (string, error) {
+	signer, _ := d.Headers[SignerHeader].(string)
+	encoded, _ := d.Headers[SignatureHeader].(string)
+	if signer == "" || encoded == "" {
+		return "", ErrUnsigned
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return signer, ErrBadSignature
+	}
+
+	key, err := keys.PublicKey(signer)
+	if err != nil {
+		return signer, err
+	}
+
+	_, routingKey := originalRoute(d)
+	msg := amqp.Publishing{
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		CorrelationId:   d.CorrelationId,
+		MessageId:       d.MessageId,
+		Body:            d.Body,
+	}
+	if !ed25519.Verify(key, signedContent(signer, routingKey, msg), signature) {
+		return signer, ErrBadSignature
+	}
+
+	return signer, nil
+}
+
+// verifyRetries is how many times a delivery whose signer can't be found
+// is retried before it is dead-lettered, whatever the retry policy.
+const verifyRetries = 5
+
+// verify checks a delivery for a subscription WithVerification and settles
+// it if it fails.
+func (s *Subscription) verify(delivery amqp.Delivery) (string, bool) {
+	signer, err := Verify(s.config.keys, delivery)
+	if err == nil {
+		return signer, true
+	}
+
+	// A signer the store doesn't know yet may have only just registered,
+	// perhaps with another server, so the delivery is retried below rather
+	// than thrown away.
+	if errors.Is(err, ErrUnsigned) || errors.Is(err, ErrBadSignature) {
+		log.Printf("Rejecting message %s on %s from %q: %v", delivery.MessageId, s.queue, signer, err)
+		forgeriesTotal.With(s.queue).Inc()
+		delivery.Nack(false, false)
+		return "", false
+	}
+
+	if RetryAttempt(delivery) >= verifyRetries {
+		log.Printf("Giving up on verifying message %s on %s after %d retries: %v", delivery.MessageId, s.queue, verifyRetries, err)
+		delivery.Nack(false, false)
+		return "", false
+	}
+
+	log.Printf("Could not verify message %s on %s, retrying: %v", delivery.MessageId, s.queue, err)
+	s.retry(delivery)
+	return "", false
+}
+
+// KeyRing is a KeyStore that signers register with. The first key
+// registered for a signer is the only one accepted for it afterwards. It is
+// safe for concurrent use.
+//
+// A ring saved to a file is shared by every process that opens the file:
+// registrations are made under a lock file, "<path>.lock", against the
+// latest contents, and a lookup that misses reloads the file if another
+// process has changed it.
+type KeyRing struct {
+	path string
+	lock *fileLock
+
+	mu   sync.RWMutex
+	keys map[string]ed25519.PublicKey
+	// loaded is the file as last read, to tell when it has changed.
+	loaded os.FileInfo
+}
+
+// NewKeyRing returns a key ring saved to path, loading any keys already
+// there. An empty path keeps the keys in memory only.
+func NewKeyRing(path string) (*KeyRing, error) {
+	r := &KeyRing{path: path, keys: map[string]ed25519.PublicKey{}}
+	if path == "" {
+		return r, nil
+	}
+
+	lock, err := openFileLock(path+".lock", 1)
+	if err != nil {
+		return nil, err
+	}
+	r.lock = lock
+
+	if err := r.load(); err != nil {
+		lock.close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *KeyRing) PublicKey(id string) (ed25519.PublicKey, error) {
+	r.mu.RLock()
+	key, ok := r.keys[id]
+	r.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	// Another process may have registered it since.
+	if r.path != "" {
+		r.mu.Lock()
+		err := r.load()
+		key, ok = r.keys[id]
+		r.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, ErrUnknownSigner
+	}
+
+	return key, nil
+}
+
+// Register records key for id. Registering the same key again is fine; a
+// different one fails with ErrSignerTaken. Whether a signer may register at
+// all is up to the caller.
+func (r *KeyRing) Register(id string, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("pubsub: key for %q is %d bytes, not %d", id, len(key), ed25519.PublicKeySize)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.path != "" {
+		unlock, err := r.lock.lock(0, true)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if err := r.load(); err != nil {
+			return err
+		}
+	}
+
+	if existing, ok := r.keys[id]; ok {
+		if !existing.Equal(key) {
+			return ErrSignerTaken
+		}
+		return nil
+	}
+	r.keys[id] = key
+
+	if err := r.save(); err != nil {
+		delete(r.keys, id)
+		return err
+	}
+
+	return nil
+}
+
+func (r *KeyRing) Close() error {
+	if r.lock == nil {
+		return nil
+	}
+
+	return r.lock.close()
+}
+
+// load reads the file if it has changed since it was last read. The ring
+// lock must be held.
+func (r *KeyRing) load() error {
+	info, err := os.Stat(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.loaded != nil && os.SameFile(info, r.loaded) && info.ModTime().Equal(r.loaded.ModTime()) && info.Size() == r.loaded.Size() {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	var saved map[string][]byte
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("pubsub: reading key ring %s: %w", r.path, err)
+	}
+	for id, key := range saved {
+		r.keys[id] = key
+	}
+	r.loaded = info
+
+	return nil
+}
+
+// save writes the ring to its file, atomically. The ring lock and the file
+// lock must be held.
+func (r *KeyRing) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	saved := make(map[string][]byte, len(r.keys))
+	for id, key := range r.keys {
+		saved[id] = key
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return err
+	}
+
+	// Our own write is not news.
+	if info, err := os.Stat(r.path); err == nil {
+		r.loaded = info
+	}
+
+	return nil
+}
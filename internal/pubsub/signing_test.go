@@ -0,0 +1,263 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// recordingPublisher keeps the last message published through it.
+type recordingPublisher struct {
+	key string
+	msg amqp.Publishing
+}
+
+func (p *recordingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.key = key
+	p.msg = msg
+	return nil
+}
+
+func newTestSigner(t *testing.T, id string) *Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewSigner(id, key)
+}
+
+// signedDelivery is what a subscriber on testExchange gets for val published
+// with key, signed by signer.
+func signedDelivery(t *testing.T, signer *Signer, key string, val any, opts ...PublishOption) amqp.Delivery {
+	t.Helper()
+
+	rec := &recordingPublisher{}
+	if err := Publish(NewSigningPublisher(rec, signer), testExchange, key, val, opts...); err != nil {
+		t.Fatal(err)
+	}
+
+	return amqp.Delivery{
+		Exchange:        testExchange,
+		RoutingKey:      rec.key,
+		Headers:         rec.msg.Headers,
+		ContentType:     rec.msg.ContentType,
+		ContentEncoding: rec.msg.ContentEncoding,
+		CorrelationId:   rec.msg.CorrelationId,
+		MessageId:       rec.msg.MessageId,
+		Body:            rec.msg.Body,
+	}
+}
+
+func TestVerify(t *testing.T) {
+	alice := newTestSigner(t, "alice")
+	bob := newTestSigner(t, "bob")
+	ring, _ := NewKeyRing("")
+	ring.Register("alice", alice.PublicKey())
+	ring.Register("bob", bob.PublicKey())
+
+	signer, err := Verify(ring, signedDelivery(t, alice, "moves.alice", "hello"))
+	if err != nil || signer != "alice" {
+		t.Fatalf("Verify() = %q, %v", signer, err)
+	}
+
+	tampered := map[string]func(d *amqp.Delivery){
+		"routing key":      func(d *amqp.Delivery) { d.RoutingKey = "moves.bob" },
+		"message id":       func(d *amqp.Delivery) { d.MessageId = NewMessageId() },
+		"correlation id":   func(d *amqp.Delivery) { d.CorrelationId = "other" },
+		"causation id":     func(d *amqp.Delivery) { d.Headers[CausationIdHeader] = "other" },
+		"schema version":   func(d *amqp.Delivery) { d.Headers[SchemaVersionHeader] = int64(99) },
+		"content type":     func(d *amqp.Delivery) { d.ContentType = ContentTypeGob },
+		"content encoding": func(d *amqp.Delivery) { d.ContentEncoding = "gzip" },
+		"key id":           func(d *amqp.Delivery) { d.Headers[KeyIdHeader] = "logs-2" },
+		"body":             func(d *amqp.Delivery) { d.Body = append(d.Body, ' ') },
+		"signer":           func(d *amqp.Delivery) { d.Headers[SignerHeader] = "bob" },
+		"signature":        func(d *amqp.Delivery) { d.Headers[SignatureHeader] = "not base64!" },
+		// Retry headers only count on a delivery back from a retry queue.
+		"retry headers": func(d *amqp.Delivery) {
+			d.RoutingKey = "moves.bob"
+			d.Headers[RetryExchangeHeader] = testExchange
+			d.Headers[RetryRoutingKeyHeader] = "moves.alice"
+		},
+	}
+	for name, tamper := range tampered {
+		d := signedDelivery(t, alice, "moves.alice", "hello")
+		tamper(&d)
+		if _, err := Verify(ring, d); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("%s: Verify() = %v, want ErrBadSignature", name, err)
+		}
+	}
+
+	d := signedDelivery(t, alice, "moves.alice", "hello")
+	delete(d.Headers, SignatureHeader)
+	if _, err := Verify(ring, d); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned: Verify() = %v, want ErrUnsigned", err)
+	}
+
+	if _, err := Verify(ring, signedDelivery(t, newTestSigner(t, "carol"), "moves.carol", "hello")); !errors.Is(err, ErrUnknownSigner) {
+		t.Errorf("unknown signer: Verify() = %v, want ErrUnknownSigner", err)
+	}
+}
+
+// TestVerifyRetried checks that a delivery back from a retry queue is
+// verified against the key it was first published with.
+func TestVerifyRetried(t *testing.T) {
+	alice := newTestSigner(t, "alice")
+	ring, _ := NewKeyRing("")
+	ring.Register("alice", alice.PublicKey())
+
+	d := signedDelivery(t, alice, "moves.alice", "hello")
+	d.Exchange = ""
+	d.RoutingKey = "moves"
+	d.Headers[RetryExchangeHeader] = testExchange
+	d.Headers[RetryRoutingKeyHeader] = "moves.alice"
+	d.Headers["x-death"] = []interface{}{amqp.Table{"queue": RetryQueueName("moves", time.Second), "reason": "expired"}}
+
+	if _, err := Verify(ring, d); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+}
+
+func TestVerificationSubscription(t *testing.T) {
+	_, conn := newTestBroker(t)
+	alice := newTestSigner(t, "alice")
+	mallory := newTestSigner(t, "mallory")
+	ring, _ := NewKeyRing("")
+	ring.Register("mallory", mallory.PublicKey())
+
+	type move struct {
+		Player string
+	}
+	handled := make(chan Delivery[move], 10)
+	_, err := SubscribeDelivery(testContext(t), conn, testExchange, "moves", "moves.*", Transient, func(d Delivery[move]) AckType {
+		handled <- d
+		return Ack
+	},
+		WithVerification(ring),
+		WithRetryPolicy(RetryPolicy{InitialDelay: 10 * time.Millisecond}),
+		WithMiddleware(RequireSigner(func(m move) string { return m.Player })),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unsigned, and signed by one player claiming to be another.
+	PublishJSON(ch, testExchange, "moves.alice", move{Player: "alice"})
+	PublishJSON(NewSigningPublisher(ch, mallory), testExchange, "moves.alice", move{Player: "alice"})
+	nothing(t, handled)
+
+	// alice isn't registered yet, so her move waits until she is.
+	PublishJSON(NewSigningPublisher(ch, alice), testExchange, "moves.alice", move{Player: "alice"})
+	nothing(t, handled)
+	ring.Register("alice", alice.PublicKey())
+
+	d := receive(t, handled)
+	if d.Meta.Signer != "alice" || d.Meta.RoutingKey != "moves.alice" {
+		t.Errorf("handled a move signed by %q routed with %q", d.Meta.Signer, d.Meta.RoutingKey)
+	}
+	nothing(t, handled)
+}
+
+// TestVerificationGivesUp checks that a delivery from a signer who never
+// registers dead-letters after a few retries, even under a policy that
+// retries forever.
+func TestVerificationGivesUp(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	if err := DeclareDeadLetter(ch); err != nil {
+		t.Fatal(err)
+	}
+	ring, _ := NewKeyRing("")
+
+	handled := make(chan string, 1)
+	_, err := Subscribe(testContext(t), conn, testExchange, "moves", "moves.*", Durable, func(body string) AckType {
+		handled <- body
+		return Ack
+	},
+		WithVerification(ring),
+		WithRetryPolicy(RetryPolicy{InitialDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PublishJSON(NewSigningPublisher(ch, newTestSigner(t, "nobody")), testExchange, "moves.nobody", "move"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(queued(t, ch, routing.QueuePerilDeadLetter)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("never dead-lettered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	nothing(t, handled)
+}
+
+func TestKeyRingShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	a, err := NewKeyRing(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewKeyRing(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	alice := newTestSigner(t, "alice")
+	if err := a.Register("alice", alice.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := b.PublicKey("alice"); err != nil || !key.Equal(alice.PublicKey()) {
+		t.Errorf("other ring: PublicKey() = %v, %v", key, err)
+	}
+	if err := b.Register("alice", newTestSigner(t, "alice").PublicKey()); !errors.Is(err, ErrSignerTaken) {
+		t.Errorf("registering a second key = %v, want ErrSignerTaken", err)
+	}
+	if err := b.Register("alice", alice.PublicKey()); err != nil {
+		t.Errorf("registering the same key again = %v", err)
+	}
+
+	// Rings racing to register keep each other's keys.
+	var wg sync.WaitGroup
+	for i, r := range []*KeyRing{a, b} {
+		for j := 0; j < 4; j++ {
+			id := fmt.Sprintf("p%d-%d", i, j)
+			key := newTestSigner(t, id).PublicKey()
+			wg.Add(1)
+			go func(r *KeyRing) {
+				defer wg.Done()
+				if err := r.Register(id, key); err != nil {
+					t.Error(err)
+				}
+			}(r)
+		}
+	}
+	wg.Wait()
+
+	reopened, err := NewKeyRing(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if n := len(reopened.keys); n != 9 {
+		t.Errorf("saved ring has %d keys, want 9", n)
+	}
+}
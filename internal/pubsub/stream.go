@@ -0,0 +1,73 @@
+package pubsub
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const StreamOffsetHeader = "x-stream-offset"
+
+// StreamOffset is where a subscription to a Stream starts reading.
+type StreamOffset struct {
+	arg any
+}
+
+var (
+	StreamFirst = StreamOffset{arg: "first"}
+	// StreamLast starts at the last chunk written, a little before the
+	// newest message.
+	StreamLast = StreamOffset{arg: "last"}
+	StreamNext = StreamOffset{arg: "next"}
+)
+
+func StreamAt(offset int64) StreamOffset {
+	return StreamOffset{arg: offset}
+}
+
+// StreamSince may also return a few messages from before t.
+func StreamSince(t time.Time) StreamOffset {
+	return StreamOffset{arg: t}
+}
+
+// WithStreamOffset defaults to StreamNext. A subscription that reconnects
+// carries on after the last message it handled instead.
+func WithStreamOffset(offset StreamOffset) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.streamOffset = offset
+	}
+}
+
+func StreamOffsetOf(d amqp.Delivery) (int64, bool) {
+	return argInt(d.Headers, StreamOffsetHeader)
+}
+
+func (s *Subscription) consumeArgs() amqp.Table {
+	if s.queueType != Stream {
+		return nil
+	}
+
+	if next := s.streamNext.Load(); next > 0 {
+		return amqp.Table{StreamOffsetHeader: next}
+	}
+	if s.config.streamOffset.arg != nil {
+		return amqp.Table{StreamOffsetHeader: s.config.streamOffset.arg}
+	}
+
+	return nil
+}
+
+// handledStream only moves forwards, as workers may finish out of order.
+func (s *Subscription) handledStream(d amqp.Delivery) {
+	offset, ok := StreamOffsetOf(d)
+	if !ok {
+		return
+	}
+
+	for {
+		next := s.streamNext.Load()
+		if offset < next || s.streamNext.CompareAndSwap(next, offset+1) {
+			return
+		}
+	}
+}
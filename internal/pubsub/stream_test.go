@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// newTestStream declares a stream bound to testExchange holding "0" up to
+// count-1.
+func newTestStream(t *testing.T, ch Channel, name string, count int) {
+	t.Helper()
+
+	if _, err := NewQueueSpec(name, Stream).Declare(ch); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind(name, name+".*", testExchange, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		PublishJSON(ch, testExchange, name+".alice", fmt.Sprint(i))
+	}
+}
+
+// readUntil collects bodies from handled up to and including last.
+func readUntil(t *testing.T, handled <-chan string, last string) []string {
+	t.Helper()
+
+	var got []string
+	for {
+		body := receive(t, handled)
+		got = append(got, body)
+		if body == last {
+			return got
+		}
+	}
+}
+
+func TestStreamOffsets(t *testing.T) {
+	for name, tc := range map[string]struct {
+		offset StreamOffset
+		want   string
+	}{
+		"first":   {StreamFirst, "0 1 2 3"},
+		"at":      {StreamAt(1), "1 2 3"},
+		"since":   {StreamSince(time.Now().Add(time.Hour)), "3"},
+		"next":    {StreamNext, "3"},
+		"default": {StreamOffset{}, "3"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, conn := newTestBroker(t)
+			ch := newTestChannel(t, conn)
+			newTestStream(t, ch, "history", 3)
+
+			handled := make(chan string, 10)
+			_, err := Subscribe(testContext(t), conn, testExchange, "history", "history.*", Stream, func(body string) AckType {
+				handled <- body
+				return Ack
+			}, WithStreamOffset(tc.offset))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			PublishJSON(ch, testExchange, "history.alice", "3")
+			if got := strings.Join(readUntil(t, handled, "3"), " "); got != tc.want {
+				t.Errorf("read %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestStreamResumes checks that a stream subscription that reconnects
+// carries on after the last message it handled rather than from its
+// starting offset.
+func TestStreamResumes(t *testing.T) {
+	b, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	newTestStream(t, ch, "history", 2)
+
+	d := &testDialer{broker: b}
+	m := newReconnectingManager(t, d)
+
+	handled := make(chan string, 10)
+	_, err := Subscribe(testContext(t), m, testExchange, "history", "history.*", Stream, func(body string) AckType {
+		handled <- body
+		return Ack
+	}, WithStreamOffset(StreamFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, handled, "1")
+
+	d.drop()
+	PublishJSON(ch, testExchange, "history.alice", "2")
+	d.restore()
+	waitConnected(t, m)
+
+	if got := strings.Join(readUntil(t, handled, "2"), " "); got != "2" {
+		t.Errorf("read %s after reconnecting, want 2", got)
+	}
+}
+
+// TestQuorumDeliveryLimit checks that a quorum queue dead-letters a message
+// its consumers keep requeueing.
+func TestQuorumDeliveryLimit(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+	if err := DeclareDeadLetter(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan string, 2*DefaultDeliveryLimit)
+	_, err := Subscribe(testContext(t), conn, testExchange, "requeued", "requeued.*", Quorum, func(body string) AckType {
+		handled <- body
+		return NackRequeue
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PublishJSON(ch, testExchange, "requeued.alice", "stuck")
+	for i := 0; i <= DefaultDeliveryLimit; i++ {
+		receive(t, handled)
+	}
+	nothing(t, handled)
+	if got := queued(t, ch, routing.QueuePerilDeadLetter); len(got) != 1 || got[0] != `"stuck"` {
+		t.Errorf("dead-letter queue holds %v", got)
+	}
+}
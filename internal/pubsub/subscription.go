@@ -0,0 +1,278 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrSubscriptionClosed = errors.New("pubsub: subscription channel was closed")
+
+var consumerSeq atomic.Uint64
+
+// Subscription is a running consumer started by Subscribe. Cancelling the
+// context it was started with, or calling Close, cancels the consumer, lets
+// the in-flight handler finish and settle its delivery, and then closes the
+// subscription's channel so that anything prefetched but not yet handled
+// goes back to the queue.
+type Subscription struct {
+	// ctx is handed to handlers, and cancelled when the subscription stops.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+	broker     Broker
+	queue      string
+	queueType  SimpleQueueType
+	config     subscribeConfig
+	poisoned   atomic.Uint64
+	duplicates atomic.Uint64
+	// streamNext is one past the last stream offset handled, or zero.
+	streamNext atomic.Int64
+
+	mu       sync.Mutex
+	ch       Channel
+	tag      string
+	finished chan struct{}
+	err      error
+
+	sideMu sync.Mutex
+	side   Channel
+	// confirmer carries retries and dead letters, which must reach the
+	// broker before the delivery they replace is acked.
+	confirmer *ConfirmingPublisher
+}
+
+type subscribeConfig struct {
+	decodePolicy  DecodeErrorPolicy
+	onDecodeError func(*DecodeError)
+	retry         RetryPolicy
+	codec         Codec
+	dedup         DedupStore
+	prefetchCount int
+	prefetchSize  int
+	workers       int
+	orderingKey   func(amqp.Delivery) string
+	interceptors  []Interceptor
+	middleware    []any
+	streamOffset  StreamOffset
+	queueOptions  []QueueOption
+	keys          KeyStore
+	cipherKeys    *CipherKeys
+}
+
+// SubscribeOption tunes a single subscription.
+type SubscribeOption func(*subscribeConfig)
+
+// WithDefaultCodec sets the codec used for deliveries whose content type
+// isn't registered, including messages from publishers that predate the
+// registry.
+func WithDefaultCodec(c Codec) SubscribeOption {
+	return func(config *subscribeConfig) {
+		config.codec = c
+	}
+}
+
+// WithQueueOptions declares the subscription's queue with opts.
+func WithQueueOptions(opts ...QueueOption) SubscribeOption {
+	return func(config *subscribeConfig) {
+		config.queueOptions = append(config.queueOptions, opts...)
+	}
+}
+
+func newSubscribeConfig(opts []SubscribeOption) subscribeConfig {
+	config := subscribeConfig{
+		retry:         DefaultRetryPolicy,
+		codec:         JSON,
+		prefetchCount: defaultPrefetchCount,
+		workers:       1,
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	return config
+}
+
+// Close cancels the subscription and waits for it to drain.
+func (s *Subscription) Close() error {
+	s.cancel()
+	return s.Wait()
+}
+
+// Wait blocks until the subscription has stopped and returns why, or nil if
+// it was cancelled.
+func (s *Subscription) Wait() error {
+	<-s.done
+	return s.Err()
+}
+
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscription) attach(ch Channel, tag string, finished chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ch = ch
+	s.tag = tag
+	s.finished = finished
+}
+
+func (s *Subscription) current() (Channel, string, chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ch, s.tag, s.finished
+}
+
+// publishSide publishes on a channel separate from the consuming one.
+func (s *Subscription) publishSide(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	return s.withSide(func(ch Channel) error {
+		return ch.PublishWithContext(ctx, exchange, key, false, false, msg)
+	})
+}
+
+// publishConfirmed publishes on a confirm-mode channel separate from the
+// consuming one and waits for the broker to take the message.
+func (s *Subscription) publishConfirmed(exchange, key string, msg amqp.Publishing) error {
+	s.sideMu.Lock()
+	if s.confirmer == nil {
+		confirmer, err := NewConfirmingPublisher(s.broker, WithMandatory())
+		if err != nil {
+			s.sideMu.Unlock()
+			return err
+		}
+		s.confirmer = confirmer
+	}
+	confirmer := s.confirmer
+	s.sideMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultPublishTimeout)
+	defer cancel()
+
+	return confirmer.PublishWithContext(ctx, exchange, key, false, false, msg)
+}
+
+// withSide runs fn on the side channel, opening or reopening it as needed.
+// A channel-level error from the broker closes the channel, so it is
+// dropped and reopened on the next call.
+func (s *Subscription) withSide(fn func(Channel) error) error {
+	s.sideMu.Lock()
+	defer s.sideMu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if s.side == nil {
+			side, err := s.broker.Channel()
+			if err != nil {
+				return err
+			}
+			s.side = side
+		}
+
+		err := fn(s.side)
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) {
+			s.side.Close()
+			s.side = nil
+		}
+		if !errors.Is(err, amqp.ErrClosed) || attempt > 0 {
+			return err
+		}
+		s.side = nil
+	}
+}
+
+func (s *Subscription) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+}
+
+// run supervises the subscription until ctx is cancelled. When the broker
+// closes the channel it resubscribes through the Manager if there is one,
+// and otherwise stops with the close reason.
+func (s *Subscription) run(ctx context.Context, broker Broker, closed chan *amqp.Error, start func() (chan *amqp.Error, error)) {
+	defer close(s.done)
+
+	m, managed := broker.(*Manager)
+	if managed {
+		m.track()
+		defer m.untrack()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.drain()
+			return
+		case err := <-closed:
+			_, _, finished := s.current()
+			<-finished
+
+			if err == nil {
+				if ctx.Err() == nil {
+					s.fail(ErrSubscriptionClosed)
+				}
+				return
+			}
+
+			if !managed {
+				s.fail(err)
+				return
+			}
+
+			var rerr error
+			closed, rerr = m.resubscribe(ctx, start)
+			if rerr != nil {
+				if ctx.Err() == nil {
+					s.fail(rerr)
+				}
+				return
+			}
+		}
+	}
+}
+
+// drain issues basic.cancel, waits for the handler working on the last
+// delivery to finish, and only then closes the channel.
+func (s *Subscription) drain() {
+	ch, tag, finished := s.current()
+
+	if err := ch.Cancel(tag, false); err != nil {
+		s.fail(err)
+	}
+	<-finished
+
+	if err := ch.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		s.fail(err)
+	}
+
+	s.sideMu.Lock()
+	side, confirmer := s.side, s.confirmer
+	s.side, s.confirmer = nil, nil
+	s.sideMu.Unlock()
+
+	if side != nil {
+		side.Close()
+	}
+	if confirmer != nil {
+		confirmer.Close()
+	}
+}
+
+func consumerTag(queueName string) string {
+	return fmt.Sprintf("peril.%s.%d", queueName, consumerSeq.Add(1))
+}
@@ -0,0 +1,77 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TestSubscriptionDrains checks that Close waits for the handler working on
+// a delivery and that nothing more is consumed afterwards.
+func TestSubscriptionDrains(t *testing.T) {
+	_, conn := newTestBroker(t)
+	ch := newTestChannel(t, conn)
+
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	sub, err := SubscribeJSON(testContext(t), conn, testExchange, "drained", "drained.*", Durable, func(body string) AckType {
+		started <- body
+		<-release
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PublishJSON(ch, testExchange, "drained.alice", "first")
+	receive(t, started)
+
+	closed := make(chan error, 1)
+	go func() { closed <- sub.Close() }()
+	nothing(t, closed)
+	close(release)
+	if err := receive(t, closed); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+
+	PublishJSON(ch, testExchange, "drained.alice", "second")
+	nothing(t, started)
+	if got := queued(t, ch, "drained"); len(got) != 1 || got[0] != `"second"` {
+		t.Errorf("queue holds %v", got)
+	}
+}
+
+func TestSubscriptionCancelled(t *testing.T) {
+	_, conn := newTestBroker(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := SubscribeJSON(ctx, conn, testExchange, "cancelled", "cancelled.*", Transient, func(string) AckType { return Ack })
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := sub.Wait(); err != nil {
+		t.Errorf("Wait() after cancelling = %v", err)
+	}
+}
+
+// TestSubscriptionLost checks that a subscription without a Manager stops
+// with the broker's reason when its connection goes.
+func TestSubscriptionLost(t *testing.T) {
+	b, _ := newTestBroker(t)
+	conn := b.Connect()
+
+	sub, err := SubscribeJSON(testContext(t), conn, testExchange, "lost", "lost.*", Transient, func(string) AckType { return Ack })
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Shutdown("broker restarting")
+
+	receive(t, sub.Done())
+	var amqpErr *amqp.Error
+	if err := sub.Err(); !errors.As(err, &amqpErr) {
+		t.Errorf("Err() = %v, want the broker's close reason", err)
+	}
+}
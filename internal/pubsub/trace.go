@@ -0,0 +1,69 @@
+package pubsub
+
+import (
+	"context"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// WithTraceContext makes the published message part of the trace ctx
+// carries. WithCausedBy does the same from a delivery's Meta.
+func WithTraceContext(ctx context.Context) PublishOption {
+	return func(p *publishConfig) {
+		p.trace = tracing.FromContext(ctx)
+	}
+}
+
+// Context returns the subscription's context, cancelled when it stops,
+// carrying the span the delivery is being handled in and any deadline an
+// interceptor such as Timeout has set.
+func (d Delivery[T]) Context() context.Context {
+	if d.ctx == nil {
+		return tracing.ContextWith(context.Background(), d.Meta.Trace)
+	}
+	return d.ctx
+}
+
+// startSpan starts the producer span for a stamped message and puts its
+// context in the message's traceparent header.
+func (p publishConfig) startSpan(exchange, key string, msg *amqp.Publishing) *tracing.Span {
+	span := tracing.Start(p.trace, "publish "+exchange+" "+routeLabel(key), tracing.KindProducer)
+	span.SetAttribute("exchange", exchange)
+	span.SetAttribute("routing_key", key)
+	span.SetAttribute("message_id", msg.MessageId)
+	span.SetAttribute("correlation_id", msg.CorrelationId)
+
+	msg.Headers[tracing.Header] = span.Context().Traceparent()
+
+	return span
+}
+
+// traceOf reads the span context a delivery was published under.
+func traceOf(d amqp.Delivery) tracing.SpanContext {
+	header, _ := d.Headers[tracing.Header].(string)
+	if header == "" {
+		return tracing.SpanContext{}
+	}
+
+	sc, err := tracing.ParseTraceparent(header)
+	if err != nil {
+		return tracing.SpanContext{}
+	}
+
+	return sc
+}
+
+// startConsumeSpan starts the span covering a delivery from receipt to
+// settlement.
+func startConsumeSpan(queue string, delivery amqp.Delivery) *tracing.Span {
+	span := tracing.Start(traceOf(delivery), "consume "+queue, tracing.KindConsumer)
+	span.SetAttribute("queue", queue)
+	span.SetAttribute("message_id", delivery.MessageId)
+	span.SetAttribute("routing_key", delivery.RoutingKey)
+	if delivery.Redelivered {
+		span.SetAttribute("redelivered", "true")
+	}
+
+	return span
+}
@@ -0,0 +1,129 @@
+package pubsub
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
+)
+
+// spanRecorder keeps every span exported while a test runs.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans map[string]tracing.SpanData
+}
+
+func recordSpans(t *testing.T) *spanRecorder {
+	r := &spanRecorder{spans: map[string]tracing.SpanData{}}
+	tracing.SetExporter(r)
+	t.Cleanup(func() { tracing.SetExporter(nil) })
+
+	return r
+}
+
+func (r *spanRecorder) Export(data tracing.SpanData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.spans[data.SpanId] = data
+	return nil
+}
+
+// ancestry waits for span id to be exported and returns the names of it and
+// its recorded ancestors, nearest first.
+func (r *spanRecorder) ancestry(t *testing.T, id string) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		_, ok := r.spans[id]
+		r.mu.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("span %s never ended", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var names []string
+	for span, ok := r.spans[id]; ok; span, ok = r.spans[span.ParentId] {
+		names = append(names, span.Name)
+	}
+	return names
+}
+
+// TestTracePropagation follows one trace from a publish, through the
+// subscriber handling it, to an RPC the handler makes and the server
+// answering it.
+func TestTracePropagation(t *testing.T) {
+	spans := recordSpans(t)
+	client := serveStatus(t, func(d Delivery[statusRequest]) (statusReply, error) {
+		return statusReply{Player: d.Body.Player}, nil
+	})
+	conn := client.broker.(*MemoryConnection)
+	ch := newTestChannel(t, conn)
+
+	type handled struct {
+		trace tracing.SpanContext
+		err   error
+	}
+	done := make(chan handled, 1)
+	_, err := SubscribeDelivery(testContext(t), conn, testExchange, "moves", "moves.*", Transient, func(d Delivery[string]) AckType {
+		_, err := Call[statusRequest, statusReply](d.Context(), client, rpcExchange, "status", statusRequest{Player: d.Body})
+		done <- handled{d.Meta.Trace, err}
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := tracing.Start(tracing.SpanContext{}, "move", tracing.KindInternal)
+	ctx := tracing.ContextWith(context.Background(), root.Context())
+	if err := PublishJSON(ch, testExchange, "moves.alice", "alice", WithTraceContext(ctx)); err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+
+	h := receive(t, done)
+	if h.err != nil {
+		t.Fatal(h.err)
+	}
+	if h.trace.TraceID != root.Context().TraceID {
+		t.Fatalf("handler ran in trace %s, want %s", h.trace.TraceID, root.Context().TraceID)
+	}
+
+	want := []string{"handle moves", "consume moves", "publish test moves", "move"}
+	if got := spans.ancestry(t, h.trace.SpanID.String()); !slices.Equal(got, want) {
+		t.Errorf("subscriber's span descends from %v, want %v", got, want)
+	}
+
+	// The server's spans are children of the handler's call.
+	var server tracing.SpanData
+	deadline := time.Now().Add(5 * time.Second)
+	for server.SpanId == "" {
+		spans.mu.Lock()
+		for _, span := range spans.spans {
+			if span.Name == "handle status" {
+				server = span
+			}
+		}
+		spans.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal("server's span never ended")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	want = append([]string{"handle status", "consume status", "publish rpc status"}, want...)
+	if got := spans.ancestry(t, server.SpanId); !slices.Equal(got, want) {
+		t.Errorf("server's span descends from %v, want %v", got, want)
+	}
+}
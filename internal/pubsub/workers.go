@@ -0,0 +1,125 @@
+package pubsub
+
+import (
+	"strings"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const defaultPrefetchCount = 10
+
+// WithPrefetch sets how many unacknowledged deliveries (count) and bytes of
+// them (size) the broker will push to the subscription at once. Zero means
+// no limit. For workers to run in parallel the count must be at least the
+// number of workers.
+func WithPrefetch(count, size int) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.prefetchCount = count
+		c.prefetchSize = size
+	}
+}
+
+// WithWorkers runs the handler on n goroutines. Without WithOrderingKey
+// deliveries are handled in whatever order the workers get to them.
+func WithWorkers(n int) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.workers = n
+	}
+}
+
+// WithOrderingKey keeps deliveries that share a key in order by handling
+// them one at a time, while deliveries with different keys are handled in
+// parallel.
+func WithOrderingKey(key func(amqp.Delivery) string) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.orderingKey = key
+	}
+}
+
+// ByRoutingKeySuffix orders by the last word of the original routing key,
+// which for the game's per-player keys ("game_logs.<username>") is the
+// player.
+func ByRoutingKeySuffix(d amqp.Delivery) string {
+	_, key := originalRoute(d)
+	if i := strings.LastIndexByte(key, '.'); i >= 0 {
+		return key[i+1:]
+	}
+
+	return key
+}
+
+// dispatch fans deliveries out to the subscription's workers and returns
+// once every worker has finished, so that the channel is never closed under
+// a handler that is still running.
+//
+// With an ordering key, a delivery whose key is already being handled waits
+// in that key's queue, and the worker handling the key takes it next. Other
+// keys keep flowing to idle workers in the meantime.
+func dispatch(sub *Subscription, deliveries <-chan amqp.Delivery, handle func(amqp.Delivery)) {
+	type keyed struct {
+		d   amqp.Delivery
+		key string
+	}
+
+	var (
+		mu sync.Mutex
+		// waiting holds the queued deliveries of every key a worker is
+		// handling; a key is busy while it is present.
+		waiting = map[string][]amqp.Delivery{}
+		shared  = make(chan keyed)
+		ordered = sub.config.orderingKey != nil
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < sub.config.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range shared {
+				d := k.d
+				for {
+					handle(d)
+					if !ordered {
+						break
+					}
+
+					mu.Lock()
+					queued := waiting[k.key]
+					if len(queued) == 0 {
+						delete(waiting, k.key)
+						mu.Unlock()
+						break
+					}
+					d = queued[0]
+					waiting[k.key] = queued[1:]
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for d := range deliveries {
+		if !ordered {
+			shared <- keyed{d: d}
+			continue
+		}
+
+		key := sub.config.orderingKey(d)
+		mu.Lock()
+		queued, busy := waiting[key]
+		if busy {
+			waiting[key] = append(queued, d)
+		} else {
+			waiting[key] = nil
+		}
+		mu.Unlock()
+
+		if !busy {
+			shared <- keyed{d: d, key: key}
+		}
+	}
+
+	close(shared)
+	wg.Wait()
+}
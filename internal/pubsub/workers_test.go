@@ -0,0 +1,189 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type workerMessage struct {
+	Player string
+	Seq    int
+}
+
+func publishMessages(t *testing.T, conn *MemoryConnection, msgs ...workerMessage) {
+	t.Helper()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+
+	for _, m := range msgs {
+		if err := PublishJSON(ch, testExchange, "work."+m.Player, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWorkersKeepKeyOrder(t *testing.T) {
+	const players, perPlayer = 4, 50
+	_, conn := newTestBroker(t)
+
+	var (
+		mu     sync.Mutex
+		seen   = map[string][]int{}
+		active = map[string]int{}
+	)
+	done := make(chan struct{}, players*perPlayer)
+	_, err := Subscribe(testContext(t), conn, testExchange, "work", "work.*", Transient, func(m workerMessage) AckType {
+		mu.Lock()
+		active[m.Player]++
+		if active[m.Player] > 1 {
+			t.Errorf("%s handled twice at once", m.Player)
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Duration(m.Seq%3) * time.Millisecond)
+
+		mu.Lock()
+		active[m.Player]--
+		seen[m.Player] = append(seen[m.Player], m.Seq)
+		mu.Unlock()
+		done <- struct{}{}
+		return Ack
+	}, WithWorkers(players), WithPrefetch(100, 0), WithOrderingKey(ByRoutingKeySuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []workerMessage
+	for seq := 0; seq < perPlayer; seq++ {
+		for p := 0; p < players; p++ {
+			msgs = append(msgs, workerMessage{Player: fmt.Sprintf("p%d", p), Seq: seq})
+		}
+	}
+	publishMessages(t, conn, msgs...)
+
+	for range msgs {
+		receive(t, done)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for player, seqs := range seen {
+		for i, seq := range seqs {
+			if seq != i {
+				t.Errorf("%s handled out of order: %v", player, seqs)
+				break
+			}
+		}
+	}
+}
+
+// TestWorkersNoHeadOfLineBlocking checks that a key stuck on a slow
+// delivery holds up only its own later deliveries.
+func TestWorkersNoHeadOfLineBlocking(t *testing.T) {
+	_, conn := newTestBroker(t)
+
+	release := make(chan struct{})
+	handled := make(chan workerMessage, 10)
+	_, err := Subscribe(testContext(t), conn, testExchange, "work", "work.*", Transient, func(m workerMessage) AckType {
+		if m.Player == "slow" && m.Seq == 0 {
+			<-release
+		}
+		handled <- m
+		return Ack
+	}, WithWorkers(2), WithPrefetch(10, 0), WithOrderingKey(ByRoutingKeySuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishMessages(t, conn,
+		workerMessage{Player: "slow", Seq: 0},
+		workerMessage{Player: "slow", Seq: 1},
+		workerMessage{Player: "fast", Seq: 0},
+		workerMessage{Player: "fast", Seq: 1},
+		workerMessage{Player: "fast", Seq: 2},
+	)
+
+	for seq := 0; seq < 3; seq++ {
+		if m := receive(t, handled); m.Player != "fast" || m.Seq != seq {
+			t.Fatalf("handled %+v while slow/0 was stuck", m)
+		}
+	}
+	nothing(t, handled)
+
+	close(release)
+	for seq := 0; seq < 2; seq++ {
+		if m := receive(t, handled); m.Player != "slow" || m.Seq != seq {
+			t.Errorf("handled %+v, want slow/%d", m, seq)
+		}
+	}
+}
+
+func TestWorkersRunInParallel(t *testing.T) {
+	const workers = 3
+	_, conn := newTestBroker(t)
+
+	var started sync.WaitGroup
+	started.Add(workers)
+	all := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(all)
+	}()
+
+	_, err := Subscribe(testContext(t), conn, testExchange, "work", "work.*", Transient, func(m workerMessage) AckType {
+		started.Done()
+		<-all
+		return Ack
+	}, WithWorkers(workers), WithPrefetch(workers, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []workerMessage
+	for i := 0; i < workers; i++ {
+		msgs = append(msgs, workerMessage{Player: "p", Seq: i})
+	}
+	publishMessages(t, conn, msgs...)
+
+	receive(t, all)
+}
+
+// TestWorkersDrainOnClose checks that closing a subscription waits for
+// handlers that are still running.
+func TestWorkersDrainOnClose(t *testing.T) {
+	_, conn := newTestBroker(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	var finished atomic.Bool
+	sub, err := Subscribe(ctx, conn, testExchange, "work", "work.*", Transient, func(m workerMessage) AckType {
+		close(started)
+		time.Sleep(20 * time.Millisecond)
+		finished.Store(true)
+		return Ack
+	}, WithWorkers(2), WithOrderingKey(ByRoutingKeySuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishMessages(t, conn, workerMessage{Player: "p"})
+	receive(t, started)
+
+	cancel()
+	if err := sub.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !finished.Load() {
+		t.Error("Wait returned before the handler finished")
+	}
+}
@@ -11,3 +11,23 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+type GameStatusRequest struct {
+	Username string
+}
+
+type GameStatus struct {
+	IsPaused   bool
+	ServerTime time.Time
+}
+
+// PlayerKey is a player's public signing key. A lookup for a player without
+// one answers with an empty PublicKey.
+type PlayerKey struct {
+	Username  string
+	PublicKey []byte
+}
+
+type PlayerKeyRequest struct {
+	Username string
+}
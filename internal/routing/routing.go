@@ -10,9 +10,21 @@ const (
 	ResumeKey = "resume"
 
 	GameLogSlug = "game_logs"
+
+	GameStatusKey = "game_status"
+
+	PlayerKeyRegisterKey = "player_key_register"
+
+	PlayerKeyLookupKey = "player_key_lookup"
 )
 
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+
+	ExchangePerilDeadLetter = "peril_dlx"
+)
+
+const (
+	QueuePerilDeadLetter = "peril_dlq"
 )
@@ -0,0 +1,103 @@
+package topology
+
+import (
+	"encoding/json"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type definitions struct {
+	Exchanges []exchangeDefinition `json:"exchanges"`
+	Queues    []queueDefinition    `json:"queues"`
+	Bindings  []bindingDefinition  `json:"bindings"`
+}
+
+type exchangeDefinition struct {
+	Name       string     `json:"name"`
+	VHost      string     `json:"vhost"`
+	Type       string     `json:"type"`
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"auto_delete"`
+	Internal   bool       `json:"internal"`
+	Arguments  amqp.Table `json:"arguments"`
+}
+
+type queueDefinition struct {
+	Name       string     `json:"name"`
+	VHost      string     `json:"vhost"`
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"auto_delete"`
+	Arguments  amqp.Table `json:"arguments"`
+}
+
+type bindingDefinition struct {
+	Source          string     `json:"source"`
+	VHost           string     `json:"vhost"`
+	Destination     string     `json:"destination"`
+	DestinationType string     `json:"destination_type"`
+	RoutingKey      string     `json:"routing_key"`
+	Arguments       amqp.Table `json:"arguments"`
+}
+
+// Definitions renders the topology in the format accepted by the RabbitMQ
+// management "import definitions" endpoint. Per-player queue templates and
+// exclusive queues only exist while a client is connected, so they and
+// their bindings are left out.
+func (t Topology) Definitions(vhost string) ([]byte, error) {
+	defs := definitions{
+		Exchanges: []exchangeDefinition{},
+		Queues:    []queueDefinition{},
+		Bindings:  []bindingDefinition{},
+	}
+
+	for _, ex := range t.Exchanges {
+		defs.Exchanges = append(defs.Exchanges, exchangeDefinition{
+			Name:       ex.Name,
+			VHost:      vhost,
+			Type:       ex.Kind,
+			Durable:    ex.Durable,
+			AutoDelete: ex.AutoDelete,
+			Internal:   ex.Internal,
+			Arguments:  orEmpty(ex.Args),
+		})
+	}
+
+	static := map[string]struct{}{}
+	for _, q := range t.Queues {
+		if q.Exclusive || strings.Contains(q.Name, UsernameVar) {
+			continue
+		}
+		static[q.Name] = struct{}{}
+		defs.Queues = append(defs.Queues, queueDefinition{
+			Name:       q.Name,
+			VHost:      vhost,
+			Durable:    q.Durable,
+			AutoDelete: q.AutoDelete,
+			Arguments:  orEmpty(q.Args),
+		})
+	}
+
+	for _, b := range t.Bindings {
+		if _, ok := static[b.Queue]; !ok {
+			continue
+		}
+		defs.Bindings = append(defs.Bindings, bindingDefinition{
+			Source:          b.Exchange,
+			VHost:           vhost,
+			Destination:     b.Queue,
+			DestinationType: "queue",
+			RoutingKey:      b.Key,
+			Arguments:       orEmpty(b.Args),
+		})
+	}
+
+	return json.MarshalIndent(defs, "", "  ")
+}
+
+func orEmpty(args amqp.Table) amqp.Table {
+	if args == nil {
+		return amqp.Table{}
+	}
+	return args
+}
@@ -0,0 +1,117 @@
+package topology
+
+import (
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Queue names and templates used by the game.
+const (
+	GameLogsQueue   = routing.GameLogSlug
+	WarQueue        = routing.WarRecognitionsPrefix
+	PauseQueue      = routing.PauseKey + "." + UsernameVar
+	ArmyMovesQueue  = routing.ArmyMovesPrefix + "." + UsernameVar
+	GameStatusQueue = routing.GameStatusKey
+	// GameHistoryStream keeps every game log so that past games can be
+	// replayed.
+	GameHistoryStream = "game_history"
+
+	PlayerKeyRegisterQueue = routing.PlayerKeyRegisterKey
+	PlayerKeyLookupQueue   = routing.PlayerKeyLookupKey
+)
+
+// Binding keys used by the game.
+const (
+	GameLogsKey   = routing.GameLogSlug + ".*"
+	WarKey        = routing.WarRecognitionsPrefix + ".*"
+	PauseKey      = routing.PauseKey
+	ArmyMovesKey  = routing.ArmyMovesPrefix + ".*"
+	GameStatusKey = routing.GameStatusKey
+
+	PlayerKeyRegisterKey = routing.PlayerKeyRegisterKey
+	PlayerKeyLookupKey   = routing.PlayerKeyLookupKey
+)
+
+// Queue policies. Subscriptions must declare their queues with the same
+// options as the manifest.
+const (
+	// ArmyMovesTTL is how long a move may wait for a slow client; after
+	// that the board has moved on and the move is dropped.
+	ArmyMovesTTL       = 30 * time.Second
+	ArmyMovesMaxLength = 1000
+	// PausePriority lets pause and resume overtake anything queued before
+	// them.
+	PausePriority = 9
+)
+
+var (
+	ArmyMovesOptions = []pubsub.QueueOption{
+		pubsub.WithMessageTTL(ArmyMovesTTL),
+		pubsub.WithMaxLength(ArmyMovesMaxLength),
+		pubsub.WithOverflow(pubsub.OverflowDropHead),
+	}
+	PauseOptions = []pubsub.QueueOption{
+		pubsub.WithMaxPriority(PausePriority),
+	}
+)
+
+// Shared is declared by every program: the exchanges, and the dead-letter
+// queue every other queue dead-letters to.
+var Shared = Topology{
+	Exchanges: []Exchange{
+		{Name: routing.ExchangePerilDirect, Kind: amqp.ExchangeDirect, Durable: true},
+		{Name: routing.ExchangePerilTopic, Kind: amqp.ExchangeTopic, Durable: true},
+		{Name: routing.ExchangePerilDeadLetter, Kind: amqp.ExchangeFanout, Durable: true},
+	},
+	Queues: []pubsub.QueueSpec{
+		pubsub.DeadLetterQueueSpec(),
+	},
+	Bindings: []Binding{
+		{Exchange: routing.ExchangePerilDeadLetter, Queue: routing.QueuePerilDeadLetter, Key: ""},
+	},
+}
+
+// serverOwned are the queues the server consumes from.
+var serverOwned = Topology{
+	Queues: []pubsub.QueueSpec{
+		pubsub.NewQueueSpec(GameLogsQueue, pubsub.Quorum),
+		pubsub.NewQueueSpec(GameStatusQueue, pubsub.Durable),
+		pubsub.NewQueueSpec(GameHistoryStream, pubsub.Stream),
+		pubsub.NewQueueSpec(PlayerKeyRegisterQueue, pubsub.Durable),
+		pubsub.NewQueueSpec(PlayerKeyLookupQueue, pubsub.Durable),
+	},
+	Bindings: []Binding{
+		{Exchange: routing.ExchangePerilTopic, Queue: GameLogsQueue, Key: GameLogsKey},
+		{Exchange: routing.ExchangePerilDirect, Queue: GameStatusQueue, Key: GameStatusKey},
+		{Exchange: routing.ExchangePerilTopic, Queue: GameHistoryStream, Key: GameLogsKey},
+		{Exchange: routing.ExchangePerilDirect, Queue: PlayerKeyRegisterQueue, Key: PlayerKeyRegisterKey},
+		{Exchange: routing.ExchangePerilDirect, Queue: PlayerKeyLookupQueue, Key: PlayerKeyLookupKey},
+	},
+}
+
+// playerOwned are the queues clients consume from.
+var playerOwned = Topology{
+	Queues: []pubsub.QueueSpec{
+		pubsub.NewQueueSpec(WarQueue, pubsub.Quorum),
+		pubsub.NewQueueSpec(PauseQueue, pubsub.Transient, PauseOptions...),
+		pubsub.NewQueueSpec(ArmyMovesQueue, pubsub.Transient, ArmyMovesOptions...),
+	},
+	Bindings: []Binding{
+		{Exchange: routing.ExchangePerilTopic, Queue: WarQueue, Key: WarKey},
+		{Exchange: routing.ExchangePerilDirect, Queue: PauseQueue, Key: PauseKey},
+		{Exchange: routing.ExchangePerilTopic, Queue: ArmyMovesQueue, Key: ArmyMovesKey},
+	},
+}
+
+// Server is what the server declares, and Player what each client
+// declares. Neither touches the other's queues.
+var (
+	Server = Shared.Merge(serverOwned)
+	Player = Shared.Merge(playerOwned)
+)
+
+// Peril is the full broker topology for the game.
+var Peril = Shared.Merge(serverOwned, playerOwned)
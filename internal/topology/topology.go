@@ -0,0 +1,238 @@
+package topology
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// UsernameVar is replaced by the player's username in queue templates.
+const UsernameVar = "{username}"
+
+type Exchange struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	Args       amqp.Table
+}
+
+// Binding binds a queue (or queue template) to an exchange.
+type Binding struct {
+	Exchange string
+	Queue    string
+	Key      string
+	Args     amqp.Table
+}
+
+// Topology is a complete description of the broker entities a program
+// needs. Queue names may be templates containing UsernameVar; those are
+// only declared when a username is supplied.
+type Topology struct {
+	Exchanges []Exchange
+	Queues    []pubsub.QueueSpec
+	Bindings  []Binding
+}
+
+// MismatchError means an entity already exists on the broker with flags or
+// arguments that differ from the manifest. RabbitMQ can't change those in
+// place, so the entity has to be deleted and declared again.
+type MismatchError struct {
+	Kind string
+	Name string
+	Err  error
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("topology: %s %q does not match the manifest, delete it so that it can be declared again (see \"Upgrading an existing broker\" in the README): %v", e.Kind, e.Name, e.Err)
+}
+
+func (e *MismatchError) Unwrap() error {
+	return e.Err
+}
+
+// MissingError means an entity in the manifest doesn't exist on the broker.
+type MissingError struct {
+	Kind string
+	Name string
+}
+
+func (e *MissingError) Error() string {
+	return fmt.Sprintf("topology: %s %q does not exist", e.Kind, e.Name)
+}
+
+// Merge returns t with the entities of others added after its own.
+func (t Topology) Merge(others ...Topology) Topology {
+	merged := Topology{
+		Exchanges: append([]Exchange{}, t.Exchanges...),
+		Queues:    append([]pubsub.QueueSpec{}, t.Queues...),
+		Bindings:  append([]Binding{}, t.Bindings...),
+	}
+	for _, o := range others {
+		merged.Exchanges = append(merged.Exchanges, o.Exchanges...)
+		merged.Queues = append(merged.Queues, o.Queues...)
+		merged.Bindings = append(merged.Bindings, o.Bindings...)
+	}
+
+	return merged
+}
+
+// QueueName expands a queue template for username.
+func QueueName(template, username string) string {
+	return strings.ReplaceAll(template, UsernameVar, username)
+}
+
+// Declare idempotently declares every exchange, queue and binding on ch,
+// stopping at the first failure. Templated queues are skipped when username
+// is empty, which is what the server does.
+func (t Topology) Declare(ch pubsub.Channel, username string) error {
+	for _, step := range t.steps(username) {
+		if err := step.declare(ch); err != nil {
+			return step.wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// Verify checks the broker against the manifest without changing it, and
+// returns every difference joined together. Each exchange and queue is
+// looked up with a passive declare, which reports a *MissingError if it
+// doesn't exist. Durable ones that do exist are then declared again exactly
+// as the manifest says, which can't create anything but fails with
+// PRECONDITION_FAILED, reported as a *MismatchError, if their flags or
+// arguments differ. Transient queues come and go with their consumers, so
+// only their existence is checked. Bindings can't be inspected over AMQP
+// and aren't checked. Every check runs on its own channel, since a failed
+// one closes it.
+func (t Topology) Verify(broker pubsub.Broker, username string) error {
+	errs := []error{}
+
+	for _, step := range t.steps(username) {
+		if step.passive == nil {
+			continue
+		}
+
+		ch, err := broker.Channel()
+		if err != nil {
+			return err
+		}
+
+		err = step.passive(ch)
+		if err == nil && step.durable {
+			err = step.declare(ch)
+		}
+		if err != nil {
+			errs = append(errs, step.wrap(err))
+		}
+		ch.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+// OnlyMissing reports whether err, from Verify, is only about entities that
+// don't exist yet, which Declare will create.
+func OnlyMissing(err error) bool {
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+
+	for _, err := range errs {
+		var missing *MissingError
+		if !errors.As(err, &missing) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type step struct {
+	kind    string
+	name    string
+	durable bool
+	declare func(pubsub.Channel) error
+	// passive checks that the entity exists; nil if that can't be done.
+	passive func(pubsub.Channel) error
+}
+
+func (s step) wrap(err error) error {
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		return &MismatchError{Kind: s.kind, Name: s.name, Err: err}
+	}
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+		return &MissingError{Kind: s.kind, Name: s.name}
+	}
+
+	return fmt.Errorf("topology: declaring %s %q: %w", s.kind, s.name, err)
+}
+
+// steps lists the declarations in dependency order: exchanges, then queues,
+// then bindings.
+func (t Topology) steps(username string) []step {
+	steps := []step{}
+
+	for _, ex := range t.Exchanges {
+		ex := ex
+		steps = append(steps, step{
+			kind:    "exchange",
+			name:    ex.Name,
+			durable: ex.Durable && !ex.AutoDelete,
+			declare: func(ch pubsub.Channel) error {
+				return ch.ExchangeDeclare(ex.Name, ex.Kind, ex.Durable, ex.AutoDelete, ex.Internal, false, ex.Args)
+			},
+			passive: func(ch pubsub.Channel) error {
+				return ch.ExchangeDeclarePassive(ex.Name, ex.Kind, ex.Durable, ex.AutoDelete, ex.Internal, false, ex.Args)
+			},
+		})
+	}
+
+	for _, q := range t.Queues {
+		if skip(q.Name, username) {
+			continue
+		}
+		q := q
+		q.Name = QueueName(q.Name, username)
+		steps = append(steps, step{
+			kind:    "queue",
+			name:    q.Name,
+			durable: q.Durable && !q.AutoDelete && !q.Exclusive,
+			declare: func(ch pubsub.Channel) error {
+				_, err := q.Declare(ch)
+				return err
+			},
+			passive: func(ch pubsub.Channel) error {
+				_, err := q.DeclarePassive(ch)
+				return err
+			},
+		})
+	}
+
+	for _, b := range t.Bindings {
+		if skip(b.Queue, username) {
+			continue
+		}
+		b := b
+		b.Queue = QueueName(b.Queue, username)
+		steps = append(steps, step{
+			kind: "binding",
+			name: fmt.Sprintf("%s -> %s (%s)", b.Exchange, b.Queue, b.Key),
+			declare: func(ch pubsub.Channel) error {
+				return ch.QueueBind(b.Queue, b.Key, b.Exchange, false, b.Args)
+			},
+		})
+	}
+
+	return steps
+}
+
+func skip(name, username string) bool {
+	return username == "" && strings.Contains(name, UsernameVar)
+}
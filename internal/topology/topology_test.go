@@ -0,0 +1,76 @@
+package topology
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+func TestOwnership(t *testing.T) {
+	owners := map[string]string{}
+	for name, top := range map[string]Topology{"server": serverOwned, "player": playerOwned} {
+		for _, q := range top.Queues {
+			if other, ok := owners[q.Name]; ok {
+				t.Errorf("%s is declared by both %s and %s", q.Name, other, name)
+			}
+			owners[q.Name] = name
+		}
+	}
+
+	if got, want := len(Peril.Queues), len(Shared.Queues)+len(owners); got != want {
+		t.Errorf("Peril has %d queues, want %d", got, want)
+	}
+}
+
+func TestDeclareAndVerify(t *testing.T) {
+	broker := pubsub.NewMemoryBroker().Connect()
+	defer broker.Close()
+
+	if err := Server.Verify(broker, ""); !OnlyMissing(err) {
+		t.Fatalf("Verify() on an empty broker = %v", err)
+	}
+
+	ch, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Server.Declare(ch, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := Player.Declare(ch, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Peril.Verify(broker, "alice"); err != nil {
+		t.Errorf("Verify() after declaring = %v", err)
+	}
+}
+
+// TestMismatch checks that a queue left over from before it became a quorum
+// queue is reported with what to do about it, and only to its owner.
+func TestMismatch(t *testing.T) {
+	broker := pubsub.NewMemoryBroker().Connect()
+	defer broker.Close()
+
+	ch, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pubsub.NewQueueSpec(GameLogsQueue, pubsub.Durable).Declare(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Player.Verify(broker, "alice"); !OnlyMissing(err) {
+		t.Errorf("a player's Verify() = %v, but game_logs isn't theirs", err)
+	}
+
+	err = Server.Verify(broker, "")
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) || mismatch.Name != GameLogsQueue {
+		t.Fatalf("Verify() = %v, want a *MismatchError for %s", err, GameLogsQueue)
+	}
+	if !strings.Contains(err.Error(), "Upgrading an existing broker") {
+		t.Errorf("error doesn't say how to fix it: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+// Package tracing records spans and carries their context between programs
+// in W3C traceparent form ("00-<trace id>-<span id>-<flags>"), so that the
+// chain of messages set off by one action can be put back together.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header is the message header the span context travels in.
+const Header = "traceparent"
+
+// Span kinds.
+const (
+	KindInternal = "internal"
+	KindProducer = "producer"
+	KindConsumer = "consumer"
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span across programs.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// Traceparent formats c as a traceparent header value, or "" if c is not
+// valid.
+func (c SpanContext) Traceparent() string {
+	if !c.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", c.TraceID, c.SpanID, c.Flags)
+}
+
+// ParseTraceparent reads a traceparent header value. Versions other than 00
+// are read as far as 00 defines them, as the spec asks.
+func ParseTraceparent(s string) (SpanContext, error) {
+	malformed := fmt.Errorf("tracing: malformed traceparent %q", s)
+
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, malformed
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, malformed
+	}
+
+	var c SpanContext
+	var version, flags [1]byte
+	if _, err := hex.Decode(version[:], []byte(parts[0])); err != nil {
+		return SpanContext{}, malformed
+	}
+	if _, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, malformed
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, malformed
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return SpanContext{}, malformed
+	}
+	c.Flags = flags[0]
+
+	if !c.IsValid() {
+		return SpanContext{}, fmt.Errorf("tracing: traceparent %q has a zero ID", s)
+	}
+
+	return c, nil
+}
+
+type contextKey struct{}
+
+// ContextWith returns a copy of ctx carrying sc.
+func ContextWith(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext returns the span context ctx carries, or a zero one.
+func FromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(contextKey{}).(SpanContext)
+	return sc
+}
+
+// Span is one timed operation. End it exactly once.
+type Span struct {
+	context SpanContext
+	parent  SpanID
+	name    string
+	kind    string
+	start   time.Time
+
+	mu    sync.Mutex
+	attrs map[string]string
+	err   string
+	ended bool
+}
+
+// Start begins a span as a child of parent, or as the root of a new trace if
+// parent is not valid.
+func Start(parent SpanContext, name, kind string) *Span {
+	s := &Span{
+		name:  name,
+		kind:  kind,
+		start: time.Now(),
+		attrs: map[string]string{},
+	}
+
+	if parent.IsValid() {
+		s.context.TraceID = parent.TraceID
+		s.context.Flags = parent.Flags
+		s.parent = parent.SpanID
+	} else {
+		randomize(s.context.TraceID[:])
+		s.context.Flags = 0x01
+	}
+	randomize(s.context.SpanID[:])
+
+	return s
+}
+
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err.Error()
+}
+
+// End finishes the span and hands it to the exporter.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+
+	data := SpanData{
+		TraceId:    s.context.TraceID.String(),
+		SpanId:     s.context.SpanID.String(),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      s.start,
+		End:        time.Now(),
+		Attributes: s.attrs,
+		Error:      s.err,
+	}
+	if s.parent != (SpanID{}) {
+		data.ParentId = s.parent.String()
+	}
+	s.mu.Unlock()
+
+	export(data)
+}
+
+func randomize(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		trace = "4bf92f3577b34da6a3ce929d0e0e4736"
+		span  = "00f067aa0ba902b7"
+	)
+
+	c, err := ParseTraceparent("00-" + trace + "-" + span + "-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TraceID.String() != trace || c.SpanID.String() != span || c.Flags != 0x01 {
+		t.Errorf("parsed %+v", c)
+	}
+	if got := c.Traceparent(); got != "00-"+trace+"-"+span+"-01" {
+		t.Errorf("Traceparent() = %q", got)
+	}
+
+	// Later versions may add fields, which are skipped.
+	for _, s := range []string{
+		"01-" + trace + "-" + span + "-01",
+		"cc-" + trace + "-" + span + "-01-what-comes-next",
+	} {
+		if got, err := ParseTraceparent(s); err != nil || got != c {
+			t.Errorf("ParseTraceparent(%q) = %+v, %v", s, got, err)
+		}
+	}
+
+	for name, s := range map[string]string{
+		"empty":            "",
+		"too few fields":   "00-" + trace + "-" + span,
+		"extra field":      "00-" + trace + "-" + span + "-01-extra",
+		"version ff":       "ff-" + trace + "-" + span + "-01",
+		"long version":     "000-" + trace + "-" + span + "-01",
+		"short trace id":   "00-" + trace[2:] + "-" + span + "-01",
+		"short span id":    "00-" + trace + "-" + span[2:] + "-01",
+		"long flags":       "00-" + trace + "-" + span + "-001",
+		"not hex":          "00-" + trace[:31] + "g-" + span + "-01",
+		"flags not hex":    "00-" + trace + "-" + span + "-0x",
+		"zero trace id":    "00-00000000000000000000000000000000-" + span + "-01",
+		"zero span id":     "00-" + trace + "-0000000000000000-01",
+		"future, too few":  "01-" + trace + "-" + span,
+		"future, not hex":  "01-" + trace + "-" + span + "-zz",
+		"future, bad span": "01-" + trace + "-" + span[1:] + "-01",
+		"version not hex":  "zz-" + trace + "-" + span + "-01",
+	} {
+		if got, err := ParseTraceparent(s); err == nil || got.IsValid() {
+			t.Errorf("%s: ParseTraceparent(%q) = %+v, %v", name, s, got, err)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	root := Start(SpanContext{}, "move", KindInternal)
+	if !root.Context().IsValid() || root.Context().Flags != 0x01 {
+		t.Fatalf("root span %+v", root.Context())
+	}
+
+	child := Start(root.Context(), "publish", KindProducer)
+	if child.Context().TraceID != root.Context().TraceID || child.parent != root.Context().SpanID || child.Context().SpanID == root.Context().SpanID {
+		t.Errorf("child %+v of %+v", child.Context(), root.Context())
+	}
+
+	ctx := ContextWith(context.Background(), child.Context())
+	if FromContext(ctx) != child.Context() {
+		t.Error("context lost the span")
+	}
+	if FromContext(context.Background()).IsValid() {
+		t.Error("empty context has a span")
+	}
+}